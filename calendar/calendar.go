@@ -0,0 +1,303 @@
+// Package calendar décrit les heures ouvrées : un horaire hebdomadaire, un
+// fuseau horaire et une liste de jours fériés. Les échéances de SLA et les
+// statistiques de résolution peuvent être calculées en temps ouvré plutôt
+// qu'en temps d'horloge.
+//
+// Sans fichier (GTM_CALENDAR_FILE), un calendrier "business" du lundi au
+// vendredi, 09:00-18:00 à l'heure locale, est disponible. Voir
+// calendar.example.json pour le format.
+package calendar
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	_ "time/tzdata" // fuseaux disponibles même sans base tz sur l'hôte
+)
+
+// Calendar est un calendrier d'heures ouvrées. Un *Calendar nil représente
+// le temps d'horloge (24h/24, 7j/7) : ses méthodes restent utilisables.
+type Calendar struct {
+	Name     string `json:"name"`
+	Timezone string `json:"timezone"`
+	// Hours associe un jour ("mon" ... "sun") à des plages "HH:MM-HH:MM".
+	Hours    map[string][]string `json:"hours"`
+	Holidays []string            `json:"holidays"` // dates "2006-01-02"
+
+	loc      *time.Location
+	week     [7][]span
+	holidays map[string]bool
+}
+
+// span est une plage ouvrée, en minutes depuis minuit.
+type span struct {
+	start, end int
+}
+
+// Set regroupe les calendriers déclarés ; Default nomme celui utilisé quand
+// aucun n'est précisé.
+type Set struct {
+	Default   string      `json:"default"`
+	Calendars []*Calendar `json:"calendars"`
+}
+
+var ErrUnknownCalendar = errors.New("calendrier inconnu")
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+var dayNames = [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"}
+
+// Default est l'ensemble utilisé quand aucun fichier n'est configuré.
+func Default() *Set {
+	office := []string{"09:00-18:00"}
+	s := &Set{
+		Default: "business",
+		Calendars: []*Calendar{{
+			Name: "business",
+			Hours: map[string][]string{
+				"mon": office, "tue": office, "wed": office, "thu": office, "fri": office,
+			},
+		}},
+	}
+	if err := s.Validate(); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Load lit un ensemble de calendriers JSON ; un chemin vide renvoie Default().
+func Load(path string) (*Set, error) {
+	if path == "" {
+		return Default(), nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Set
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("%s : %w", path, err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("%s : %w", path, err)
+	}
+	return &s, nil
+}
+
+// Validate vérifie chaque calendrier et prépare les plages horaires.
+func (s *Set) Validate() error {
+	if len(s.Calendars) == 0 {
+		return errors.New("aucun calendrier déclaré")
+	}
+	seen := map[string]bool{}
+	for _, cal := range s.Calendars {
+		if cal.Name == "" {
+			return errors.New("calendrier sans nom")
+		}
+		if seen[cal.Name] {
+			return fmt.Errorf("calendrier %q déclaré deux fois", cal.Name)
+		}
+		seen[cal.Name] = true
+		if err := cal.compile(); err != nil {
+			return fmt.Errorf("calendrier %q : %w", cal.Name, err)
+		}
+	}
+	if s.Default == "" {
+		s.Default = s.Calendars[0].Name
+	}
+	if !seen[s.Default] {
+		return fmt.Errorf("calendrier par défaut %q : %w", s.Default, ErrUnknownCalendar)
+	}
+	return nil
+}
+
+// Get renvoie le calendrier name ; un nom vide désigne le calendrier par défaut.
+func (s *Set) Get(name string) (*Calendar, error) {
+	if name == "" {
+		name = s.Default
+	}
+	for _, cal := range s.Calendars {
+		if cal.Name == name {
+			return cal, nil
+		}
+	}
+	return nil, fmt.Errorf("%q : %w", name, ErrUnknownCalendar)
+}
+
+// Names renvoie les noms des calendriers, dans l'ordre du fichier.
+func (s *Set) Names() []string {
+	out := make([]string, 0, len(s.Calendars))
+	for _, cal := range s.Calendars {
+		out = append(out, cal.Name)
+	}
+	return out
+}
+
+func (cal *Calendar) compile() error {
+	cal.loc = time.Local
+	if cal.Timezone != "" {
+		loc, err := time.LoadLocation(cal.Timezone)
+		if err != nil {
+			return err
+		}
+		cal.loc = loc
+	}
+
+	cal.week = [7][]span{}
+	open := false
+	for day, ranges := range cal.Hours {
+		wd, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("jour inconnu %q", day)
+		}
+		for _, r := range ranges {
+			sp, err := parseSpan(r)
+			if err != nil {
+				return err
+			}
+			cal.week[wd] = append(cal.week[wd], sp)
+			open = true
+		}
+	}
+	if !open {
+		return errors.New("aucune plage horaire")
+	}
+	// Add et Between parcourent les plages dans l'ordre et comptent chacune :
+	// une plage qui en chevauche une autre compterait deux fois le même temps.
+	for wd, spans := range cal.week {
+		slices.SortFunc(spans, func(a, b span) int { return a.start - b.start })
+		for i := 1; i < len(spans); i++ {
+			if spans[i].start < spans[i-1].end {
+				return fmt.Errorf("le %s, les plages %s et %s se chevauchent", dayNames[wd], spans[i-1], spans[i])
+			}
+		}
+	}
+
+	cal.holidays = map[string]bool{}
+	for _, h := range cal.Holidays {
+		if _, err := time.Parse(time.DateOnly, h); err != nil {
+			return fmt.Errorf("jour férié %q : %w", h, err)
+		}
+		cal.holidays[h] = true
+	}
+	return nil
+}
+
+// parseSpan lit une plage "09:00-12:30" ; "24:00" est permis en fin de plage.
+func parseSpan(r string) (span, error) {
+	from, to, ok := strings.Cut(r, "-")
+	if !ok {
+		return span{}, fmt.Errorf("plage %q : format attendu HH:MM-HH:MM", r)
+	}
+	start, err1 := parseClock(strings.TrimSpace(from))
+	end, err2 := parseClock(strings.TrimSpace(to))
+	if err1 != nil || err2 != nil || start >= end {
+		return span{}, fmt.Errorf("plage %q invalide", r)
+	}
+	return span{start, end}, nil
+}
+
+func (sp span) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", sp.start/60, sp.start%60, sp.end/60, sp.end%60)
+}
+
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil {
+		return 0, err
+	}
+	if h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("heure %q invalide", s)
+	}
+	return h*60 + m, nil
+}
+
+// maxDays borne les parcours jour par jour (un calendrier dont toutes les
+// plages tombent sur des jours fériés ne doit pas faire boucler Add).
+const maxDays = 10 * 366
+
+// periods renvoie les plages ouvrées du jour qui contient day.
+func (cal *Calendar) periods(day time.Time) [][2]time.Time {
+	y, m, d := day.Date()
+	if cal.holidays[day.Format(time.DateOnly)] {
+		return nil
+	}
+	var out [][2]time.Time
+	for _, sp := range cal.week[day.Weekday()] {
+		start := time.Date(y, m, d, sp.start/60, sp.start%60, 0, 0, cal.loc)
+		end := time.Date(y, m, d, sp.end/60, sp.end%60, 0, 0, cal.loc)
+		out = append(out, [2]time.Time{start, end})
+	}
+	return out
+}
+
+func midnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// Add renvoie l'instant atteint après d de temps ouvré à partir de start.
+func (cal *Calendar) Add(start time.Time, d time.Duration) time.Time {
+	if cal == nil || d <= 0 {
+		return start.Add(d)
+	}
+	cursor := start.In(cal.loc)
+	day := midnight(cursor)
+	for i := 0; i < maxDays; i++ {
+		for _, p := range cal.periods(day) {
+			from := p[0]
+			if cursor.After(from) {
+				from = cursor
+			}
+			if !from.Before(p[1]) {
+				continue
+			}
+			avail := p[1].Sub(from)
+			if avail >= d {
+				return from.Add(d)
+			}
+			d -= avail
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return start.Add(d)
+}
+
+// Between renvoie le temps ouvré écoulé entre from et to (nul si to précède from).
+func (cal *Calendar) Between(from, to time.Time) time.Duration {
+	if cal == nil {
+		if to.Before(from) {
+			return 0
+		}
+		return to.Sub(from)
+	}
+	from, to = from.In(cal.loc), to.In(cal.loc)
+	var total time.Duration
+	for day, i := midnight(from), 0; !day.After(to) && i < maxDays; day, i = day.AddDate(0, 0, 1), i+1 {
+		for _, p := range cal.periods(day) {
+			start, end := p[0], p[1]
+			if from.After(start) {
+				start = from
+			}
+			if to.Before(end) {
+				end = to
+			}
+			if end.After(start) {
+				total += end.Sub(start)
+			}
+		}
+	}
+	return total
+}
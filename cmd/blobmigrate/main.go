@@ -0,0 +1,75 @@
+// Commande blobmigrate : copie le contenu des pièces jointes d'un pilote de
+// stockage vers un autre, par exemple avant de passer GTM_STORAGE de
+// "local" à "s3". Les deux pilotes sont configurés par les variables GTM_*.
+//
+//	go run ./cmd/blobmigrate -from local -to s3
+//
+// La copie est idempotente : un blob déjà présent à destination est ignoré.
+// L'empreinte SHA-256 de chaque blob copié est comparée à celle enregistrée.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"sae/config"
+	"sae/db"
+	"sae/storage"
+)
+
+func main() {
+	from := flag.String("from", "local", "pilote source (local ou s3)")
+	to := flag.String("to", "s3", "pilote destination (local ou s3)")
+	remove := flag.Bool("delete", false, "supprimer le blob source après une copie vérifiée")
+	dryRun := flag.Bool("dry-run", false, "afficher ce qui serait copié sans rien écrire")
+	flag.Parse()
+
+	if *from == *to {
+		log.Fatal("la source et la destination doivent être différentes")
+	}
+
+	cfg := config.Load()
+	src, err := storage.Open(*from, cfg)
+	if err != nil {
+		log.Fatal("Source : ", err)
+	}
+	dst, err := storage.Open(*to, cfg)
+	if err != nil {
+		log.Fatal("Destination : ", err)
+	}
+
+	database, err := db.InitDB()
+	if err != nil {
+		log.Fatal("Erreur DB : ", err)
+	}
+
+	var attachments []db.Attachment
+	if err := database.Order("id").Find(&attachments).Error; err != nil {
+		log.Fatal("Erreur DB : ", err)
+	}
+
+	blobs := make([]storage.Blob, 0, len(attachments))
+	for _, a := range attachments {
+		blobs = append(blobs, storage.Blob{Key: a.StorageKey, Size: a.Size, ContentType: a.MimeType, Checksum: a.Checksum})
+	}
+
+	res := storage.Migrate(context.Background(), src, dst, blobs, storage.MigrateOptions{
+		DeleteSource: *remove,
+		DryRun:       *dryRun,
+		Report: func(b storage.Blob, err error) {
+			if err == nil {
+				fmt.Printf("copierait %s (%d octets)\n", b.Key, b.Size)
+				return
+			}
+			log.Printf("%s : %v", b.Key, err)
+		},
+	})
+
+	fmt.Printf("%d copiés, %d déjà présents, %d en erreur\n", res.Copied, res.Skipped, res.Failed)
+	if res.Failed > 0 {
+		os.Exit(1)
+	}
+}
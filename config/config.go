@@ -0,0 +1,174 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config regroupe les réglages lus au démarrage dans les variables
+// d'environnement GTM_*. Chaque réglage a une valeur par défaut utilisable
+// en développement.
+type Config struct {
+	// Pièces jointes
+	UploadDir      string   // GTM_UPLOAD_DIR
+	MaxUploadSize  int64    // GTM_MAX_UPLOAD_SIZE, en octets, par fichier
+	MaxUploadFiles int64    // GTM_MAX_UPLOAD_FILES, par envoi
+	AllowedTypes   []string // GTM_ALLOWED_TYPES, types MIME ou préfixes ("image/")
+
+	// Moteur de recherche attendu : "fts5" (index, tag sqlite_fts5) ou
+	// "like" (sans index). Le serveur refuse de démarrer si le binaire a
+	// été compilé avec l'autre.
+	SearchEngine string // GTM_SEARCH
+
+	// Workflow des tickets (fichier JSON, défaut intégré si vide)
+	WorkflowFile string // GTM_WORKFLOW_FILE
+
+	// Calendriers d'heures ouvrées (fichier JSON, défaut intégré si vide)
+	CalendarFile string // GTM_CALENDAR_FILE
+
+	// Escalade des tickets en retard (scheduler en tâche de fond)
+	Scheduler          bool          // GTM_SCHEDULER
+	EscalationInterval time.Duration // GTM_ESCALATION_INTERVAL, entre deux passages
+	EscalationWarning  time.Duration // GTM_ESCALATION_WARNING, avance des alertes (0 : aucune)
+	EscalationAssignee string        // GTM_ESCALATION_ASSIGNEE, reçoit les tickets hors délai
+
+	// Notifications par e-mail (désactivées sans relais SMTP)
+	SMTPAddr        string // GTM_SMTP_ADDR, hôte:port
+	SMTPUsername    string // GTM_SMTP_USERNAME
+	SMTPPassword    string // GTM_SMTP_PASSWORD
+	SMTPFrom        string // GTM_SMTP_FROM
+	MailTemplateDir string // GTM_MAIL_TEMPLATES, gabarits remplaçant ceux par défaut
+	MailMaxAttempts int64  // GTM_MAIL_MAX_ATTEMPTS
+	BaseURL         string // GTM_BASE_URL, pour les liens dans les messages
+
+	// Webhooks sortants (abonnements gérés dans /admin)
+	WebhookMaxAttempts int64 // GTM_WEBHOOK_MAX_ATTEMPTS
+
+	// Alertes de supervision reçues sur /api/v1/alerts : "close" ferme le
+	// ticket à la résolution de l'alerte, "comment" y ajoute seulement un message.
+	AlertResolve string // GTM_ALERT_RESOLVE
+
+	// Import des e-mails entrants (désactivé sans Maildir)
+	Maildir         string        // GTM_MAILDIR
+	MaildirInterval time.Duration // GTM_MAILDIR_INTERVAL, entre deux relèves
+
+	// Stockage des pièces jointes : "local" (UploadDir) ou "s3"
+	StorageDriver string // GTM_STORAGE
+	S3Endpoint    string // GTM_S3_ENDPOINT, hôte[:port]
+	S3Bucket      string // GTM_S3_BUCKET
+	S3AccessKey   string // GTM_S3_ACCESS_KEY
+	S3SecretKey   string // GTM_S3_SECRET_KEY
+	S3Region      string // GTM_S3_REGION
+	S3UseSSL      bool   // GTM_S3_USE_SSL
+
+	// Sessions navigateur, stockées en base : une session inactive pendant
+	// SessionTTL expire.
+	SessionTTL time.Duration // GTM_SESSION_TTL
+
+	// Passkeys (WebAuthn) : identifiant du site (nom de domaine, sans port)
+	// et origines acceptées ; par défaut, l'hôte et l'origine de BaseURL.
+	WebAuthnRPID    string   // GTM_WEBAUTHN_RP_ID
+	WebAuthnOrigins []string // GTM_WEBAUTHN_ORIGINS
+}
+
+func Load() Config {
+	return Config{
+		UploadDir:      env("GTM_UPLOAD_DIR", "uploads"),
+		MaxUploadSize:  envInt("GTM_MAX_UPLOAD_SIZE", 10<<20),
+		MaxUploadFiles: envInt("GTM_MAX_UPLOAD_FILES", 10),
+		AllowedTypes: envList("GTM_ALLOWED_TYPES", []string{
+			"image/",
+			"text/plain",
+			"application/pdf",
+			"application/zip",
+			"application/json",
+		}),
+		SearchEngine:       env("GTM_SEARCH", "fts5"),
+		WorkflowFile:       env("GTM_WORKFLOW_FILE", ""),
+		CalendarFile:       env("GTM_CALENDAR_FILE", ""),
+		Scheduler:          envBool("GTM_SCHEDULER", true),
+		EscalationInterval: envDuration("GTM_ESCALATION_INTERVAL", time.Minute),
+		EscalationWarning:  envDuration("GTM_ESCALATION_WARNING", 30*time.Minute),
+		EscalationAssignee: env("GTM_ESCALATION_ASSIGNEE", ""),
+		SMTPAddr:           env("GTM_SMTP_ADDR", ""),
+		SMTPUsername:       env("GTM_SMTP_USERNAME", ""),
+		SMTPPassword:       env("GTM_SMTP_PASSWORD", ""),
+		SMTPFrom:           env("GTM_SMTP_FROM", "Go Ticket Manager <tickets@localhost>"),
+		MailTemplateDir:    env("GTM_MAIL_TEMPLATES", ""),
+		MailMaxAttempts:    envInt("GTM_MAIL_MAX_ATTEMPTS", 8),
+		BaseURL:            env("GTM_BASE_URL", "https://localhost"),
+		Maildir:            env("GTM_MAILDIR", ""),
+		MaildirInterval:    envDuration("GTM_MAILDIR_INTERVAL", 30*time.Second),
+		WebhookMaxAttempts: envInt("GTM_WEBHOOK_MAX_ATTEMPTS", 10),
+		AlertResolve:       env("GTM_ALERT_RESOLVE", "close"),
+		StorageDriver:      env("GTM_STORAGE", "local"),
+		S3Endpoint:         env("GTM_S3_ENDPOINT", ""),
+		S3Bucket:           env("GTM_S3_BUCKET", "attachments"),
+		S3AccessKey:        env("GTM_S3_ACCESS_KEY", ""),
+		S3SecretKey:        env("GTM_S3_SECRET_KEY", ""),
+		S3Region:           env("GTM_S3_REGION", ""),
+		S3UseSSL:           envBool("GTM_S3_USE_SSL", true),
+		SessionTTL:         envDuration("GTM_SESSION_TTL", 7*24*time.Hour),
+		WebAuthnRPID:       env("GTM_WEBAUTHN_RP_ID", ""),
+		WebAuthnOrigins:    envList("GTM_WEBAUTHN_ORIGINS", nil),
+	}
+}
+
+// TypeAllowed indique si un type MIME (sans paramètres) est autorisé.
+// Une entrée terminée par "/" autorise toute la famille.
+func (c Config) TypeAllowed(mime string) bool {
+	for _, allowed := range c.AllowedTypes {
+		if mime == allowed || (strings.HasSuffix(allowed, "/") && strings.HasPrefix(mime, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+func env(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int64) int64 {
+	v, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
+
+func envBool(key string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envDuration lit une durée Go ("90s", "15m", "1h") ; "0" est accepté.
+func envDuration(key string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || v < 0 {
+		return def
+	}
+	return v
+}
+
+func envList(key string, def []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
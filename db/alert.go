@@ -0,0 +1,61 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Alert rattache une alerte de supervision (identifiée par son empreinte,
+// le "fingerprint" d'Alertmanager) au ticket qu'elle a ouvert. Tant que ce
+// ticket n'est pas fermé, les nouveaux envois de la même alerte le mettent à
+// jour au lieu d'en créer un autre.
+type Alert struct {
+	gorm.Model
+	Fingerprint string `gorm:"index"`
+	// OpenFingerprint vaut Fingerprint tant que le ticket est ouvert, NULL
+	// ensuite : l'index unique interdit deux alertes ouvertes de même
+	// empreinte, même reçues en parallèle.
+	OpenFingerprint *string `gorm:"uniqueIndex"`
+	Name            string
+	TicketID        uint `gorm:"index"`
+	Ticket          Ticket
+	Status          string // AlertFiring ou AlertResolved
+	StartsAt        time.Time
+	EndsAt          *time.Time
+	LastSeenAt      time.Time
+	Firings         int // nombre d'envois reçus à l'état firing
+}
+
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// LatestAlert renvoie la dernière alerte enregistrée pour fingerprint, avec
+// son ticket ; false s'il n'y en a pas ou si le ticket a été supprimé.
+func LatestAlert(db *gorm.DB, fingerprint string) (Alert, bool) {
+	var alert Alert
+	err := db.Preload("Ticket").Where("fingerprint = ?", fingerprint).Order("id desc").First(&alert).Error
+	if err != nil || alert.Ticket.ID == 0 {
+		return alert, false
+	}
+	return alert, true
+}
+
+// CloseAlert détache l'alerte de son ticket fermé ou supprimé : un nouvel
+// envoi de la même empreinte ouvrira un autre ticket.
+func CloseAlert(db *gorm.DB, alert *Alert) error {
+	alert.OpenFingerprint = nil
+	return db.Model(alert).Update("open_fingerprint", nil).Error
+}
+
+// PriorityRank renvoie le rang de p dans Priorities (-1 si inconnue).
+func PriorityRank(p string) int {
+	for i, known := range Priorities {
+		if known == p {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+var ErrInvalidAssignee = errors.New("seul un utilisateur qui traite les tickets (permission ticket.handle) peut être assigné")
+
+// IsAgent indique si l'utilisateur peut se voir assigner des tickets
+// (permission ticket.handle).
+func IsAgent(db *gorm.DB, u User) bool {
+	return RoleHas(db, u.Role, PermTicketHandle)
+}
+
+// Agents renvoie les utilisateurs assignables, par nom.
+func Agents(db *gorm.DB) ([]User, error) {
+	var users []User
+	err := db.Where("role IN (?)", RolesWith(db, PermTicketHandle)).Order("username").Find(&users).Error
+	return users, err
+}
+
+// AssignTicket assigne le ticket à assigneeID (0 pour le désassigner) et
+// trace le changement dans l'historique. Le ticket n'est pas enregistré :
+// l'appelant le fait, avec SaveTicket.
+func AssignTicket(db *gorm.DB, ticket *Ticket, assigneeID uint, actor string) error {
+	var oldName, newName string
+	if ticket.AssigneeID != nil {
+		var old User
+		if err := db.Unscoped().First(&old, *ticket.AssigneeID).Error; err == nil {
+			oldName = old.Username
+		}
+	}
+
+	var assignee *User
+	if assigneeID != 0 {
+		var u User
+		if err := db.First(&u, assigneeID).Error; err != nil || !IsAgent(db, u) {
+			return ErrInvalidAssignee
+		}
+		assignee = &u
+		newName = u.Username
+	}
+
+	if oldName == newName && (ticket.AssigneeID == nil) == (assignee == nil) {
+		return nil
+	}
+
+	LogTicketChange(db, *ticket, actor, "Assignee", oldName, newName)
+	if assignee == nil {
+		ticket.AssigneeID = nil
+	} else {
+		ticket.AssigneeID = &assignee.ID
+	}
+	ticket.Assignee = assignee
+	Publish(db, Event{Type: EventTicketAssigned, Ticket: *ticket, Actor: actor, Data: map[string]string{
+		"from": oldName, "to": newName,
+	}})
+	return nil
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"gorm.io/gorm"
+)
+
+// Attachment décrit un fichier joint à un ticket, ou à l'un de ses
+// commentaires si CommentID est renseigné. Le contenu est stocké hors de la
+// base, sous StorageKey.
+type Attachment struct {
+	gorm.Model
+	TicketID   uint  `gorm:"index"`
+	CommentID  *uint `gorm:"index"`
+	Filename   string
+	Size       int64
+	MimeType   string
+	Checksum   string // SHA-256 hexadécimal du contenu
+	StorageKey string
+	UploadedBy string
+}
+
+// TicketAttachments renvoie les pièces jointes d'un ticket. Celles des notes
+// internes ne sont incluses que si withInternal est vrai.
+func TicketAttachments(db *gorm.DB, ticketID uint, withInternal bool) ([]Attachment, error) {
+	var attachments []Attachment
+	q := db.Where("attachments.ticket_id = ?", ticketID)
+	if !withInternal {
+		q = q.Where("attachments.comment_id IS NULL OR attachments.comment_id NOT IN (?)",
+			db.Model(&TicketComment{}).Select("id").Where("internal = ?", true))
+	}
+	err := q.Order("attachments.created_at, attachments.id").Find(&attachments).Error
+	return attachments, err
+}
+
+// AttachmentVisible indique si la pièce jointe est visible pour un
+// utilisateur qui voit déjà le ticket : seule une note interne la masque.
+func AttachmentVisible(db *gorm.DB, a Attachment, withInternal bool) bool {
+	if a.CommentID == nil || withInternal {
+		return true
+	}
+	var comment TicketComment
+	if err := db.First(&comment, *a.CommentID).Error; err != nil {
+		return false
+	}
+	return !comment.Internal
+}
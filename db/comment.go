@@ -0,0 +1,117 @@
+package db
+
+import (
+	"errors"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// TicketComment est un message de la conversation d'un ticket. ParentID
+// désigne le message auquel on répond (nil pour un message de premier niveau).
+// Une note interne (Internal) n'est jamais montrée au rôle Client.
+type TicketComment struct {
+	gorm.Model
+	TicketID    uint `gorm:"index"`
+	ParentID    *uint
+	Author      string
+	Body        string
+	Internal    bool         `gorm:"index"`
+	Attachments []Attachment `gorm:"foreignKey:CommentID"`
+}
+
+// Champs d'historique utilisés pour tracer les messages. Les entrées
+// InternalNote doivent être filtrées comme les notes elles-mêmes.
+const (
+	HistoryComment      = "Comment"
+	HistoryInternalNote = "InternalNote"
+)
+
+// CommentThread est un commentaire et ses réponses, pour l'affichage en fil.
+type CommentThread struct {
+	TicketComment
+	Replies []*CommentThread
+}
+
+var ErrInvalidParent = errors.New("le message parent n'appartient pas à ce ticket")
+
+// AddTicketComment enregistre un commentaire et le trace dans l'historique du
+// ticket. Un message public ne peut pas répondre à une note interne : le
+// client verrait une réponse à un message qu'il ne peut pas lire.
+func AddTicketComment(db *gorm.DB, ticket Ticket, author, body string, parentID *uint, internal bool) (TicketComment, error) {
+	comment := TicketComment{
+		TicketID: ticket.ID,
+		ParentID: parentID,
+		Author:   author,
+		Body:     body,
+		Internal: internal,
+	}
+
+	if parentID != nil {
+		var parent TicketComment
+		if err := db.Where("ticket_id = ?", ticket.ID).First(&parent, *parentID).Error; err != nil {
+			return comment, ErrInvalidParent
+		}
+		if parent.Internal && !internal {
+			return comment, ErrInvalidParent
+		}
+	}
+
+	// Le message, son historique et ce que les abonnés mettent en file sont
+	// validés ensemble.
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&comment).Error; err != nil {
+			return err
+		}
+		field := HistoryComment
+		if internal {
+			field = HistoryInternalNote
+		} else if MarkFirstResponse(&ticket, author) {
+			if err := tx.Model(&ticket).UpdateColumn("first_response_at", ticket.FirstResponseAt).Error; err != nil {
+				return err
+			}
+		}
+		LogTicketChange(tx, ticket, author, field, "", body)
+		Publish(tx, Event{Type: EventTicketCommented, Ticket: ticket, Actor: author, Data: map[string]string{
+			"comment_id": strconv.FormatUint(uint64(comment.ID), 10),
+			"internal":   strconv.FormatBool(internal),
+			"body":       body,
+		}})
+		return nil
+	})
+	return comment, err
+}
+
+// TicketComments renvoie les commentaires d'un ticket, du plus ancien au plus
+// récent. Les notes internes ne sont incluses que si withInternal est vrai.
+func TicketComments(db *gorm.DB, ticketID uint, withInternal bool) ([]TicketComment, error) {
+	var comments []TicketComment
+	q := db.Where("ticket_id = ?", ticketID)
+	if !withInternal {
+		q = q.Where("internal = ?", false)
+	}
+	err := q.Preload("Attachments").Order("created_at, id").Find(&comments).Error
+	return comments, err
+}
+
+// BuildCommentThreads range les commentaires en arbre. Une réponse dont le
+// parent a disparu est remontée au premier niveau.
+func BuildCommentThreads(comments []TicketComment) []*CommentThread {
+	nodes := make(map[uint]*CommentThread, len(comments))
+	for _, c := range comments {
+		nodes[c.ID] = &CommentThread{TicketComment: c}
+	}
+
+	var roots []*CommentThread
+	for _, c := range comments {
+		node := nodes[c.ID]
+		if c.ParentID != nil {
+			if parent, ok := nodes[*c.ParentID]; ok {
+				parent.Replies = append(parent.Replies, node)
+				continue
+			}
+		}
+		roots = append(roots, node)
+	}
+	return roots
+}
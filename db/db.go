@@ -15,6 +15,21 @@ type User struct {
 	Username string `gorm:"unique"`
 	Password string
 	Role     string
+	Email    string
+
+	// Double authentification (voir totp.go) : le secret est enregistré dès
+	// l'enrôlement, TOTPEnabled seulement après un premier code valide.
+	// TOTPLastStep est la dernière période acceptée, pour refuser un code
+	// rejoué.
+	TOTPSecret   string
+	TOTPEnabled  bool
+	TOTPLastStep int64
+
+	// Verrouillage de /login (voir session.go) : FailedLogins compte les mots
+	// de passe faux consécutifs, LockedUntil refuse toute tentative avant
+	// cette date.
+	FailedLogins int
+	LockedUntil  time.Time
 }
 
 type Ticket struct {
@@ -25,6 +40,22 @@ type Ticket struct {
 	State       string
 	ClosedAt    time.Time
 	Priority    string
+	Resolution  string
+	AssigneeID  *uint   `gorm:"index"`
+	Assignee    *User   `gorm:"foreignKey:AssigneeID"`
+	Labels      []Label `gorm:"many2many:ticket_labels"`
+	QueueID     *uint   `gorm:"index"`
+	Queue       *Queue
+	FieldValues []TicketFieldValue `gorm:"foreignKey:TicketID"`
+
+	// Échéances de SLA, calculées d'après la priorité (voir sla.go).
+	FirstResponseAt *time.Time
+	ResponseDueAt   *time.Time
+	ResolutionDueAt *time.Time
+
+	// ReplyToken figure dans l'adresse de réponse des notifications : un
+	// e-mail n'est rattaché au ticket que s'il le porte (voir inbound.go).
+	ReplyToken string
 }
 
 type TicketHistory struct {
@@ -42,7 +73,22 @@ func InitDB() (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	db.AutoMigrate(&User{}, &Ticket{}, &TicketHistory{})
+	db.AutoMigrate(&User{}, &Ticket{}, &TicketHistory{}, &APIToken{}, &TicketComment{}, &Attachment{}, &SLAPolicy{}, &Escalation{}, &OutgoingMail{}, &InboundMail{}, &Webhook{}, &WebhookDelivery{}, &Alert{}, &SavedView{}, &SavedViewPin{}, &Label{}, &Queue{}, &CustomField{}, &TicketFieldValue{}, &Role{}, &RolePermission{}, &UserSession{}, &RecoveryCode{}, &Passkey{}, &PasskeyChallenge{})
+	if err := SeedSLAPolicies(db); err != nil {
+		return nil, err
+	}
+	if err := SeedRoles(db); err != nil {
+		return nil, err
+	}
+	if err := BackfillReplyTokens(db); err != nil {
+		return nil, err
+	}
+	if err := setupEmailIndex(db); err != nil {
+		return nil, err
+	}
+	if err := setupSearch(db); err != nil {
+		return nil, err
+	}
 	return db, nil
 }
 
@@ -65,6 +111,19 @@ func CheckUser(db *gorm.DB, username string) bool {
 	return result.RowsAffected > 0
 }
 
+// DeleteUser supprime l'utilisateur avec tout ce qui ouvre son compte :
+// sessions, jetons d'API, passkeys, défis en cours et codes de secours.
+func DeleteUser(db *gorm.DB, id uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []any{&UserSession{}, &APIToken{}, &Passkey{}, &PasskeyChallenge{}, &RecoveryCode{}} {
+			if err := tx.Where("user_id = ?", id).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&User{}, id).Error
+	})
+}
+
 func TestDB() {
 	db, err := InitDB()
 	if err != nil {
@@ -108,5 +167,21 @@ func LogTicketChange(db *gorm.DB, ticket Ticket, user string, field, oldValue, n
 
 	if err := db.Create(&history).Error; err != nil {
 		log.Println("Erreur lors de l'ajout dans l'historique :", err)
+		return
 	}
+	Publish(db, Event{Type: EventTicketUpdated, Ticket: ticket, Actor: user, At: history.ChangedAt, Data: map[string]string{
+		"field": field, "old": oldValue, "new": newValue,
+	}})
+}
+
+// DeleteTicket supprime le ticket (suppression logique) et publie
+// l'événement ticket.deleted dans la même transaction.
+func DeleteTicket(db *gorm.DB, ticket Ticket, actor string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&ticket).Error; err != nil {
+			return err
+		}
+		Publish(tx, Event{Type: EventTicketDeleted, Ticket: ticket, Actor: actor})
+		return nil
+	})
 }
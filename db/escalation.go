@@ -0,0 +1,61 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Escalation garde la trace de chaque règle d'escalade déclenchée sur un
+// ticket. L'unicité (ticket, règle, échéance) empêche une règle de se
+// déclencher deux fois pour la même échéance, y compris après un redémarrage
+// ou avec plusieurs instances du serveur ; si l'échéance change (nouvelle
+// priorité), la règle peut se déclencher de nouveau.
+type Escalation struct {
+	gorm.Model
+	TicketID uint      `gorm:"uniqueIndex:idx_escalation_once"`
+	Rule     string    `gorm:"uniqueIndex:idx_escalation_once"`
+	DueAt    time.Time `gorm:"uniqueIndex:idx_escalation_once"`
+	FiredAt  time.Time
+}
+
+// ClaimEscalation enregistre l'escalade ; false si elle avait déjà été
+// enregistrée. À appeler dans la transaction qui applique ses effets.
+func ClaimEscalation(db *gorm.DB, ticketID uint, rule string, dueAt time.Time) (bool, error) {
+	esc := Escalation{TicketID: ticketID, Rule: rule, DueAt: dueAt, FiredAt: time.Now()}
+	res := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&esc)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// NextPriority renvoie la priorité immédiatement supérieure ; false si p est
+// déjà la plus haute (ou inconnue).
+func NextPriority(p string) (string, bool) {
+	for i, known := range Priorities {
+		if known == p && i+1 < len(Priorities) {
+			return Priorities[i+1], true
+		}
+	}
+	return "", false
+}
+
+// RaisePriority monte la priorité d'un cran et la trace dans l'historique.
+// Contrairement à SetTicketPriority, les échéances ne sont pas recalculées :
+// le ticket reste jugé sur l'engagement pris à sa création. Le ticket n'est
+// pas enregistré.
+func RaisePriority(db *gorm.DB, ticket *Ticket, actor string) (bool, error) {
+	next, ok := NextPriority(ticket.Priority)
+	if !ok {
+		return false, nil
+	}
+	from := ticket.Priority
+	LogTicketChange(db, *ticket, actor, "Priority", from, next)
+	ticket.Priority = next
+	Publish(db, Event{Type: EventTicketPriorityChanged, Ticket: *ticket, Actor: actor, Data: map[string]string{
+		"from": from, "to": next,
+	}})
+	return true, nil
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Event signale un changement notable sur un ticket. Ticket est l'état du
+// ticket après le changement ; avec SaveTicket, l'état enregistré.
+type Event struct {
+	Type   string
+	Ticket Ticket
+	Actor  string
+	At     time.Time
+	Data   map[string]string
+}
+
+const (
+	EventTicketCreated         = "ticket.created"
+	EventTicketUpdated         = "ticket.updated" // chaque ligne de TicketHistory
+	EventTicketDeleted         = "ticket.deleted"
+	EventTicketStateChanged    = "ticket.state_changed"
+	EventTicketPriorityChanged = "ticket.priority_changed"
+	EventTicketAssigned        = "ticket.assigned"
+	EventTicketCommented       = "ticket.commented"
+	EventTicketEscalated       = "ticket.escalated"
+)
+
+var (
+	subscribersMu sync.RWMutex
+	subscribers   []func(*gorm.DB, Event)
+)
+
+// Subscribe enregistre fn, appelée pour chaque événement publié avec la
+// connexion (éventuellement la transaction) de l'appelant : ce que fn
+// enregistre, par exemple une file d'envoi, est validé ou annulé avec le
+// changement lui-même, à condition que le changement et sa publication
+// soient dans la même transaction (voir SaveTicket). fn ne doit faire aucun
+// appel réseau.
+func Subscribe(fn func(*gorm.DB, Event)) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	subscribers = append(subscribers, fn)
+}
+
+// pendingEvents retient les événements publiés pendant SaveTicket.
+type pendingEvents struct {
+	events []Event
+}
+
+type pendingKey struct{}
+
+// Publish diffuse e à tous les abonnés ; pendant SaveTicket, la diffusion
+// attend que le ticket soit enregistré.
+func Publish(db *gorm.DB, e Event) {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	if pending, ok := db.Statement.Context.Value(pendingKey{}).(*pendingEvents); ok {
+		pending.events = append(pending.events, e)
+		return
+	}
+	dispatch(db, e)
+}
+
+func dispatch(db *gorm.DB, e Event) {
+	subscribersMu.RLock()
+	defer subscribersMu.RUnlock()
+	for _, fn := range subscribers {
+		fn(db, e)
+	}
+}
+
+// SaveTicket applique fn puis enregistre le ticket (sans ses associations),
+// dans une seule transaction. Les événements publiés par fn ne sont diffusés
+// qu'une fois le ticket enregistré, avec son état final : une erreur de fn ou
+// de l'enregistrement annule le changement, son historique et tout ce que les
+// abonnés auraient mis en file.
+func SaveTicket(db *gorm.DB, ticket *Ticket, fn func(tx *gorm.DB) error) error {
+	ctx := db.Statement.Context
+	pending := &pendingEvents{}
+	return db.WithContext(context.WithValue(ctx, pendingKey{}, pending)).Transaction(func(tx *gorm.DB) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if err := tx.Omit(clause.Associations).Save(ticket).Error; err != nil {
+			return err
+		}
+		tx = tx.WithContext(ctx)
+		for _, e := range pending.events {
+			if e.Ticket.ID == ticket.ID {
+				e.Ticket = *ticket
+			}
+			Publish(tx, e)
+		}
+		return nil
+	})
+}
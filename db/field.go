@@ -0,0 +1,422 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CustomField est un champ défini par les admins (numéro d'inventaire,
+// service touché, version d'OS...). Un champ rattaché à des files ne
+// s'applique qu'aux tickets de ces files ; sans file, il s'applique à tous.
+// Son type est fixé à la création : les valeurs déjà saisies en dépendent.
+type CustomField struct {
+	ID uint `gorm:"primarykey"`
+	// Name est la clé du champ : paramètre de filtre cf_<name>, clé JSON de
+	// l'API et champ de l'historique.
+	Name     string `gorm:"uniqueIndex"`
+	Label    string
+	Type     string
+	Options  string // choix, un par ligne (select, multiselect)
+	Required bool
+	Position int
+	Queues   []Queue `gorm:"many2many:queue_fields"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// TicketFieldValue est la valeur d'un champ pour un ticket ; un choix
+// multiple a une ligne par option cochée. Les nombres et les dates sont
+// stockés sous forme normalisée (strconv, AAAA-MM-JJ).
+type TicketFieldValue struct {
+	ID       uint         `gorm:"primarykey"`
+	TicketID uint         `gorm:"index:idx_field_value"`
+	FieldID  uint         `gorm:"index:idx_field_value"`
+	Field    *CustomField `gorm:"foreignKey:FieldID"`
+	Value    string
+}
+
+const (
+	FieldText        = "text"
+	FieldNumber      = "number"
+	FieldDate        = "date"
+	FieldSelect      = "select"
+	FieldMultiSelect = "multiselect"
+)
+
+// FieldTypes liste les types de champ, dans l'ordre du formulaire d'admin.
+var FieldTypes = []string{FieldText, FieldNumber, FieldDate, FieldSelect, FieldMultiSelect}
+
+var (
+	ErrInvalidField      = errors.New("champ invalide")
+	ErrInvalidFieldValue = errors.New("valeur invalide")
+)
+
+// FieldError signale la valeur refusée d'un champ.
+type FieldError struct {
+	Field  CustomField
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s : %s", e.Field.Label, e.Reason)
+}
+
+func (e *FieldError) Unwrap() error { return ErrInvalidFieldValue }
+
+var fieldName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,39}$`)
+
+// OptionList renvoie les choix d'un champ select ou multiselect.
+func (f CustomField) OptionList() []string {
+	var out []string
+	for _, o := range strings.Split(f.Options, "\n") {
+		if o = strings.TrimSpace(o); o != "" {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+// HasOptions indique si le champ se remplit par une liste de choix.
+func (f CustomField) HasOptions() bool {
+	return f.Type == FieldSelect || f.Type == FieldMultiSelect
+}
+
+// InputType renvoie le type de l'élément <input> du champ.
+func (f CustomField) InputType() string {
+	switch f.Type {
+	case FieldNumber, FieldDate:
+		return f.Type
+	}
+	return "text"
+}
+
+// QueueIDs renvoie les files du champ, séparées par des virgules, pour le
+// formulaire de création (vide : toutes les files).
+func (f CustomField) QueueIDs() string {
+	ids := make([]string, len(f.Queues))
+	for i, q := range f.Queues {
+		ids[i] = strconv.FormatUint(uint64(q.ID), 10)
+	}
+	return strings.Join(ids, ",")
+}
+
+// normalizeField valide la définition d'un champ. Les options ne peuvent pas
+// contenir de virgule : elle sépare les valeurs du filtre.
+func normalizeField(f *CustomField) error {
+	f.Name = strings.TrimSpace(f.Name)
+	f.Label = strings.TrimSpace(f.Label)
+	if f.Label == "" {
+		f.Label = f.Name
+	}
+	if !fieldName.MatchString(f.Name) || !slices.Contains(FieldTypes, f.Type) {
+		return ErrInvalidField
+	}
+	options := f.OptionList()
+	if f.HasOptions() && len(options) == 0 {
+		return ErrInvalidField
+	}
+	for _, o := range options {
+		if strings.Contains(o, ",") {
+			return ErrInvalidField
+		}
+	}
+	if !f.HasOptions() {
+		options = nil
+	}
+	f.Options = strings.Join(options, "\n")
+	return nil
+}
+
+// CustomFields renvoie tous les champs et leurs files, dans l'ordre d'affichage.
+func CustomFields(db *gorm.DB) ([]CustomField, error) {
+	var fields []CustomField
+	err := db.Preload("Queues").Order("position, id").Find(&fields).Error
+	return fields, err
+}
+
+// FieldsFor renvoie les champs qui s'appliquent à un ticket de la file
+// queueID (nil : ticket non classé).
+func FieldsFor(db *gorm.DB, queueID *uint) ([]CustomField, error) {
+	var fields []CustomField
+	q := db.Where("NOT EXISTS (SELECT 1 FROM queue_fields WHERE queue_fields.custom_field_id = custom_fields.id)")
+	if queueID != nil {
+		q = q.Or("custom_fields.id IN (SELECT custom_field_id FROM queue_fields WHERE queue_id = ?)", *queueID)
+	}
+	err := q.Order("position, id").Find(&fields).Error
+	return fields, err
+}
+
+func fieldQueues(db *gorm.DB, queueIDs []uint) ([]Queue, error) {
+	var queues []Queue
+	if len(queueIDs) == 0 {
+		return queues, nil
+	}
+	if err := db.Where("id IN ?", queueIDs).Find(&queues).Error; err != nil {
+		return nil, err
+	}
+	if len(queues) != len(uniqueIDs(queueIDs)) {
+		return nil, ErrUnknownQueue
+	}
+	return queues, nil
+}
+
+// CreateField enregistre un champ et le rattache aux files queueIDs.
+func CreateField(db *gorm.DB, f CustomField, queueIDs []uint) (CustomField, error) {
+	if err := normalizeField(&f); err != nil {
+		return f, err
+	}
+	queues, err := fieldQueues(db, queueIDs)
+	if err != nil {
+		return f, err
+	}
+	f.Queues = queues
+	return f, db.Create(&f).Error
+}
+
+// UpdateField modifie le libellé, les options, l'obligation, la position et
+// les files d'un champ ; le nom et le type ne changent pas.
+func UpdateField(db *gorm.DB, f *CustomField, in CustomField, queueIDs []uint) error {
+	f.Label, f.Options, f.Required, f.Position = in.Label, in.Options, in.Required, in.Position
+	if err := normalizeField(f); err != nil {
+		return err
+	}
+	queues, err := fieldQueues(db, queueIDs)
+	if err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Queues").Save(f).Error; err != nil {
+			return err
+		}
+		return tx.Model(f).Association("Queues").Replace(queues)
+	})
+}
+
+// DeleteField supprime le champ et ses valeurs ; l'historique les garde.
+func DeleteField(db *gorm.DB, id uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("field_id = ?", id).Delete(&TicketFieldValue{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM queue_fields WHERE custom_field_id = ?", id).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&CustomField{}, id).Error
+	})
+}
+
+// FieldValues associe à chaque champ (par identifiant) ses valeurs.
+type FieldValues map[uint][]string
+
+// ParseFieldValues lit et valide les valeurs des champs fields ; get renvoie
+// les valeurs saisies pour un nom de champ.
+func ParseFieldValues(fields []CustomField, get func(name string) []string) (FieldValues, error) {
+	out := FieldValues{}
+	for _, f := range fields {
+		var raw []string
+		for _, v := range get(f.Name) {
+			if v = strings.TrimSpace(v); v != "" {
+				raw = append(raw, v)
+			}
+		}
+		if len(raw) == 0 {
+			if f.Required {
+				return nil, &FieldError{f, "valeur requise"}
+			}
+			out[f.ID] = nil
+			continue
+		}
+		if f.Type != FieldMultiSelect && len(raw) > 1 {
+			return nil, &FieldError{f, "une seule valeur attendue"}
+		}
+		values, err := normalizeValues(f, raw)
+		if err != nil {
+			return nil, err
+		}
+		out[f.ID] = values
+	}
+	return out, nil
+}
+
+func normalizeValues(f CustomField, raw []string) ([]string, error) {
+	switch f.Type {
+	case FieldNumber:
+		n, err := strconv.ParseFloat(strings.ReplaceAll(raw[0], ",", "."), 64)
+		if err != nil {
+			return nil, &FieldError{f, "nombre attendu"}
+		}
+		return []string{strconv.FormatFloat(n, 'f', -1, 64)}, nil
+	case FieldDate:
+		if _, err := time.Parse("2006-01-02", raw[0]); err != nil {
+			return nil, &FieldError{f, "date attendue au format AAAA-MM-JJ"}
+		}
+		return raw, nil
+	case FieldSelect, FieldMultiSelect:
+		// Les choix gardent l'ordre de la définition du champ.
+		var out []string
+		for _, o := range f.OptionList() {
+			if slices.Contains(raw, o) {
+				out = append(out, o)
+			}
+		}
+		if len(out) != len(uniqueStrings(raw)) {
+			return nil, &FieldError{f, "choix inconnu"}
+		}
+		return out, nil
+	}
+	return raw, nil
+}
+
+func uniqueStrings(values []string) map[string]bool {
+	out := make(map[string]bool, len(values))
+	for _, v := range values {
+		out[v] = true
+	}
+	return out
+}
+
+// TicketFieldValues renvoie les valeurs enregistrées pour le ticket.
+func TicketFieldValues(db *gorm.DB, ticketID uint) (FieldValues, error) {
+	var rows []TicketFieldValue
+	if err := db.Where("ticket_id = ?", ticketID).Order("id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := FieldValues{}
+	for _, r := range rows {
+		out[r.FieldID] = append(out[r.FieldID], r.Value)
+	}
+	return out, nil
+}
+
+func insertFieldValues(db *gorm.DB, ticketID, fieldID uint, values []string) error {
+	for _, v := range values {
+		if err := db.Create(&TicketFieldValue{TicketID: ticketID, FieldID: fieldID, Value: v}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InitTicketFields enregistre les valeurs saisies à la création du ticket,
+// sans historique (comme les autres champs du ticket).
+func InitTicketFields(db *gorm.DB, ticketID uint, values FieldValues) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for fieldID, v := range values {
+			if err := insertFieldValues(tx, ticketID, fieldID, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CheckRequiredFields vérifie, avant de classer le ticket dans queueID, que
+// chaque champ obligatoire de cette file a une valeur : celle de values si le
+// changement la fournit, sinon celle enregistrée.
+func CheckRequiredFields(db *gorm.DB, ticketID uint, queueID *uint, values FieldValues) error {
+	fields, err := FieldsFor(db, queueID)
+	if err != nil {
+		return err
+	}
+	current, err := TicketFieldValues(db, ticketID)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		v, ok := values[f.ID]
+		if !ok {
+			v = current[f.ID]
+		}
+		if f.Required && len(v) == 0 {
+			return &FieldError{f, "valeur requise"}
+		}
+	}
+	return nil
+}
+
+// SetTicketFields remplace les valeurs des champs fields et trace chaque
+// changement dans l'historique, sous le nom du champ.
+func SetTicketFields(db *gorm.DB, ticket Ticket, fields []CustomField, values FieldValues, actor string) error {
+	current, err := TicketFieldValues(db, ticket.ID)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		next, ok := values[f.ID]
+		if !ok {
+			continue
+		}
+		from, to := strings.Join(current[f.ID], ", "), strings.Join(next, ", ")
+		if from == to {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("ticket_id = ? AND field_id = ?", ticket.ID, f.ID).Delete(&TicketFieldValue{}).Error; err != nil {
+				return err
+			}
+			return insertFieldValues(tx, ticket.ID, f.ID, next)
+		})
+		if err != nil {
+			return err
+		}
+		LogTicketChange(db, ticket, actor, f.Name, from, to)
+	}
+	return nil
+}
+
+// FieldView est un champ et ses valeurs, pour l'affichage et les formulaires.
+type FieldView struct {
+	CustomField
+	Values []string
+}
+
+// Value renvoie les valeurs séparées par des virgules.
+func (v FieldView) Value() string {
+	return strings.Join(v.Values, ", ")
+}
+
+// Has indique si l'option est choisie.
+func (v FieldView) Has(option string) bool {
+	return slices.Contains(v.Values, option)
+}
+
+// PreloadFieldValues charge les valeurs des champs d'une requête de tickets,
+// pour l'API (voir Ticket.FieldValues).
+func PreloadFieldValues(db *gorm.DB) *gorm.DB {
+	return db.Preload("FieldValues", func(q *gorm.DB) *gorm.DB { return q.Order("id") }).Preload("FieldValues.Field")
+}
+
+// LoadFieldValues recharge les valeurs des champs du ticket.
+func LoadFieldValues(db *gorm.DB, ticket *Ticket) error {
+	return db.Preload("Field").Where("ticket_id = ?", ticket.ID).Order("id").Find(&ticket.FieldValues).Error
+}
+
+// NewFieldViews associe aux champs leurs valeurs (aucune si values est nil).
+func NewFieldViews(fields []CustomField, values FieldValues) []FieldView {
+	out := make([]FieldView, len(fields))
+	for i, f := range fields {
+		out[i] = FieldView{CustomField: f, Values: values[f.ID]}
+	}
+	return out
+}
+
+// TicketFields renvoie les champs qui s'appliquent au ticket, avec leurs valeurs.
+func TicketFields(db *gorm.DB, ticket Ticket) ([]FieldView, error) {
+	fields, err := FieldsFor(db, ticket.QueueID)
+	if err != nil {
+		return nil, err
+	}
+	values, err := TicketFieldValues(db, ticket.ID)
+	if err != nil {
+		return nil, err
+	}
+	return NewFieldViews(fields, values), nil
+}
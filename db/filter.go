@@ -0,0 +1,482 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TicketFilter décrit une liste de tickets : filtres, tri et page. Il se lit
+// depuis les paramètres d'URL (ParseTicketFilter) et s'y réécrit (Query),
+// si bien que les listes HTML, l'API et les vues enregistrées partagent les
+// mêmes paramètres :
+//
+//	state, priority             valeurs séparées par des virgules ou répétées
+//	label                       idem ; le ticket doit porter toutes les étiquettes
+//	queue                       noms de files, ou "none" (non classé)
+//	cf_<nom>                    champ personnalisé : texte contenu, nombre ou
+//	                            date exacts ou intervalle "min..max" (bornes
+//	                            facultatives), choix séparés par des virgules
+//	                            (l'un d'eux ; tous pour un choix multiple)
+//	user                        demandeur
+//	assignee                    nom d'un agent, "none" (non assigné) ou "me"
+//	created_from, created_to    dates AAAA-MM-JJ, bornes incluses
+//	closed_from, closed_to
+//	sort                        champ de tri, préfixé par "-" pour l'ordre décroissant
+//	limit, cursor               taille de page et curseur de la page suivante
+type TicketFilter struct {
+	States                 []string
+	Priorities             []string
+	Labels                 []string
+	Queues                 []string
+	Fields                 map[string]string // cf_<nom> → valeur
+	User                   string
+	Assignee               string
+	CreatedFrom, CreatedTo time.Time
+	ClosedFrom, ClosedTo   time.Time
+	Sort                   string
+	Limit                  int
+	Cursor                 string
+
+	// Me remplace "me" dans Assignee : l'utilisateur connecté.
+	Me string
+	// MemberOf limite la liste aux files d'un Supervisor, aux tickets qui
+	// lui sont assignés et à ceux qu'il a ouverts ; nil : pas de limite.
+	// Jamais lu dans l'URL.
+	MemberOf []uint
+
+	fields []fieldCriterion
+}
+
+const (
+	AssigneeNone = "none"
+	AssigneeMe   = "me"
+
+	DefaultTicketSort = "-id"
+	DefaultPageSize   = 50
+	MaxPageSize       = 200
+)
+
+var ErrInvalidFilter = errors.New("filtre invalide")
+
+func invalidFilter(format string, args ...any) error {
+	return fmt.Errorf("%w : %s", ErrInvalidFilter, fmt.Sprintf(format, args...))
+}
+
+// sortField décrit un champ de tri : son expression SQL, sa valeur pour un
+// ticket (reprise dans le curseur) et le type de cette valeur.
+type sortField struct {
+	expr  string
+	value func(Ticket) any
+	kind  string // "int", "string" ou "time"
+}
+
+// Sans échéance, un ticket est classé après tous les autres.
+var noDueDate = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// TicketSorts liste les champs de tri proposés, dans l'ordre d'affichage.
+var TicketSorts = []string{"id", "created_at", "updated_at", "closed_at", "priority", "state", "title", "resolution_due_at"}
+
+var ticketSorts = map[string]sortField{
+	"id":         {"tickets.id", func(t Ticket) any { return int64(t.ID) }, "int"},
+	"created_at": {"tickets.created_at", func(t Ticket) any { return t.CreatedAt }, "time"},
+	"updated_at": {"tickets.updated_at", func(t Ticket) any { return t.UpdatedAt }, "time"},
+	"closed_at":  {"tickets.closed_at", func(t Ticket) any { return t.ClosedAt }, "time"},
+	"priority":   {priorityRankSQL(), func(t Ticket) any { return int64(PriorityRank(t.Priority)) }, "int"},
+	"state":      {"tickets.state", func(t Ticket) any { return t.State }, "string"},
+	"title":      {"tickets.title", func(t Ticket) any { return t.Title }, "string"},
+	"resolution_due_at": {"COALESCE(tickets.resolution_due_at, '" + noDueDate.Format("2006-01-02 15:04:05-07:00") + "')",
+		func(t Ticket) any {
+			if t.ResolutionDueAt == nil {
+				return noDueDate
+			}
+			return *t.ResolutionDueAt
+		}, "time"},
+}
+
+// priorityRankSQL classe les priorités de la plus basse à la plus haute,
+// comme PriorityRank.
+func priorityRankSQL() string {
+	var b strings.Builder
+	b.WriteString("CASE tickets.priority")
+	for i, p := range Priorities {
+		fmt.Fprintf(&b, " WHEN '%s' THEN %d", p, i)
+	}
+	b.WriteString(" ELSE -1 END")
+	return b.String()
+}
+
+// ParseTicketFilter lit un filtre depuis des paramètres d'URL.
+func ParseTicketFilter(v url.Values) (TicketFilter, error) {
+	f := TicketFilter{
+		States:     listParam(v["state"]),
+		Priorities: listParam(v["priority"]),
+		Labels:     listParam(v["label"]),
+		Queues:     listParam(v["queue"]),
+		User:       strings.TrimSpace(v.Get("user")),
+		Assignee:   strings.TrimSpace(v.Get("assignee")),
+		Sort:       v.Get("sort"),
+		Cursor:     v.Get("cursor"),
+	}
+	for key, values := range v {
+		if name, ok := strings.CutPrefix(key, "cf_"); ok && strings.TrimSpace(values[0]) != "" {
+			if f.Fields == nil {
+				f.Fields = map[string]string{}
+			}
+			f.Fields[name] = strings.TrimSpace(values[0])
+		}
+	}
+	for _, p := range f.Priorities {
+		if !IsPriority(p) {
+			return f, invalidFilter("priorité %q inconnue", p)
+		}
+	}
+	if f.Sort == "" {
+		f.Sort = DefaultTicketSort
+	}
+	if _, ok := ticketSorts[strings.TrimPrefix(f.Sort, "-")]; !ok {
+		return f, invalidFilter("tri %q inconnu", f.Sort)
+	}
+
+	var err error
+	dates := []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"created_from", &f.CreatedFrom}, {"created_to", &f.CreatedTo},
+		{"closed_from", &f.ClosedFrom}, {"closed_to", &f.ClosedTo},
+	}
+	for _, d := range dates {
+		if s := v.Get(d.name); s != "" {
+			if *d.dst, err = time.ParseInLocation("2006-01-02", s, time.Local); err != nil {
+				return f, invalidFilter("%s : date attendue au format AAAA-MM-JJ", d.name)
+			}
+		}
+	}
+
+	if s := v.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit < 1 {
+			return f, invalidFilter("limit doit être un entier positif")
+		}
+	}
+	if f.Limit == 0 {
+		f.Limit = DefaultPageSize
+	}
+	f.Limit = min(f.Limit, MaxPageSize)
+	return f, nil
+}
+
+func listParam(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+// Query réécrit le filtre en paramètres d'URL, sans le curseur ; les
+// valeurs par défaut sont omises.
+func (f TicketFilter) Query() url.Values {
+	v := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	set("state", strings.Join(f.States, ","))
+	set("priority", strings.Join(f.Priorities, ","))
+	set("label", strings.Join(f.Labels, ","))
+	set("queue", strings.Join(f.Queues, ","))
+	for name, value := range f.Fields {
+		v.Set("cf_"+name, value)
+	}
+	set("user", f.User)
+	set("assignee", f.Assignee)
+	for key, t := range map[string]time.Time{
+		"created_from": f.CreatedFrom, "created_to": f.CreatedTo,
+		"closed_from": f.ClosedFrom, "closed_to": f.ClosedTo,
+	} {
+		if !t.IsZero() {
+			v.Set(key, t.Format("2006-01-02"))
+		}
+	}
+	if f.Sort != DefaultTicketSort {
+		set("sort", f.Sort)
+	}
+	if f.Limit != DefaultPageSize {
+		v.Set("limit", strconv.Itoa(f.Limit))
+	}
+	return v
+}
+
+// Apply ajoute les conditions du filtre à q (sans tri ni pagination).
+func (f TicketFilter) Apply(q *gorm.DB) *gorm.DB {
+	if len(f.States) > 0 {
+		q = q.Where("tickets.state IN ?", f.States)
+	}
+	if len(f.Priorities) > 0 {
+		q = q.Where("tickets.priority IN ?", f.Priorities)
+	}
+	for _, name := range f.Labels {
+		q = q.Where("tickets.id IN (?)", q.Session(&gorm.Session{NewDB: true}).
+			Table("ticket_labels").Select("ticket_labels.ticket_id").
+			Joins("JOIN labels ON labels.id = ticket_labels.label_id").Where("labels.name = ?", name))
+	}
+	if len(f.Queues) > 0 {
+		var names []string
+		none := false
+		for _, name := range f.Queues {
+			if name == QueueNone {
+				none = true
+			} else {
+				names = append(names, name)
+			}
+		}
+		byName := q.Session(&gorm.Session{NewDB: true}).Model(&Queue{}).Select("id").Where("name IN ?", names)
+		switch {
+		case none && len(names) > 0:
+			q = q.Where("(tickets.queue_id IS NULL OR tickets.queue_id IN (?))", byName)
+		case none:
+			q = q.Where("tickets.queue_id IS NULL")
+		default:
+			q = q.Where("tickets.queue_id IN (?)", byName)
+		}
+	}
+	if f.MemberOf != nil {
+		q = q.Where("(tickets.queue_id IN ? OR tickets.user = ? OR tickets.assignee_id IN (?))", f.MemberOf, f.Me,
+			q.Session(&gorm.Session{NewDB: true}).Model(&User{}).Select("id").Where("username = ?", f.Me))
+	}
+	for _, c := range f.fields {
+		q = c.apply(q)
+	}
+	if f.User != "" {
+		q = q.Where("tickets.user = ?", f.User)
+	}
+	switch assignee := f.Assignee; assignee {
+	case "":
+	case AssigneeNone:
+		q = q.Where("tickets.assignee_id IS NULL")
+	default:
+		if assignee == AssigneeMe {
+			assignee = f.Me
+		}
+		q = q.Where("tickets.assignee_id IN (?)", q.Session(&gorm.Session{NewDB: true}).
+			Model(&User{}).Select("id").Where("username = ?", assignee))
+	}
+	// Les bornes de fin incluent toute la journée.
+	if !f.CreatedFrom.IsZero() {
+		q = q.Where("tickets.created_at >= ?", f.CreatedFrom)
+	}
+	if !f.CreatedTo.IsZero() {
+		q = q.Where("tickets.created_at < ?", f.CreatedTo.AddDate(0, 0, 1))
+	}
+	// Un ticket ouvert a une date de fermeture nulle (0001-01-01).
+	if !f.ClosedFrom.IsZero() || !f.ClosedTo.IsZero() {
+		q = q.Where("tickets.closed_at > ?", time.Time{})
+	}
+	if !f.ClosedFrom.IsZero() {
+		q = q.Where("tickets.closed_at >= ?", f.ClosedFrom)
+	}
+	if !f.ClosedTo.IsZero() {
+		q = q.Where("tickets.closed_at < ?", f.ClosedTo.AddDate(0, 0, 1))
+	}
+	return q
+}
+
+// cursor repère le dernier ticket d'une page : sa valeur de tri et son id.
+type cursor struct {
+	Value json.RawMessage `json:"v"`
+	ID    uint            `json:"id"`
+}
+
+func encodeCursor(field sortField, t Ticket) string {
+	value, _ := json.Marshal(field.value(t))
+	raw, _ := json.Marshal(cursor{Value: value, ID: t.ID})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(field sortField, s string) (any, uint, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	var c cursor
+	if err == nil {
+		err = json.Unmarshal(raw, &c)
+	}
+	if err != nil {
+		return nil, 0, invalidFilter("curseur illisible")
+	}
+	var value any
+	switch field.kind {
+	case "int":
+		var n int64
+		err = json.Unmarshal(c.Value, &n)
+		value = n
+	case "time":
+		var t time.Time
+		err = json.Unmarshal(c.Value, &t)
+		value = t
+	default:
+		var s string
+		err = json.Unmarshal(c.Value, &s)
+		value = s
+	}
+	if err != nil {
+		return nil, 0, invalidFilter("curseur illisible")
+	}
+	return value, c.ID, nil
+}
+
+// TicketPage est une page de résultats ; NextCursor est vide sur la
+// dernière page.
+type TicketPage struct {
+	Tickets    []Ticket
+	NextCursor string
+}
+
+// ListTickets renvoie une page de tickets. La pagination se fait par
+// curseur : la page suivante reprend après le dernier ticket (valeur de tri
+// puis id), sans décalage même si des tickets sont créés entre-temps.
+func ListTickets(db *gorm.DB, f TicketFilter) (TicketPage, error) {
+	var page TicketPage
+	name, desc := strings.CutPrefix(f.Sort, "-")
+	if name == "" {
+		name, desc = "id", true
+	}
+	field, ok := ticketSorts[name]
+	if !ok {
+		return page, invalidFilter("tri %q inconnu", f.Sort)
+	}
+	if f.Limit <= 0 {
+		f.Limit = DefaultPageSize
+	}
+	if err := f.resolveFields(db); err != nil {
+		return page, err
+	}
+
+	dir, cmp := "ASC", ">"
+	if desc {
+		dir, cmp = "DESC", "<"
+	}
+	q := f.Apply(PreloadFieldValues(db.Model(&Ticket{}).Preload("Assignee").Preload("Labels").Preload("Queue")))
+	if f.Cursor != "" {
+		value, id, err := decodeCursor(field, f.Cursor)
+		if err != nil {
+			return page, err
+		}
+		q = q.Where(fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND tickets.id %[2]s ?))", field.expr, cmp), value, value, id)
+	}
+	q = q.Order(fmt.Sprintf("%s %s, tickets.id %s", field.expr, dir, dir)).Limit(f.Limit + 1)
+	if err := q.Find(&page.Tickets).Error; err != nil {
+		return page, err
+	}
+	if len(page.Tickets) > f.Limit {
+		page.Tickets = page.Tickets[:f.Limit]
+		page.NextCursor = encodeCursor(field, page.Tickets[f.Limit-1])
+	}
+	return page, nil
+}
+
+// CountTickets compte les tickets du filtre, toutes pages confondues.
+func CountTickets(db *gorm.DB, f TicketFilter) (int64, error) {
+	var n int64
+	if err := f.resolveFields(db); err != nil {
+		return 0, err
+	}
+	err := f.Apply(db.Model(&Ticket{})).Count(&n).Error
+	return n, err
+}
+
+// fieldCriterion est un critère cf_<nom> rapproché de la définition du champ.
+type fieldCriterion struct {
+	field  CustomField
+	values []string // choix, ou valeur exacte
+	lo, hi any      // intervalle ; nil : borne absente
+}
+
+// resolveFields charge les champs nommés dans Fields et valide les critères
+// selon leur type ; Apply s'en sert ensuite.
+func (f *TicketFilter) resolveFields(db *gorm.DB) error {
+	f.fields = nil
+	for name, raw := range f.Fields {
+		var field CustomField
+		if err := db.Where("name = ?", name).First(&field).Error; err != nil {
+			return invalidFilter("champ %q inconnu", name)
+		}
+		c := fieldCriterion{field: field}
+		switch field.Type {
+		case FieldNumber, FieldDate:
+			parse := func(s string) (any, error) {
+				if field.Type == FieldDate {
+					_, err := time.Parse("2006-01-02", s)
+					return s, err
+				}
+				return strconv.ParseFloat(s, 64)
+			}
+			lo, hi, isRange := strings.Cut(raw, "..")
+			var err error
+			if !isRange {
+				var v any
+				if v, err = parse(raw); err == nil {
+					c.lo, c.hi = v, v
+				}
+			} else {
+				if lo != "" {
+					c.lo, err = parse(lo)
+				}
+				if hi != "" && err == nil {
+					c.hi, err = parse(hi)
+				}
+			}
+			if err != nil {
+				return invalidFilter("cf_%s : nombre, date ou intervalle min..max attendu", name)
+			}
+		case FieldSelect, FieldMultiSelect:
+			c.values = listParam([]string{raw})
+		default:
+			c.values = []string{raw}
+		}
+		f.fields = append(f.fields, c)
+	}
+	return nil
+}
+
+func (c fieldCriterion) apply(q *gorm.DB) *gorm.DB {
+	sub := func(cond string, args ...any) *gorm.DB {
+		return q.Session(&gorm.Session{NewDB: true}).Model(&TicketFieldValue{}).Select("ticket_id").
+			Where("field_id = ?", c.field.ID).Where(cond, args...)
+	}
+	value := "value"
+	if c.field.Type == FieldNumber {
+		value = "CAST(value AS REAL)"
+	}
+	switch c.field.Type {
+	case FieldText:
+		return q.Where("tickets.id IN (?)", sub("value LIKE ? ESCAPE '\\'", "%"+likeEscaper.Replace(c.values[0])+"%"))
+	case FieldSelect:
+		return q.Where("tickets.id IN (?)", sub("value IN ?", c.values))
+	case FieldMultiSelect:
+		for _, v := range c.values {
+			q = q.Where("tickets.id IN (?)", sub("value = ?", v))
+		}
+		return q
+	}
+	switch {
+	case c.lo != nil && c.hi != nil:
+		return q.Where("tickets.id IN (?)", sub(value+" >= ? AND "+value+" <= ?", c.lo, c.hi))
+	case c.lo != nil:
+		return q.Where("tickets.id IN (?)", sub(value+" >= ?", c.lo))
+	case c.hi != nil:
+		return q.Where("tickets.id IN (?)", sub(value+" <= ?", c.hi))
+	}
+	return q
+}
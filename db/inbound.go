@@ -0,0 +1,82 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// InboundMail garde la trace des e-mails reçus et du ticket (et du message)
+// qu'ils ont créé. Son Message-ID évite d'importer deux fois le même e-mail
+// et permet de rattacher les réponses qui le citent.
+type InboundMail struct {
+	gorm.Model
+	MessageID  string `gorm:"uniqueIndex"`
+	From       string
+	Subject    string
+	TicketID   uint `gorm:"index"`
+	CommentID  *uint
+	ReceivedAt time.Time
+}
+
+// InboundMailSeen indique si l'e-mail messageID a déjà été importé.
+func InboundMailSeen(db *gorm.DB, messageID string) bool {
+	var n int64
+	db.Model(&InboundMail{}).Where("message_id = ?", messageID).Count(&n)
+	return n > 0
+}
+
+// TicketForMessageIDs cherche le ticket d'un des Message-ID cités par une
+// réponse (In-Reply-To, References), qu'il s'agisse d'une notification
+// envoyée ou d'un e-mail déjà importé. Les identifiants sont essayés dans
+// l'ordre.
+func TicketForMessageIDs(db *gorm.DB, ids []string) (uint, bool) {
+	for _, id := range ids {
+		var out OutgoingMail
+		if err := db.Where("message_id = ?", id).First(&out).Error; err == nil && out.TicketID != 0 {
+			return out.TicketID, true
+		}
+		var in InboundMail
+		if err := db.Where("message_id = ?", id).First(&in).Error; err == nil && in.TicketID != 0 {
+			return in.TicketID, true
+		}
+	}
+	return 0, false
+}
+
+// NewReplyToken tire le jeton de réponse d'un nouveau ticket.
+func NewReplyToken() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// BackfillReplyTokens donne un jeton de réponse aux tickets créés avant
+// leur introduction.
+func BackfillReplyTokens(db *gorm.DB) error {
+	var ids []uint
+	if err := db.Unscoped().Model(&Ticket{}).Where("reply_token = '' OR reply_token IS NULL").Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		token, err := NewReplyToken()
+		if err != nil {
+			return err
+		}
+		if err := db.Unscoped().Model(&Ticket{}).Where("id = ?", id).UpdateColumn("reply_token", token).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplyTokenValid compare en temps constant le jeton d'une réponse à celui
+// du ticket.
+func ReplyTokenValid(ticket Ticket, token string) bool {
+	return ticket.ReplyToken != "" && subtle.ConstantTimeCompare([]byte(ticket.ReplyToken), []byte(token)) == 1
+}
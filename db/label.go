@@ -0,0 +1,192 @@
+package db
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Label est une étiquette de la taxonomie gérée par les admins. Les tickets
+// y sont rattachés par la table ticket_labels. Une étiquette supprimée
+// disparaît vraiment (pas de suppression logique) pour que son nom, unique,
+// puisse être réutilisé ; l'historique des tickets garde les noms.
+type Label struct {
+	ID          uint   `gorm:"primarykey"`
+	Name        string `gorm:"uniqueIndex"`
+	Color       string // #rrggbb
+	Description string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// HistoryLabels est le champ d'historique des changements d'étiquettes ;
+// les valeurs sont les noms séparés par ", ".
+const HistoryLabels = "Labels"
+
+const DefaultLabelColor = "#6c757d"
+
+var (
+	ErrInvalidLabel = errors.New("étiquette invalide : nom requis, sans virgule, et couleur au format #rrggbb")
+	ErrUnknownLabel = errors.New("étiquette inconnue")
+)
+
+var labelColor = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+// TextColor renvoie la couleur de texte lisible sur le fond de l'étiquette.
+func (l Label) TextColor() string {
+	if !labelColor.MatchString(l.Color) {
+		return "#fff"
+	}
+	r, _ := strconv.ParseUint(l.Color[1:3], 16, 8)
+	g, _ := strconv.ParseUint(l.Color[3:5], 16, 8)
+	b, _ := strconv.ParseUint(l.Color[5:7], 16, 8)
+	if 299*r+587*g+114*b > 150000 {
+		return "#000"
+	}
+	return "#fff"
+}
+
+// normalizeLabel valide et met en forme les champs saisis. La virgule est
+// interdite dans le nom : elle sépare les valeurs du filtre "label".
+func normalizeLabel(l *Label) error {
+	l.Name = strings.TrimSpace(l.Name)
+	l.Description = strings.TrimSpace(l.Description)
+	l.Color = strings.ToLower(strings.TrimSpace(l.Color))
+	if l.Color == "" {
+		l.Color = DefaultLabelColor
+	}
+	if l.Name == "" || strings.Contains(l.Name, ",") || !labelColor.MatchString(l.Color) {
+		return ErrInvalidLabel
+	}
+	return nil
+}
+
+// Labels renvoie toutes les étiquettes, par nom.
+func Labels(db *gorm.DB) ([]Label, error) {
+	var labels []Label
+	err := db.Order("name").Find(&labels).Error
+	return labels, err
+}
+
+// CreateLabel enregistre une nouvelle étiquette.
+func CreateLabel(db *gorm.DB, name, color, description string) (Label, error) {
+	l := Label{Name: name, Color: color, Description: description}
+	if err := normalizeLabel(&l); err != nil {
+		return l, err
+	}
+	return l, db.Create(&l).Error
+}
+
+// UpdateLabel renomme ou recolore une étiquette ; les tickets qui la portent
+// suivent.
+func UpdateLabel(db *gorm.DB, l *Label, name, color, description string) error {
+	l.Name, l.Color, l.Description = name, color, description
+	if err := normalizeLabel(l); err != nil {
+		return err
+	}
+	return db.Save(l).Error
+}
+
+// DeleteLabel retire l'étiquette de tous les tickets, en le traçant dans leur
+// historique, puis la supprime.
+func DeleteLabel(db *gorm.DB, id uint, actor string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var tickets []Ticket
+		err := tx.Preload("Labels").Where("id IN (SELECT ticket_id FROM ticket_labels WHERE label_id = ?)", id).Find(&tickets).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM ticket_labels WHERE label_id = ?", id).Error; err != nil {
+			return err
+		}
+		for _, t := range tickets {
+			from := labelNames(t.Labels)
+			kept := make([]Label, 0, len(t.Labels))
+			for _, l := range t.Labels {
+				if l.ID != id {
+					kept = append(kept, l)
+				}
+			}
+			t.Labels = kept
+			LogTicketChange(tx, t, actor, HistoryLabels, from, labelNames(kept))
+		}
+		return tx.Delete(&Label{}, id).Error
+	})
+}
+
+// LabelsByID charge les étiquettes ids ; ErrUnknownLabel si l'une n'existe pas.
+func LabelsByID(db *gorm.DB, ids []uint) ([]Label, error) {
+	var labels []Label
+	if len(ids) == 0 {
+		return labels, nil
+	}
+	if err := db.Where("id IN ?", ids).Order("name").Find(&labels).Error; err != nil {
+		return nil, err
+	}
+	if len(labels) != len(uniqueIDs(ids)) {
+		return nil, ErrUnknownLabel
+	}
+	return labels, nil
+}
+
+// LabelsByName charge les étiquettes nommées ; ErrUnknownLabel si l'une
+// n'existe pas.
+func LabelsByName(db *gorm.DB, names []string) ([]Label, error) {
+	var labels []Label
+	if len(names) == 0 {
+		return labels, nil
+	}
+	if err := db.Where("name IN ?", names).Order("name").Find(&labels).Error; err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, n := range names {
+		seen[n] = true
+	}
+	if len(labels) != len(seen) {
+		return nil, ErrUnknownLabel
+	}
+	return labels, nil
+}
+
+func uniqueIDs(ids []uint) map[uint]bool {
+	out := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		out[id] = true
+	}
+	return out
+}
+
+func labelNames(labels []Label) string {
+	names := make([]string, 0, len(labels))
+	for _, l := range labels {
+		names = append(names, l.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// SetTicketLabels remplace les étiquettes du ticket et trace le changement
+// dans l'historique (une entrée avec l'ancienne et la nouvelle liste).
+func SetTicketLabels(db *gorm.DB, ticket *Ticket, labels []Label, actor string) error {
+	var current []Label
+	if err := db.Model(ticket).Association("Labels").Find(&current); err != nil {
+		return err
+	}
+	from, to := labelNames(current), labelNames(labels)
+	if from == to {
+		ticket.Labels = current
+		return nil
+	}
+	if err := db.Model(ticket).Association("Labels").Replace(labels); err != nil {
+		return err
+	}
+	ticket.Labels = labels
+	LogTicketChange(db, *ticket, actor, HistoryLabels, from, to)
+	return nil
+}
@@ -0,0 +1,144 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// OutgoingMail est un e-mail en file d'envoi. Le message est mis en forme à
+// l'enregistrement ; l'envoi est fait plus tard, avec de nouvelles tentatives
+// en cas d'échec (voir le package notify).
+type OutgoingMail struct {
+	gorm.Model
+	Event         string
+	TicketID      uint `gorm:"index"`
+	To            string
+	Subject       string
+	Body          string
+	MessageID     string `gorm:"index"`
+	ReplyTo       string
+	Status        string `gorm:"index"`
+	Attempts      int
+	NextAttemptAt time.Time `gorm:"index"`
+	LastError     string
+	SentAt        *time.Time
+}
+
+const (
+	MailPending = "pending"
+	MailSent    = "sent"
+	MailFailed  = "failed" // abandonné après le nombre maximal de tentatives
+)
+
+var ErrInvalidEmail = errors.New("adresse e-mail invalide")
+
+// NormalizeEmail valide une adresse saisie par un utilisateur et la renvoie
+// sans nom ni espaces ; une chaîne vide est acceptée (pas de notifications).
+func NormalizeEmail(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Name != "" {
+		return "", ErrInvalidEmail
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+var ErrEmailTaken = errors.New("adresse e-mail déjà utilisée")
+
+// EmailTaken indique si l'adresse est déjà celle d'un autre utilisateur que
+// except. Les e-mails reçus sont attribués d'après cette adresse : elle ne
+// peut appartenir qu'à un seul compte.
+func EmailTaken(db *gorm.DB, email string, except uint) bool {
+	if email == "" {
+		return false
+	}
+	var count int64
+	db.Model(&User{}).Where("LOWER(email) = ? AND id <> ?", strings.ToLower(email), except).Count(&count)
+	return count > 0
+}
+
+// SetUserEmail change l'adresse de l'utilisateur (déjà normalisée, voir
+// NormalizeEmail) ; ErrEmailTaken si un autre compte l'utilise.
+func SetUserEmail(db *gorm.DB, user *User, email string) error {
+	if EmailTaken(db, email, user.ID) {
+		return ErrEmailTaken
+	}
+	return db.Model(user).Update("email", email).Error
+}
+
+// setupEmailIndex garantit l'unicité des adresses des comptes actifs (les
+// adresses vides, sans notifications, sont permises). Une base qui contient
+// déjà des doublons est refusée : à corriger avant le démarrage.
+func setupEmailIndex(db *gorm.DB) error {
+	var dups []string
+	err := db.Model(&User{}).Where("email <> ''").Group("LOWER(email)").Having("COUNT(*) > 1").Pluck("LOWER(email)", &dups).Error
+	if err != nil {
+		return err
+	}
+	if len(dups) > 0 {
+		return fmt.Errorf("adresses e-mail partagées par plusieurs utilisateurs, à corriger : %s", strings.Join(dups, ", "))
+	}
+	return db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users(LOWER(email)) WHERE email <> '' AND deleted_at IS NULL").Error
+}
+
+// EnqueueMail met le message en file, à envoyer dès que possible.
+func EnqueueMail(db *gorm.DB, m *OutgoingMail) error {
+	m.Status = MailPending
+	m.NextAttemptAt = time.Now().UTC()
+	return db.Create(m).Error
+}
+
+// DueMails renvoie au plus limit messages dont l'envoi est dû. Les dates de
+// la file sont toujours en UTC, ce qui permet de les comparer en SQL.
+func DueMails(db *gorm.DB, now time.Time, limit int) ([]OutgoingMail, error) {
+	var mails []OutgoingMail
+	err := db.Where("status = ? AND next_attempt_at <= ?", MailPending, now.UTC()).
+		Order("next_attempt_at, id").Limit(limit).Find(&mails).Error
+	return mails, err
+}
+
+// ClaimMail réserve le message pendant lease, pour qu'un autre processus ne
+// l'envoie pas en même temps ; false s'il a déjà été pris.
+func ClaimMail(db *gorm.DB, m *OutgoingMail, lease time.Duration) (bool, error) {
+	until := time.Now().UTC().Add(lease)
+	res := db.Model(&OutgoingMail{}).
+		Where("id = ? AND status = ? AND next_attempt_at = ?", m.ID, MailPending, m.NextAttemptAt).
+		Update("next_attempt_at", until)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	m.NextAttemptAt = until
+	return res.RowsAffected > 0, nil
+}
+
+func MarkMailSent(db *gorm.DB, m *OutgoingMail) error {
+	now := time.Now()
+	m.Status, m.SentAt, m.LastError = MailSent, &now, ""
+	m.Attempts++
+	return db.Model(m).Updates(map[string]any{
+		"status": m.Status, "sent_at": now, "attempts": m.Attempts, "last_error": "",
+	}).Error
+}
+
+// MarkMailFailed note l'échec d'une tentative ; retry à zéro abandonne le
+// message, sinon il sera retenté après ce délai.
+func MarkMailFailed(db *gorm.DB, m *OutgoingMail, sendErr error, retry time.Duration) error {
+	m.Attempts++
+	m.LastError = sendErr.Error()
+	if retry <= 0 {
+		m.Status = MailFailed
+	} else {
+		m.NextAttemptAt = time.Now().UTC().Add(retry)
+	}
+	return db.Model(m).Updates(map[string]any{
+		"status": m.Status, "attempts": m.Attempts, "last_error": m.LastError, "next_attempt_at": m.NextAttemptAt,
+	}).Error
+}
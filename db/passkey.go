@@ -0,0 +1,243 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"gorm.io/gorm"
+)
+
+// Passkey est une clé d'accès WebAuthn (clé de sécurité, Windows Hello,
+// Touch ID, gestionnaire de mots de passe...) enregistrée par l'utilisateur.
+// Elle remplace le mot de passe et le second facteur, ou sert de second
+// facteur après le mot de passe. Credential garde, en JSON, l'enregistrement
+// complet de go-webauthn : clé publique, compteur de signatures, drapeaux.
+type Passkey struct {
+	ID           uint `gorm:"primarykey"`
+	UserID       uint `gorm:"index"`
+	Name         string
+	CredentialID []byte `gorm:"uniqueIndex"`
+	Credential   []byte
+	CreatedAt    time.Time
+	LastUsedAt   *time.Time
+}
+
+var (
+	ErrInvalidPasskey = errors.New("passkey invalide")
+	// ErrPasskeyCloned signale un compteur de signatures qui recule : la clé
+	// a peut-être été copiée, la connexion est refusée.
+	ErrPasskeyCloned = errors.New("compteur de signatures incohérent, passkey refusée")
+)
+
+// PasskeyUser présente un utilisateur et ses passkeys à go-webauthn.
+type PasskeyUser struct {
+	User
+	Credentials []webauthn.Credential
+}
+
+// WebAuthnID est l'identifiant (user handle) rendu par l'authentificateur à
+// une connexion sans nom d'utilisateur : l'ID de l'utilisateur sur 8 octets,
+// qui ne dit rien de lui.
+func (u PasskeyUser) WebAuthnID() []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(u.ID))
+}
+
+func (u PasskeyUser) WebAuthnName() string {
+	return u.Username
+}
+
+func (u PasskeyUser) WebAuthnDisplayName() string {
+	return u.Username
+}
+
+func (u PasskeyUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.Credentials
+}
+
+// LoadPasskeyUser charge les passkeys de l'utilisateur.
+func LoadPasskeyUser(db *gorm.DB, user User) (PasskeyUser, error) {
+	keys, err := UserPasskeys(db, user.ID)
+	if err != nil {
+		return PasskeyUser{}, err
+	}
+	u := PasskeyUser{User: user}
+	for _, k := range keys {
+		var cred webauthn.Credential
+		if err := json.Unmarshal(k.Credential, &cred); err != nil {
+			return PasskeyUser{}, err
+		}
+		u.Credentials = append(u.Credentials, cred)
+	}
+	return u, nil
+}
+
+// PasskeyUserByHandle retrouve l'utilisateur d'un user handle (voir
+// WebAuthnID) et ses passkeys.
+func PasskeyUserByHandle(db *gorm.DB, handle []byte) (PasskeyUser, error) {
+	if len(handle) != 8 {
+		return PasskeyUser{}, ErrInvalidPasskey
+	}
+	var user User
+	if err := db.First(&user, binary.BigEndian.Uint64(handle)).Error; err != nil {
+		return PasskeyUser{}, err
+	}
+	return LoadPasskeyUser(db, user)
+}
+
+// AddPasskey enregistre une passkey créée par la cérémonie d'enregistrement.
+func AddPasskey(db *gorm.DB, user User, name string, cred *webauthn.Credential) (Passkey, error) {
+	data, err := json.Marshal(cred)
+	if err != nil {
+		return Passkey{}, err
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Passkey"
+	}
+	k := Passkey{UserID: user.ID, Name: name, CredentialID: cred.ID, Credential: data}
+	return k, db.Create(&k).Error
+}
+
+// UsePasskey enregistre l'état de la passkey après une connexion (compteur de
+// signatures, drapeaux) ; une passkey peut-être clonée est refusée.
+func UsePasskey(db *gorm.DB, userID uint, cred *webauthn.Credential) error {
+	if cred.Authenticator.CloneWarning {
+		return ErrPasskeyCloned
+	}
+	data, err := json.Marshal(cred)
+	if err != nil {
+		return err
+	}
+	return db.Model(&Passkey{}).Where("user_id = ? AND credential_id = ?", userID, cred.ID).
+		Updates(map[string]any{"credential": data, "last_used_at": time.Now()}).Error
+}
+
+// UserPasskeys renvoie les passkeys de l'utilisateur, les plus anciennes d'abord.
+func UserPasskeys(db *gorm.DB, userID uint) ([]Passkey, error) {
+	var keys []Passkey
+	err := db.Where("user_id = ?", userID).Order("id").Find(&keys).Error
+	return keys, err
+}
+
+// PasskeyCounts renvoie le nombre de passkeys par utilisateur.
+func PasskeyCounts(db *gorm.DB) (map[uint]int64, error) {
+	var rows []struct {
+		UserID uint
+		Count  int64
+	}
+	err := db.Model(&Passkey{}).Select("user_id, COUNT(*) AS count").Group("user_id").Scan(&rows).Error
+	counts := map[uint]int64{}
+	for _, r := range rows {
+		counts[r.UserID] = r.Count
+	}
+	return counts, err
+}
+
+// DeletePasskey supprime une passkey de l'utilisateur.
+func DeletePasskey(db *gorm.DB, userID, id uint) error {
+	return db.Where("user_id = ?", userID).Delete(&Passkey{}, id).Error
+}
+
+// DeleteUserPasskeys supprime toutes les passkeys de l'utilisateur.
+func DeleteUserPasskeys(db *gorm.DB, userID uint) error {
+	return db.Where("user_id = ?", userID).Delete(&Passkey{}).Error
+}
+
+// ResetSecondFactor retire tous les seconds facteurs de l'utilisateur (TOTP,
+// codes de secours, passkeys) ensemble : un échec n'en laisse aucun à moitié.
+func ResetSecondFactor(db *gorm.DB, userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := ResetTOTP(tx, userID); err != nil {
+			return err
+		}
+		return DeleteUserPasskeys(tx, userID)
+	})
+}
+
+// HasPasskeys indique si l'utilisateur a au moins une passkey.
+func HasPasskeys(db *gorm.DB, userID uint) bool {
+	var count int64
+	db.Model(&Passkey{}).Where("user_id = ?", userID).Count(&count)
+	return count > 0
+}
+
+// HasSecondFactor indique si l'utilisateur a un second facteur : TOTP actif
+// ou au moins une passkey.
+func HasSecondFactor(db *gorm.DB, user User) bool {
+	return user.TOTPEnabled || HasPasskeys(db, user.ID)
+}
+
+// -------------------- Cérémonies WebAuthn --------------------
+
+// PasskeyChallenge garde, entre le début et la fin d'une cérémonie WebAuthn,
+// le défi envoyé au navigateur. Le cookie ne contient qu'un jeton aléatoire ;
+// un défi ne sert qu'une fois.
+type PasskeyChallenge struct {
+	ID        uint   `gorm:"primarykey"`
+	Hash      string `gorm:"uniqueIndex"`
+	UserID    uint   // 0 pour une connexion sans nom d'utilisateur
+	Kind      string
+	Data      []byte    // webauthn.SessionData en JSON
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// Types de cérémonie.
+const (
+	PasskeyRegister     = "register"      // ajout d'une passkey depuis /profile
+	PasskeyLogin        = "login"         // connexion sans mot de passe
+	PasskeySecondFactor = "second_factor" // seconde étape après le mot de passe
+)
+
+// passkeyChallengeTTL borne la durée d'une cérémonie, même si go-webauthn
+// n'en fixe pas.
+const passkeyChallengeTTL = 5 * time.Minute
+
+// SavePasskeyChallenge enregistre le défi d'une cérémonie et renvoie le jeton
+// en clair à placer dans le cookie. Les défis expirés sont purgés au passage.
+func SavePasskeyChallenge(db *gorm.DB, userID uint, kind string, session *webauthn.SessionData) (string, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	plain := hex.EncodeToString(buf)
+
+	now := time.Now()
+	db.Where("expires_at < ?", now).Delete(&PasskeyChallenge{})
+	ch := PasskeyChallenge{
+		Hash:      hashToken(plain),
+		UserID:    userID,
+		Kind:      kind,
+		Data:      data,
+		ExpiresAt: now.Add(passkeyChallengeTTL),
+	}
+	return plain, db.Create(&ch).Error
+}
+
+// TakePasskeyChallenge retrouve et consomme le défi d'une cérémonie du type
+// attendu ; renvoie l'utilisateur pour qui il a été émis.
+func TakePasskeyChallenge(db *gorm.DB, plain, kind string) (uint, webauthn.SessionData, error) {
+	var ch PasskeyChallenge
+	var session webauthn.SessionData
+	err := db.Where("hash = ? AND kind = ? AND expires_at > ?", hashToken(plain), kind, time.Now()).First(&ch).Error
+	if err != nil {
+		return 0, session, err
+	}
+	res := db.Delete(&ch)
+	if res.Error != nil || res.RowsAffected != 1 {
+		return 0, session, gorm.ErrRecordNotFound
+	}
+	if err := json.Unmarshal(ch.Data, &session); err != nil {
+		return 0, session, err
+	}
+	return ch.UserID, session, nil
+}
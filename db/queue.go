@@ -0,0 +1,186 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Queue est une file de tickets (Réseau, Comptes, Matériel...). Le demandeur
+// y classe son ticket à la création ; un admin peut ensuite le déplacer. Un
+// agent membre d'au moins une file ne voit que les tickets de ses files (et
+// ceux qui lui sont assignés), sauf permission ticket.read.all_queues. Comme pour les étiquettes, une file
+// supprimée disparaît vraiment : ses tickets redeviennent non classés.
+type Queue struct {
+	ID          uint   `gorm:"primarykey"`
+	Name        string `gorm:"uniqueIndex"`
+	Description string
+	Members     []User `gorm:"many2many:queue_members"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// HistoryQueue est le champ d'historique des changements de file.
+const HistoryQueue = "Queue"
+
+// QueueNone désigne, dans le filtre "queue", les tickets non classés.
+const QueueNone = "none"
+
+var (
+	ErrInvalidQueue  = errors.New("file invalide : nom requis, sans virgule")
+	ErrUnknownQueue  = errors.New("file inconnue")
+	ErrInvalidMember = errors.New("seul un utilisateur qui traite les tickets (permission ticket.handle) peut être membre d'une file")
+)
+
+func normalizeQueue(q *Queue) error {
+	q.Name = strings.TrimSpace(q.Name)
+	q.Description = strings.TrimSpace(q.Description)
+	if q.Name == "" || strings.Contains(q.Name, ",") || q.Name == QueueNone {
+		return ErrInvalidQueue
+	}
+	return nil
+}
+
+// Queues renvoie les files et leurs membres, par nom.
+func Queues(db *gorm.DB) ([]Queue, error) {
+	var queues []Queue
+	err := db.Preload("Members", func(q *gorm.DB) *gorm.DB { return q.Order("username") }).
+		Order("name").Find(&queues).Error
+	return queues, err
+}
+
+// FindQueue charge la file id ; 0 n'est pas une file (ticket non classé).
+func FindQueue(db *gorm.DB, id uint) (*Queue, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	var q Queue
+	if err := db.First(&q, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUnknownQueue
+		}
+		return nil, err
+	}
+	return &q, nil
+}
+
+// FindQueueByName charge la file nommée ; un nom vide n'est pas une file.
+func FindQueueByName(db *gorm.DB, name string) (*Queue, error) {
+	if name == "" {
+		return nil, nil
+	}
+	var q Queue
+	if err := db.Where("name = ?", name).First(&q).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUnknownQueue
+		}
+		return nil, err
+	}
+	return &q, nil
+}
+
+// CreateQueue enregistre une nouvelle file, sans membre.
+func CreateQueue(db *gorm.DB, name, description string) (Queue, error) {
+	q := Queue{Name: name, Description: description}
+	if err := normalizeQueue(&q); err != nil {
+		return q, err
+	}
+	return q, db.Create(&q).Error
+}
+
+// UpdateQueue renomme la file ou change sa description.
+func UpdateQueue(db *gorm.DB, q *Queue, name, description string) error {
+	q.Name, q.Description = name, description
+	if err := normalizeQueue(q); err != nil {
+		return err
+	}
+	return db.Omit("Members").Save(q).Error
+}
+
+// DeleteQueue supprime la file et ses adhésions ; ses tickets deviennent
+// non classés, ce que leur historique trace.
+func DeleteQueue(db *gorm.DB, id uint, actor string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var queue Queue
+		if err := tx.First(&queue, id).Error; err != nil {
+			return err
+		}
+		var tickets []Ticket
+		if err := tx.Where("queue_id = ?", id).Find(&tickets).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&Ticket{}).Where("queue_id = ?", id).Update("queue_id", nil).Error; err != nil {
+			return err
+		}
+		for _, t := range tickets {
+			t.QueueID = nil
+			LogTicketChange(tx, t, actor, HistoryQueue, queue.Name, "")
+		}
+		if err := tx.Exec("DELETE FROM queue_members WHERE queue_id = ?", id).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Queue{}, id).Error
+	})
+}
+
+// SetQueueMembers remplace les membres de la file par userIDs, qui doivent
+// tous pouvoir traiter des tickets (voir IsAgent).
+func SetQueueMembers(db *gorm.DB, q *Queue, userIDs []uint) error {
+	var users []User
+	if len(userIDs) > 0 {
+		if err := db.Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+			return err
+		}
+	}
+	if len(users) != len(uniqueIDs(userIDs)) {
+		return ErrInvalidMember
+	}
+	for _, u := range users {
+		if !IsAgent(db, u) {
+			return ErrInvalidMember
+		}
+	}
+	return db.Model(q).Association("Members").Replace(users)
+}
+
+// MemberQueueIDs renvoie les files dont username est membre.
+func MemberQueueIDs(db *gorm.DB, username string) ([]uint, error) {
+	var ids []uint
+	err := db.Table("queue_members").
+		Joins("JOIN users ON users.id = queue_members.user_id").
+		Where("users.username = ? AND users.deleted_at IS NULL", username).
+		Pluck("queue_members.queue_id", &ids).Error
+	return ids, err
+}
+
+// MoveTicket classe le ticket dans la file queueID (0 : non classé) et trace
+// le changement dans l'historique. Le ticket n'est pas enregistré.
+func MoveTicket(db *gorm.DB, ticket *Ticket, queueID uint, actor string) error {
+	queue, err := FindQueue(db, queueID)
+	if err != nil {
+		return err
+	}
+	var oldName, newName string
+	if ticket.QueueID != nil {
+		if old, err := FindQueue(db, *ticket.QueueID); err == nil && old != nil {
+			oldName = old.Name
+		}
+	}
+	if queue != nil {
+		newName = queue.Name
+	}
+	if (ticket.QueueID == nil && queue == nil) || (ticket.QueueID != nil && queue != nil && *ticket.QueueID == queue.ID) {
+		return nil
+	}
+
+	LogTicketChange(db, *ticket, actor, HistoryQueue, oldName, newName)
+	if queue == nil {
+		ticket.QueueID = nil
+	} else {
+		ticket.QueueID = &queue.ID
+	}
+	ticket.Queue = queue
+	return nil
+}
@@ -0,0 +1,366 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Role regroupe des permissions nommées ; User.Role contient le nom du rôle.
+// Les rôles Admin, Supervisor et Client existent toujours (voir SeedRoles) :
+// Admin a toutes les permissions, les permissions des autres se modifient
+// dans /admin. Comme les étiquettes, un rôle supprimé disparaît vraiment.
+type Role struct {
+	ID          uint   `gorm:"primarykey"`
+	Name        string `gorm:"uniqueIndex"`
+	Description string
+	// RequireTOTP impose la double authentification (TOTP ou passkey) aux
+	// utilisateurs du rôle.
+	RequireTOTP bool
+	Permissions []RolePermission
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// RolePermission accorde une permission à un rôle.
+type RolePermission struct {
+	RoleID     uint   `gorm:"primaryKey"`
+	Permission string `gorm:"primaryKey"`
+}
+
+const (
+	RoleAdmin      = "Admin"
+	RoleSupervisor = "Supervisor"
+	// RoleClient est le rôle des comptes créés par /register.
+	RoleClient = "Client"
+)
+
+const (
+	PermTicketCreate         = "ticket.create"
+	PermTicketReadAny        = "ticket.read.any"
+	PermTicketReadAllQueues  = "ticket.read.all_queues"
+	PermTicketInternal       = "ticket.internal"
+	PermTicketUpdateState    = "ticket.update.state"
+	PermTicketUpdatePriority = "ticket.update.priority"
+	PermTicketUpdateLabels   = "ticket.update.labels"
+	PermTicketUpdateFields   = "ticket.update.fields"
+	PermTicketAssign         = "ticket.assign"
+	PermTicketHandle         = "ticket.handle"
+	PermTicketEdit           = "ticket.edit"
+	PermTicketDeleteAny      = "ticket.delete.any"
+	PermAttachmentDeleteAny  = "attachment.delete.any"
+	PermAlertCreate          = "alert.create"
+	PermViewManage           = "view.manage"
+	PermStatsView            = "stats.view"
+	PermAdminAccess          = "admin.access"
+	PermUserManage           = "user.manage"
+	PermRoleManage           = "role.manage"
+	PermSLAManage            = "sla.manage"
+	PermWebhookManage        = "webhook.manage"
+	PermLabelManage          = "label.manage"
+	PermQueueManage          = "queue.manage"
+	PermFieldManage          = "field.manage"
+)
+
+// Permission décrit une permission du catalogue.
+type Permission struct {
+	Name        string
+	Description string
+	// Scope est la portée qu'un jeton d'API doit aussi porter pour exercer
+	// la permission ; vide, seule compte la portée tickets:read/write
+	// vérifiée à l'authentification.
+	Scope string
+}
+
+// Permissions est le catalogue, dans l'ordre du formulaire d'admin.
+var Permissions = []Permission{
+	{PermTicketCreate, "Ouvrir des tickets", ""},
+	{PermTicketReadAny, "Voir les tickets des autres (supervision, recherche)", ""},
+	{PermTicketReadAllQueues, "Voir toutes les files, même en étant membre de certaines", ""},
+	{PermTicketInternal, "Lire et écrire les notes internes", ""},
+	{PermTicketUpdateState, "Changer l'état (selon les rôles du workflow)", ""},
+	{PermTicketUpdatePriority, "Changer la priorité", ""},
+	{PermTicketUpdateLabels, "Changer les étiquettes", ""},
+	{PermTicketUpdateFields, "Modifier les champs personnalisés", ""},
+	{PermTicketAssign, "Assigner les tickets", ""},
+	{PermTicketHandle, "Traiter des tickets : être assigné, membre d'une file", ""},
+	{PermTicketEdit, "Modifier titre, description, demandeur et file ; ouvrir un ticket pour un autre", ""},
+	{PermTicketDeleteAny, "Supprimer les tickets des autres", ""},
+	{PermAttachmentDeleteAny, "Supprimer les pièces jointes des autres", ""},
+	{PermAlertCreate, "Envoyer des alertes de supervision (POST /api/v1/alerts)", ScopeAlertsWrite},
+	{PermViewManage, "Supprimer les vues enregistrées des autres", ""},
+	{PermStatsView, "Consulter les statistiques", ScopeStatsRead},
+	{PermAdminAccess, "Accéder à la page d'administration", ScopeAdmin},
+	{PermUserManage, "Gérer les utilisateurs", ScopeAdmin},
+	{PermRoleManage, "Gérer les rôles et leurs permissions", ScopeAdmin},
+	{PermSLAManage, "Gérer les SLA", ScopeAdmin},
+	{PermWebhookManage, "Gérer les webhooks", ScopeAdmin},
+	{PermLabelManage, "Gérer les étiquettes", ScopeAdmin},
+	{PermQueueManage, "Gérer les files", ScopeAdmin},
+	{PermFieldManage, "Gérer les champs personnalisés", ScopeAdmin},
+}
+
+// defaultRoles sont les permissions des rôles créés par SeedRoles ; celles
+// d'Admin ne sont pas stockées (voir RolePermissions).
+var defaultRoles = []struct {
+	Name, Description string
+	Permissions       []string
+}{
+	{RoleAdmin, "Toutes les permissions", nil},
+	{RoleSupervisor, "Traite les tickets", []string{
+		PermTicketCreate, PermTicketReadAny, PermTicketInternal,
+		PermTicketUpdateState, PermTicketUpdatePriority, PermTicketUpdateLabels, PermTicketUpdateFields,
+		PermTicketAssign, PermTicketHandle, PermTicketDeleteAny, PermAttachmentDeleteAny, PermAlertCreate,
+	}},
+	{RoleClient, "Ouvre et suit ses tickets", []string{PermTicketCreate}},
+}
+
+var (
+	ErrInvalidRole = errors.New("rôle invalide : nom requis, permissions connues")
+	ErrUnknownRole = errors.New("rôle inconnu")
+	ErrRoleInUse   = errors.New("rôle encore attribué à des utilisateurs")
+	ErrBuiltinRole = errors.New("les rôles Admin, Supervisor et Client ne se suppriment pas")
+	ErrGrantDenied = errors.New("vous ne pouvez pas accorder une permission que vous n'avez pas")
+)
+
+// LookupPermission renvoie la permission du catalogue nommée name.
+func LookupPermission(name string) (Permission, bool) {
+	for _, p := range Permissions {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Permission{}, false
+}
+
+// IsBuiltinRole indique si le rôle est créé par SeedRoles.
+func IsBuiltinRole(name string) bool {
+	return name == RoleAdmin || name == RoleSupervisor || name == RoleClient
+}
+
+// SeedRoles crée les rôles par défaut qui n'existent pas encore ; les
+// permissions modifiées par un admin sont conservées.
+func SeedRoles(db *gorm.DB) error {
+	for _, d := range defaultRoles {
+		var count int64
+		if err := db.Model(&Role{}).Where("name = ?", d.Name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err := CreateRole(db, d.Name, d.Description, d.Permissions, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PermissionSet est l'ensemble des permissions d'un rôle.
+type PermissionSet map[string]bool
+
+// Has indique si la permission est accordée.
+func (s PermissionSet) Has(perm string) bool {
+	return s[perm]
+}
+
+// CheckGrant vérifie qu'un utilisateur aux permissions actor peut faire
+// passer un rôle de current à perms : chaque permission ajoutée doit être
+// l'une des siennes.
+func CheckGrant(actor, current PermissionSet, perms []string) error {
+	for _, p := range perms {
+		if !current.Has(p) && !actor.Has(p) {
+			return fmt.Errorf("%w : %s", ErrGrantDenied, p)
+		}
+	}
+	return nil
+}
+
+// CanAssignRole indique si un utilisateur du rôle actorRole peut attribuer
+// le rôle role, ou le retirer : seul un Admin gère les Admins, et un autre
+// rôle ne doit accorder aucune permission qu'actorRole n'a pas.
+func CanAssignRole(db *gorm.DB, actorRole, role string) bool {
+	if role == RoleAdmin || actorRole == RoleAdmin {
+		return actorRole == RoleAdmin
+	}
+	actor, err := RolePermissions(db, actorRole)
+	if err != nil {
+		return false
+	}
+	target, err := RolePermissions(db, role)
+	if err != nil {
+		return false
+	}
+	for p := range target {
+		if !actor.Has(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// Has indique si le rôle accorde la permission (toujours vrai pour Admin).
+func (r Role) Has(perm string) bool {
+	if r.Name == RoleAdmin {
+		return true
+	}
+	return slices.ContainsFunc(r.Permissions, func(p RolePermission) bool { return p.Permission == perm })
+}
+
+// RolePermissions renvoie les permissions du rôle nommé ; un rôle inconnu
+// n'en a aucune.
+func RolePermissions(db *gorm.DB, role string) (PermissionSet, error) {
+	set := PermissionSet{}
+	if role == RoleAdmin {
+		for _, p := range Permissions {
+			set[p.Name] = true
+		}
+		return set, nil
+	}
+	var perms []string
+	err := db.Table("role_permissions").
+		Joins("JOIN roles ON roles.id = role_permissions.role_id").
+		Where("roles.name = ?", role).
+		Pluck("role_permissions.permission", &perms).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range perms {
+		set[p] = true
+	}
+	return set, nil
+}
+
+// RoleHas indique si le rôle nommé accorde la permission.
+func RoleHas(db *gorm.DB, role, perm string) bool {
+	set, err := RolePermissions(db, role)
+	return err == nil && set.Has(perm)
+}
+
+// RolesWith renvoie une sous-requête des noms de rôles qui accordent la
+// permission, pour filtrer les utilisateurs (role IN ?).
+func RolesWith(db *gorm.DB, perm string) *gorm.DB {
+	return db.Model(&Role{}).Select("name").
+		Where("name = ? OR id IN (SELECT role_id FROM role_permissions WHERE permission = ?)", RoleAdmin, perm)
+}
+
+// RoleNamesWith renvoie, par nom, les rôles qui accordent la permission.
+func RoleNamesWith(db *gorm.DB, perm string) ([]string, error) {
+	var names []string
+	err := RolesWith(db, perm).Order("name").Pluck("name", &names).Error
+	return names, err
+}
+
+// LastAdmin indique si user est le seul utilisateur du rôle Admin, le seul
+// qui ne peut pas perdre la gestion des rôles.
+func LastAdmin(db *gorm.DB, user User) bool {
+	var others int64
+	db.Model(&User{}).Where("role = ? AND id <> ?", RoleAdmin, user.ID).Count(&others)
+	return user.Role == RoleAdmin && others == 0
+}
+
+// Roles renvoie les rôles et leurs permissions, par nom.
+func Roles(db *gorm.DB) ([]Role, error) {
+	var roles []Role
+	err := db.Preload("Permissions").Order("name").Find(&roles).Error
+	return roles, err
+}
+
+// IsRole indique si un rôle porte ce nom.
+func IsRole(db *gorm.DB, name string) bool {
+	var count int64
+	db.Model(&Role{}).Where("name = ?", name).Count(&count)
+	return count > 0
+}
+
+func rolePermissions(perms []string) ([]RolePermission, error) {
+	var out []RolePermission
+	seen := map[string]bool{}
+	for _, p := range perms {
+		if _, ok := LookupPermission(p); !ok {
+			return nil, ErrInvalidRole
+		}
+		if !seen[p] {
+			seen[p] = true
+			out = append(out, RolePermission{Permission: p})
+		}
+	}
+	return out, nil
+}
+
+// CreateRole enregistre un rôle et ses permissions.
+func CreateRole(db *gorm.DB, name, description string, perms []string, requireTOTP bool) (Role, error) {
+	r := Role{Name: strings.TrimSpace(name), Description: strings.TrimSpace(description), RequireTOTP: requireTOTP}
+	if r.Name == "" {
+		return r, ErrInvalidRole
+	}
+	granted, err := rolePermissions(perms)
+	if err != nil {
+		return r, err
+	}
+	if r.Name != RoleAdmin {
+		r.Permissions = granted
+	}
+	return r, db.Create(&r).Error
+}
+
+// UpdateRole change la description, les permissions et l'obligation de
+// double authentification du rôle ; son nom, référencé par les utilisateurs
+// et le workflow, ne change pas. Les permissions d'Admin ne se modifient pas.
+func UpdateRole(db *gorm.DB, r *Role, description string, perms []string, requireTOTP bool) error {
+	granted, err := rolePermissions(perms)
+	if err != nil {
+		return err
+	}
+	r.Description = strings.TrimSpace(description)
+	r.RequireTOTP = requireTOTP
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Permissions").Save(r).Error; err != nil {
+			return err
+		}
+		if r.Name == RoleAdmin {
+			return nil
+		}
+		if err := tx.Where("role_id = ?", r.ID).Delete(&RolePermission{}).Error; err != nil {
+			return err
+		}
+		for i := range granted {
+			granted[i].RoleID = r.ID
+		}
+		if len(granted) > 0 {
+			if err := tx.Create(&granted).Error; err != nil {
+				return err
+			}
+		}
+		r.Permissions = granted
+		return nil
+	})
+}
+
+// DeleteRole supprime un rôle personnalisé que plus aucun utilisateur n'a.
+func DeleteRole(db *gorm.DB, id uint) error {
+	var r Role
+	if err := db.First(&r, id).Error; err != nil {
+		return ErrUnknownRole
+	}
+	if IsBuiltinRole(r.Name) {
+		return ErrBuiltinRole
+	}
+	var users int64
+	if err := db.Model(&User{}).Where("role = ?", r.Name).Count(&users).Error; err != nil {
+		return err
+	}
+	if users > 0 {
+		return ErrRoleInUse
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("role_id = ?", r.ID).Delete(&RolePermission{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&r).Error
+	})
+}
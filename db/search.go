@@ -0,0 +1,123 @@
+package db
+
+import (
+	"html"
+	"html/template"
+	"strings"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+// Recherche plein texte dans les tickets (titre, description, valeurs des
+// champs personnalisés) et leurs messages. Deux moteurs, choisis à la compilation :
+//   - avec le tag sqlite_fts5, un index FTS5 tenu à jour par des triggers
+//     (search_fts5.go), classé par bm25 ;
+//   - sinon, une recherche LIKE sans index (search_like.go), suffisante pour
+//     quelques milliers de tickets.
+
+// searchTriggers tiennent l'index FTS5 à jour. Une base ouverte par un
+// binaire sans FTS5 doit les perdre : ils feraient échouer toute écriture.
+var searchTriggers = []string{
+	"ticket_search_ticket_ai", "ticket_search_ticket_au", "ticket_search_ticket_ad",
+	"ticket_search_comment_ai", "ticket_search_comment_au", "ticket_search_comment_ad",
+	"ticket_search_field_ai", "ticket_search_field_au", "ticket_search_field_ad",
+}
+
+// likeEscaper protège les jokers de LIKE ; à utiliser avec ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchQuery décrit une recherche et ce que l'appelant a le droit de voir.
+type SearchQuery struct {
+	Text string
+	// User limite la recherche aux tickets de ce demandeur (rôle Client).
+	User string
+	// WithInternal inclut les notes internes (Supervisor, Admin).
+	WithInternal bool
+	// MemberOf limite la recherche aux files de l'agent Me, comme
+	// TicketFilter.MemberOf ; nil : pas de limite.
+	MemberOf []uint
+	Me       string
+	Limit    int
+}
+
+// searchMemberOf est la condition de SearchQuery.MemberOf, commune aux deux
+// moteurs (arguments : MemberOf, Me, Me).
+const searchMemberOf = `(tickets.queue_id IN ? OR tickets.user = ? OR tickets.assignee_id IN (SELECT id FROM users WHERE username = ? AND deleted_at IS NULL))`
+
+// SearchHit est un ticket trouvé, avec l'extrait le plus pertinent.
+type SearchHit struct {
+	Ticket Ticket
+	// Snippet est un extrait du texte trouvé, les termes recherchés entre
+	// MarkStart et MarkEnd.
+	Snippet string
+	// CommentID désigne le message d'où vient l'extrait (nil : le ticket lui-même).
+	CommentID *uint
+	// Rank classe les résultats : plus il est petit, plus le ticket est pertinent.
+	Rank float64
+}
+
+const (
+	MarkStart = "\x02"
+	MarkEnd   = "\x03"
+)
+
+// SnippetHTML renvoie l'extrait échappé, les termes trouvés dans des <mark>.
+func (h SearchHit) SnippetHTML() template.HTML {
+	s := html.EscapeString(h.Snippet)
+	s = strings.ReplaceAll(s, MarkStart, "<mark>")
+	s = strings.ReplaceAll(s, MarkEnd, "</mark>")
+	return template.HTML(s)
+}
+
+// searchTerms découpe la saisie en mots ; la ponctuation et les opérateurs
+// sont ignorés, les mots se combinent en ET.
+func searchTerms(text string) []string {
+	terms := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(terms) > 10 {
+		terms = terms[:10]
+	}
+	return terms
+}
+
+// SearchTickets cherche les tickets visibles correspondant à q.Text, du plus
+// pertinent au moins pertinent.
+func SearchTickets(db *gorm.DB, q SearchQuery) ([]SearchHit, error) {
+	terms := searchTerms(q.Text)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	if q.Limit <= 0 || q.Limit > 100 {
+		q.Limit = 50
+	}
+	return search(db, terms, q)
+}
+
+// loadHits charge les tickets des résultats, dans l'ordre des résultats.
+func loadHits(db *gorm.DB, hits []SearchHit) ([]SearchHit, error) {
+	if len(hits) == 0 {
+		return hits, nil
+	}
+	ids := make([]uint, len(hits))
+	for i, h := range hits {
+		ids[i] = h.Ticket.ID
+	}
+	var tickets []Ticket
+	if err := db.Preload("Assignee").Preload("Labels").Preload("Queue").Where("id IN ?", ids).Find(&tickets).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]Ticket, len(tickets))
+	for _, t := range tickets {
+		byID[t.ID] = t
+	}
+	out := hits[:0]
+	for _, h := range hits {
+		if t, ok := byID[h.Ticket.ID]; ok {
+			h.Ticket = t
+			out = append(out, h)
+		}
+	}
+	return out, nil
+}
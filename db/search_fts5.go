@@ -0,0 +1,152 @@
+//go:build sqlite_fts5
+
+package db
+
+import (
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// SearchEngine nomme le moteur de recherche compilé.
+const SearchEngine = "fts5"
+
+// L'index ticket_search a une ligne par ticket (rowid 2×id), une par
+// message (rowid 2×id+1) et une par valeur de champ personnalisé (rowid
+// -id) : les triggers le mettent à jour par rowid, sans parcourir la table.
+var searchSchema = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS ticket_search USING fts5(
+		title, body, ticket_id UNINDEXED, comment_id UNINDEXED, internal UNINDEXED,
+		tokenize = 'unicode61 remove_diacritics 2')`,
+
+	`CREATE TRIGGER IF NOT EXISTS ticket_search_ticket_ai AFTER INSERT ON tickets BEGIN
+		INSERT INTO ticket_search(rowid, title, body, ticket_id, comment_id, internal)
+		SELECT new.id*2, new.title, new.description, new.id, NULL, 0 WHERE new.deleted_at IS NULL;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS ticket_search_ticket_au AFTER UPDATE OF title, description, deleted_at ON tickets BEGIN
+		DELETE FROM ticket_search WHERE rowid = old.id*2;
+		INSERT INTO ticket_search(rowid, title, body, ticket_id, comment_id, internal)
+		SELECT new.id*2, new.title, new.description, new.id, NULL, 0 WHERE new.deleted_at IS NULL;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS ticket_search_ticket_ad AFTER DELETE ON tickets BEGIN
+		DELETE FROM ticket_search WHERE rowid = old.id*2;
+	END`,
+
+	`CREATE TRIGGER IF NOT EXISTS ticket_search_comment_ai AFTER INSERT ON ticket_comments BEGIN
+		INSERT INTO ticket_search(rowid, title, body, ticket_id, comment_id, internal)
+		SELECT new.id*2+1, '', new.body, new.ticket_id, new.id, new.internal WHERE new.deleted_at IS NULL;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS ticket_search_comment_au AFTER UPDATE OF body, internal, deleted_at ON ticket_comments BEGIN
+		DELETE FROM ticket_search WHERE rowid = old.id*2+1;
+		INSERT INTO ticket_search(rowid, title, body, ticket_id, comment_id, internal)
+		SELECT new.id*2+1, '', new.body, new.ticket_id, new.id, new.internal WHERE new.deleted_at IS NULL;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS ticket_search_comment_ad AFTER DELETE ON ticket_comments BEGIN
+		DELETE FROM ticket_search WHERE rowid = old.id*2+1;
+	END`,
+
+	`CREATE TRIGGER IF NOT EXISTS ticket_search_field_ai AFTER INSERT ON ticket_field_values BEGIN
+		INSERT INTO ticket_search(rowid, title, body, ticket_id, comment_id, internal)
+		VALUES (-new.id, '', new.value, new.ticket_id, NULL, 0);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS ticket_search_field_au AFTER UPDATE OF value ON ticket_field_values BEGIN
+		DELETE FROM ticket_search WHERE rowid = -old.id;
+		INSERT INTO ticket_search(rowid, title, body, ticket_id, comment_id, internal)
+		VALUES (-new.id, '', new.value, new.ticket_id, NULL, 0);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS ticket_search_field_ad AFTER DELETE ON ticket_field_values BEGIN
+		DELETE FROM ticket_search WHERE rowid = -old.id;
+	END`,
+}
+
+// setupSearch crée l'index et ses triggers. Sans triggers (première
+// utilisation, ou base passée entre-temps par un binaire sans FTS5), l'index
+// est reconstruit à partir des tickets et messages existants.
+func setupSearch(db *gorm.DB) error {
+	var triggers int64
+	if err := db.Raw("SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name IN ?", searchTriggers).Scan(&triggers).Error; err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range searchSchema {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		if triggers == int64(len(searchTriggers)) {
+			return nil
+		}
+		if err := tx.Exec("DELETE FROM ticket_search").Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`INSERT INTO ticket_search(rowid, title, body, ticket_id, comment_id, internal)
+			SELECT id*2, title, description, id, NULL, 0 FROM tickets WHERE deleted_at IS NULL`).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`INSERT INTO ticket_search(rowid, title, body, ticket_id, comment_id, internal)
+			SELECT id*2+1, '', body, ticket_id, id, internal FROM ticket_comments WHERE deleted_at IS NULL`).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`INSERT INTO ticket_search(rowid, title, body, ticket_id, comment_id, internal)
+			SELECT -id, '', value, ticket_id, NULL, 0 FROM ticket_field_values`).Error
+	})
+}
+
+type ftsRow struct {
+	TicketID  uint
+	CommentID *uint
+	Snippet   string
+	Rank      float64
+}
+
+func search(db *gorm.DB, terms []string, q SearchQuery) ([]SearchHit, error) {
+	// Chaque mot est cherché comme préfixe : "imprim" trouve "imprimante".
+	match := make([]string, len(terms))
+	for i, t := range terms {
+		match[i] = `"` + t + `"*`
+	}
+
+	// Le titre pèse dix fois plus que le corps dans le classement.
+	sql := `SELECT ticket_search.ticket_id, ticket_search.comment_id,
+			snippet(ticket_search, -1, ?, ?, '…', 16) AS snippet,
+			bm25(ticket_search, 10.0, 1.0) AS rank
+		FROM ticket_search
+		JOIN tickets ON tickets.id = ticket_search.ticket_id AND tickets.deleted_at IS NULL
+		WHERE ticket_search MATCH ?`
+	args := []any{MarkStart, MarkEnd, strings.Join(match, " ")}
+	if q.User != "" {
+		sql += ` AND tickets.user = ?`
+		args = append(args, q.User)
+	}
+	if q.MemberOf != nil {
+		sql += ` AND ` + searchMemberOf
+		args = append(args, q.MemberOf, q.Me, q.Me)
+	}
+	if !q.WithInternal {
+		sql += ` AND ticket_search.internal = 0`
+	}
+	// Un ticket n'apparaît qu'une fois, avec son meilleur extrait : avec
+	// min(), SQLite prend les autres colonnes sur la ligne du minimum. La
+	// recherche est matérialisée, bm25() et snippet() n'étant utilisables
+	// que dans la requête du MATCH.
+	sql = `WITH matches AS MATERIALIZED (` + sql + `)
+		SELECT ticket_id, comment_id, snippet, min(rank) AS rank
+		FROM matches GROUP BY ticket_id ORDER BY rank LIMIT ?`
+	args = append(args, q.Limit)
+
+	var rows []ftsRow
+	if err := db.Raw(sql, args...).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	hits := make([]SearchHit, 0, len(rows))
+	for _, r := range rows {
+		hits = append(hits, SearchHit{
+			Ticket:    Ticket{Model: gorm.Model{ID: r.TicketID}},
+			Snippet:   r.Snippet,
+			CommentID: r.CommentID,
+			Rank:      r.Rank,
+		})
+	}
+	return loadHits(db, hits)
+}
@@ -0,0 +1,153 @@
+//go:build !sqlite_fts5
+
+package db
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// SearchEngine nomme le moteur de recherche compilé.
+const SearchEngine = "like"
+
+// setupSearch retire les triggers laissés par un binaire compilé avec FTS5.
+// L'index lui-même ne peut pas être supprimé sans le module ; il sera
+// reconstruit si FTS5 est de nouveau utilisé.
+func setupSearch(db *gorm.DB) error {
+	for _, name := range searchTriggers {
+		if err := db.Exec("DROP TRIGGER IF EXISTS " + name).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func search(db *gorm.DB, terms []string, q SearchQuery) ([]SearchHit, error) {
+	comments := "SELECT 1 FROM ticket_comments WHERE ticket_comments.ticket_id = tickets.id AND ticket_comments.deleted_at IS NULL AND ticket_comments.body LIKE ? ESCAPE '\\'"
+	if !q.WithInternal {
+		comments += " AND ticket_comments.internal = 0"
+	}
+
+	fields := "SELECT 1 FROM ticket_field_values WHERE ticket_field_values.ticket_id = tickets.id AND ticket_field_values.value LIKE ? ESCAPE '\\'"
+
+	tx := db.Model(&Ticket{})
+	for _, t := range terms {
+		p := "%" + likeEscaper.Replace(t) + "%"
+		tx = tx.Where("(title LIKE ? ESCAPE '\\' OR description LIKE ? ESCAPE '\\' OR EXISTS ("+comments+") OR EXISTS ("+fields+"))", p, p, p, p)
+	}
+	if q.User != "" {
+		tx = tx.Where("user = ?", q.User)
+	}
+	if q.MemberOf != nil {
+		tx = tx.Where(searchMemberOf, q.MemberOf, q.Me, q.Me)
+	}
+	var tickets []Ticket
+	if err := tx.Order("updated_at desc").Limit(500).Find(&tickets).Error; err != nil || len(tickets) == 0 {
+		return nil, err
+	}
+
+	quoted := make([]string, len(terms))
+	for i, t := range terms {
+		quoted[i] = regexp.QuoteMeta(t)
+	}
+	pattern := regexp.MustCompile(`(?i)` + strings.Join(quoted, "|"))
+
+	// Messages et valeurs de champs des candidats, en deux requêtes ; seuls
+	// ceux qui contiennent un terme comptent.
+	ids := make([]uint, len(tickets))
+	for i, t := range tickets {
+		ids[i] = t.ID
+	}
+	anyTerm := func(col string) (string, []any) {
+		conds := make([]string, len(terms))
+		args := make([]any, len(terms))
+		for i, t := range terms {
+			conds[i] = col + " LIKE ? ESCAPE '\\'"
+			args[i] = "%" + likeEscaper.Replace(t) + "%"
+		}
+		return "(" + strings.Join(conds, " OR ") + ")", args
+	}
+	cond, args := anyTerm("body")
+	cq := db.Where("ticket_id IN ?", ids).Where(cond, args...)
+	if !q.WithInternal {
+		cq = cq.Where("internal = ?", false)
+	}
+	var allMsgs []TicketComment
+	if err := cq.Order("id").Find(&allMsgs).Error; err != nil {
+		return nil, err
+	}
+	msgsByTicket := map[uint][]TicketComment{}
+	for _, m := range allMsgs {
+		msgsByTicket[m.TicketID] = append(msgsByTicket[m.TicketID], m)
+	}
+	cond, args = anyTerm("value")
+	var allValues []TicketFieldValue
+	if err := db.Where("ticket_id IN ?", ids).Where(cond, args...).Order("id").Find(&allValues).Error; err != nil {
+		return nil, err
+	}
+	valuesByTicket := map[uint][]string{}
+	for _, v := range allValues {
+		valuesByTicket[v.TicketID] = append(valuesByTicket[v.TicketID], v.Value)
+	}
+
+	hits := make([]SearchHit, 0, len(tickets))
+	for _, t := range tickets {
+		msgs, values := msgsByTicket[t.ID], valuesByTicket[t.ID]
+
+		// Score : occurrences pondérées, le titre pesant dix fois plus.
+		score := 10*len(pattern.FindAllStringIndex(t.Title, -1)) + len(pattern.FindAllStringIndex(t.Description, -1))
+		hit := SearchHit{Ticket: t}
+		for _, text := range append([]string{t.Title, t.Description}, values...) {
+			if hit.Snippet == "" && pattern.MatchString(text) {
+				hit.Snippet = highlight(pattern, text)
+			}
+		}
+		for _, v := range values {
+			score += len(pattern.FindAllStringIndex(v, -1))
+		}
+		for _, m := range msgs {
+			n := len(pattern.FindAllStringIndex(m.Body, -1))
+			score += n
+			if hit.Snippet == "" && n > 0 {
+				hit.Snippet = highlight(pattern, m.Body)
+				id := m.ID
+				hit.CommentID = &id
+			}
+		}
+		hit.Rank = -float64(score)
+		hits = append(hits, hit)
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Rank < hits[j].Rank })
+	if len(hits) > q.Limit {
+		hits = hits[:q.Limit]
+	}
+	return loadHits(db, hits)
+}
+
+// highlight renvoie un extrait d'environ 120 octets autour de la première
+// occurrence, les termes marqués comme le ferait snippet() de FTS5.
+func highlight(pattern *regexp.Regexp, text string) string {
+	loc := pattern.FindStringIndex(text)
+	if loc == nil {
+		return ""
+	}
+	start, end := max(loc[0]-50, 0), min(loc[1]+70, len(text))
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+	out := pattern.ReplaceAllString(text[start:end], MarkStart+"$0"+MarkEnd)
+	if start > 0 {
+		out = "…" + out
+	}
+	if end < len(text) {
+		out += "…"
+	}
+	return out
+}
@@ -0,0 +1,204 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UserSession est une session navigateur ouverte par /login. Le cookie ne
+// contient qu'un jeton aléatoire dont seul le SHA-256 est stocké, comme pour
+// les jetons d'API. Supprimer la ligne déconnecte l'appareil à la requête
+// suivante.
+//
+// Une session dont Stage n'est pas vide attend la seconde étape de la
+// connexion (voir totp.go et passkey.go) et ne donne accès qu'à /login/2fa.
+type UserSession struct {
+	ID         uint   `gorm:"primarykey"`
+	UserID     uint   `gorm:"index"`
+	Hash       string `gorm:"uniqueIndex"`
+	Stage      string `gorm:"not null;default:''"`
+	Attempts   int
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time `gorm:"index"`
+}
+
+const (
+	// SessionSecondFactor : mot de passe vérifié, code TOTP, code de secours
+	// ou passkey attendu.
+	SessionSecondFactor = "second_factor"
+	// SessionEnroll : mot de passe vérifié, le rôle impose d'enrôler un
+	// second facteur avant d'entrer.
+	SessionEnroll = "enroll"
+)
+
+// maxSessionAttempts est le nombre de codes faux tolérés par une session en
+// attente de seconde étape avant sa suppression.
+const maxSessionAttempts = 5
+
+// Après maxLoginFailures échecs de suite (mot de passe faux, ou second
+// facteur faux après le bon mot de passe), le compte refuse /login pendant
+// loginLockout, durée doublée à chaque nouvel échec jusqu'à maxLoginLockout.
+// Le compteur est tenu par compte, pas par adresse : un attaquant qui change
+// d'adresse n'a pas plus d'essais.
+const (
+	maxLoginFailures = 5
+	loginLockout     = time.Minute
+	maxLoginLockout  = time.Hour
+)
+
+// LoginLocked indique si le compte refuse encore les connexions à now.
+func LoginLocked(user User, now time.Time) bool {
+	return now.Before(user.LockedUntil)
+}
+
+// FailLogin compte un échec de connexion pour user et le verrouille au-delà
+// de maxLoginFailures.
+func FailLogin(db *gorm.DB, user *User, now time.Time) error {
+	// L'incrément est fait par la base : des essais simultanés comptent tous
+	// (NULL pour un compte antérieur au verrouillage).
+	if err := db.Model(user).UpdateColumn("failed_logins", gorm.Expr("COALESCE(failed_logins, 0) + 1")).Error; err != nil {
+		return err
+	}
+	if err := db.Model(user).Select("failed_logins").First(user).Error; err != nil {
+		return err
+	}
+	n := user.FailedLogins - maxLoginFailures
+	if n < 0 {
+		return nil
+	}
+	lock := maxLoginLockout
+	if n < 6 {
+		lock = min(loginLockout<<n, maxLoginLockout)
+	}
+	user.LockedUntil = now.Add(lock)
+	return db.Model(user).UpdateColumn("locked_until", user.LockedUntil).Error
+}
+
+// ResetLoginFailures remet le compteur de user à zéro après une connexion
+// réussie, second facteur compris.
+func ResetLoginFailures(db *gorm.DB, user *User) error {
+	if user.FailedLogins == 0 && user.LockedUntil.IsZero() {
+		return nil
+	}
+	user.FailedLogins, user.LockedUntil = 0, time.Time{}
+	return db.Model(user).UpdateColumns(map[string]any{"failed_logins": 0, "locked_until": time.Time{}}).Error
+}
+
+// sessionTouch espace les écritures de LastSeenAt : une session active n'est
+// pas mise à jour à chaque requête.
+const sessionTouch = time.Minute
+
+// CreateSession ouvre une session de durée ttl pour user, à l'étape stage
+// ("" pour une session complète), et renvoie le jeton en clair à placer dans
+// le cookie. Les sessions expirées de tous les utilisateurs sont purgées au
+// passage.
+func CreateSession(db *gorm.DB, user User, stage, userAgent, ip string, ttl time.Duration) (string, UserSession, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", UserSession{}, err
+	}
+	plain := hex.EncodeToString(buf)
+
+	now := time.Now()
+	db.Where("expires_at < ?", now).Delete(&UserSession{})
+	s := UserSession{
+		UserID:     user.ID,
+		Hash:       hashToken(plain),
+		Stage:      stage,
+		UserAgent:  userAgent,
+		IP:         ip,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+	if err := db.Create(&s).Error; err != nil {
+		return "", UserSession{}, err
+	}
+	return plain, s, nil
+}
+
+// LookupSession retrouve une session non expirée et son utilisateur, relu en
+// base : la session d'un utilisateur supprimé n'est plus valable.
+func LookupSession(db *gorm.DB, plain string) (UserSession, User, error) {
+	var s UserSession
+	var user User
+	if err := db.Where("hash = ? AND expires_at > ?", hashToken(plain), time.Now()).First(&s).Error; err != nil {
+		return s, user, err
+	}
+	if err := db.First(&user, s.UserID).Error; err != nil {
+		return s, user, err
+	}
+	return s, user, nil
+}
+
+// TouchSession fait glisser de ttl l'expiration d'une session complète
+// active. Renvoie vrai si la session a été prolongée : le cookie doit l'être
+// aussi.
+func TouchSession(db *gorm.DB, s *UserSession, ttl time.Duration) bool {
+	now := time.Now()
+	if s.Stage != "" || now.Sub(s.LastSeenAt) < sessionTouch {
+		return false
+	}
+	s.LastSeenAt = now
+	s.ExpiresAt = now.Add(ttl)
+	return db.Model(s).UpdateColumns(map[string]any{"last_seen_at": s.LastSeenAt, "expires_at": s.ExpiresAt}).Error == nil
+}
+
+// UserSessions renvoie les sessions actives de l'utilisateur, la plus récente
+// d'abord.
+func UserSessions(db *gorm.DB, userID uint) ([]UserSession, error) {
+	var sessions []UserSession
+	err := db.Where("user_id = ? AND stage = '' AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at desc").Find(&sessions).Error
+	return sessions, err
+}
+
+// SessionCounts renvoie le nombre de sessions actives par utilisateur.
+func SessionCounts(db *gorm.DB) (map[uint]int64, error) {
+	var rows []struct {
+		UserID uint
+		Count  int64
+	}
+	err := db.Model(&UserSession{}).Select("user_id, COUNT(*) AS count").
+		Where("stage = '' AND expires_at > ?", time.Now()).Group("user_id").Scan(&rows).Error
+	counts := map[uint]int64{}
+	for _, r := range rows {
+		counts[r.UserID] = r.Count
+	}
+	return counts, err
+}
+
+// FailSession compte un code faux sur une session en attente et la supprime
+// au-delà de maxSessionAttempts ; renvoie false si la session est fermée.
+func FailSession(db *gorm.DB, s *UserSession) bool {
+	s.Attempts++
+	if s.Attempts >= maxSessionAttempts {
+		db.Delete(s)
+		return false
+	}
+	db.Model(s).UpdateColumn("attempts", s.Attempts)
+	return true
+}
+
+// EndSession ferme la session du jeton en clair (déconnexion).
+func EndSession(db *gorm.DB, plain string) error {
+	return db.Where("hash = ?", hashToken(plain)).Delete(&UserSession{}).Error
+}
+
+// RevokeSession ferme une session de l'utilisateur ; celles des autres ne
+// sont pas touchées.
+func RevokeSession(db *gorm.DB, userID, id uint) error {
+	return db.Where("user_id = ?", userID).Delete(&UserSession{}, id).Error
+}
+
+// RevokeUserSessions ferme toutes les sessions de l'utilisateur, sauf except
+// (0 : aucune exception), et renvoie leur nombre.
+func RevokeUserSessions(db *gorm.DB, userID, except uint) (int64, error) {
+	res := db.Where("user_id = ? AND id <> ?", userID, except).Delete(&UserSession{})
+	return res.RowsAffected, res.Error
+}
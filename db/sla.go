@@ -0,0 +1,244 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"sae/calendar"
+
+	"gorm.io/gorm"
+)
+
+// Priorités reconnues, de la plus basse à la plus haute.
+var Priorities = []string{"low", "medium", "high", "urgent"}
+
+// DefaultPriority est appliquée aux tickets créés sans priorité, pour qu'ils
+// relèvent eux aussi d'une politique de SLA.
+const DefaultPriority = "medium"
+
+var ErrInvalidPriority = errors.New("priorité invalide")
+
+func IsPriority(p string) bool {
+	for _, known := range Priorities {
+		if p == known {
+			return true
+		}
+	}
+	return false
+}
+
+// SLAPolicy fixe, pour une priorité, les délais de première réponse et de
+// résolution, en minutes. Avec un calendrier, les délais sont comptés en
+// heures ouvrées ; sinon en temps d'horloge.
+type SLAPolicy struct {
+	gorm.Model
+	Priority          string `gorm:"uniqueIndex"`
+	ResponseMinutes   int
+	ResolutionMinutes int
+	Calendar          string
+}
+
+var defaultSLAPolicies = []SLAPolicy{
+	{Priority: "low", ResponseMinutes: 24 * 60, ResolutionMinutes: 5 * 24 * 60},
+	{Priority: "medium", ResponseMinutes: 8 * 60, ResolutionMinutes: 3 * 24 * 60},
+	{Priority: "high", ResponseMinutes: 4 * 60, ResolutionMinutes: 24 * 60},
+	{Priority: "urgent", ResponseMinutes: 60, ResolutionMinutes: 4 * 60},
+}
+
+// SeedSLAPolicies crée les politiques par défaut des priorités qui n'en ont pas.
+func SeedSLAPolicies(db *gorm.DB) error {
+	for _, p := range defaultSLAPolicies {
+		policy := p
+		if err := db.Where(SLAPolicy{Priority: p.Priority}).FirstOrCreate(&policy).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SLAPolicies renvoie les politiques dans l'ordre des priorités.
+func SLAPolicies(db *gorm.DB) ([]SLAPolicy, error) {
+	var all []SLAPolicy
+	if err := db.Find(&all).Error; err != nil {
+		return nil, err
+	}
+	var out []SLAPolicy
+	for _, p := range Priorities {
+		for _, policy := range all {
+			if policy.Priority == p {
+				out = append(out, policy)
+			}
+		}
+	}
+	return out, nil
+}
+
+// ApplySLA calcule les échéances du ticket à partir de sa date de création
+// et de la politique de sa priorité (aucune échéance sans politique). Un
+// calendrier absent de cals est traité comme du temps d'horloge.
+func ApplySLA(db *gorm.DB, cals *calendar.Set, ticket *Ticket) {
+	ticket.ResponseDueAt = nil
+	ticket.ResolutionDueAt = nil
+
+	var policy SLAPolicy
+	if err := db.Where("priority = ?", ticket.Priority).First(&policy).Error; err != nil {
+		return
+	}
+	start := ticket.CreatedAt
+	if start.IsZero() {
+		start = time.Now()
+	}
+	var cal *calendar.Calendar
+	if policy.Calendar != "" && cals != nil {
+		cal, _ = cals.Get(policy.Calendar)
+	}
+	response := cal.Add(start, time.Duration(policy.ResponseMinutes)*time.Minute)
+	resolution := cal.Add(start, time.Duration(policy.ResolutionMinutes)*time.Minute)
+	ticket.ResponseDueAt = &response
+	ticket.ResolutionDueAt = &resolution
+}
+
+// CreateTicket enregistre un nouveau ticket en lui appliquant la priorité
+// par défaut et les échéances de SLA.
+func CreateTicket(db *gorm.DB, cals *calendar.Set, ticket *Ticket) error {
+	if ticket.Priority == "" {
+		ticket.Priority = DefaultPriority
+	}
+	if !IsPriority(ticket.Priority) {
+		return ErrInvalidPriority
+	}
+	if ticket.ReplyToken == "" {
+		token, err := NewReplyToken()
+		if err != nil {
+			return err
+		}
+		ticket.ReplyToken = token
+	}
+	ticket.CreatedAt = time.Now()
+	ApplySLA(db, cals, ticket)
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(ticket).Error; err != nil {
+			return err
+		}
+		Publish(tx, Event{Type: EventTicketCreated, Ticket: *ticket, Actor: ticket.User})
+		return nil
+	})
+}
+
+// SetTicketPriority change la priorité, la trace dans l'historique et
+// recalcule les échéances. Le ticket n'est pas enregistré.
+func SetTicketPriority(db *gorm.DB, cals *calendar.Set, ticket *Ticket, priority, actor string) error {
+	if ticket.Priority == priority {
+		return nil
+	}
+	if !IsPriority(priority) {
+		return ErrInvalidPriority
+	}
+	from := ticket.Priority
+	LogTicketChange(db, *ticket, actor, "Priority", from, priority)
+	ticket.Priority = priority
+	ApplySLA(db, cals, ticket)
+	Publish(db, Event{Type: EventTicketPriorityChanged, Ticket: *ticket, Actor: actor, Data: map[string]string{
+		"from": from, "to": priority,
+	}})
+	return nil
+}
+
+// MarkFirstResponse note la première réponse apportée au demandeur : un
+// message public ou un changement d'état fait par quelqu'un d'autre que lui.
+// Le ticket n'est pas enregistré : la réponse ne compte qu'une fois le
+// changement qui la porte sauvegardé. Renvoie vrai si la date a été posée.
+func MarkFirstResponse(ticket *Ticket, actor string) bool {
+	if ticket.FirstResponseAt != nil || actor == ticket.User {
+		return false
+	}
+	now := time.Now()
+	ticket.FirstResponseAt = &now
+	return true
+}
+
+// SLAStatus résume la situation d'un ticket vis-à-vis de ses échéances.
+type SLAStatus struct {
+	HasPolicy          bool
+	ResponseBreached   bool
+	ResolutionBreached bool
+	// Remaining est le temps restant avant l'échéance de résolution
+	// (négatif si elle est dépassée) ; nul pour un ticket fermé.
+	Remaining time.Duration
+	Closed    bool
+}
+
+// SLAAt évalue les échéances à l'instant now.
+func (t Ticket) SLAAt(now time.Time) SLAStatus {
+	s := SLAStatus{Closed: !t.ClosedAt.IsZero()}
+	if t.ResolutionDueAt == nil || t.ResponseDueAt == nil {
+		return s
+	}
+	s.HasPolicy = true
+
+	if t.FirstResponseAt != nil {
+		s.ResponseBreached = t.FirstResponseAt.After(*t.ResponseDueAt)
+	} else {
+		s.ResponseBreached = now.After(*t.ResponseDueAt)
+	}
+
+	if s.Closed {
+		s.ResolutionBreached = t.ClosedAt.After(*t.ResolutionDueAt)
+	} else {
+		s.Remaining = t.ResolutionDueAt.Sub(now)
+		s.ResolutionBreached = s.Remaining < 0
+	}
+	return s
+}
+
+// SLA évalue les échéances maintenant ; utilisé par les templates.
+func (t Ticket) SLA() SLAStatus {
+	return t.SLAAt(time.Now())
+}
+
+// RemainingText formate le temps restant ("2j 3h", "45min", "-1h 20min").
+func (s SLAStatus) RemainingText() string {
+	d := s.Remaining.Round(time.Minute)
+	sign := ""
+	if d < 0 {
+		sign = "-"
+		d = -d
+	}
+	days := int(d.Hours()) / 24
+	hours := int(d.Hours()) % 24
+	minutes := int(d.Minutes()) % 60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%s%dj %dh", sign, days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%s%dh %dmin", sign, hours, minutes)
+	default:
+		return fmt.Sprintf("%s%dmin", sign, minutes)
+	}
+}
+
+// UpdateSLAPolicy change les délais et le calendrier (vide : temps
+// d'horloge) d'une priorité. Les échéances des tickets existants ne sont pas
+// recalculées.
+func UpdateSLAPolicy(db *gorm.DB, cals *calendar.Set, priority string, responseMinutes, resolutionMinutes int, cal string) error {
+	if !IsPriority(priority) {
+		return ErrInvalidPriority
+	}
+	if cal != "" {
+		if _, err := cals.Get(cal); err != nil {
+			return err
+		}
+	}
+	if responseMinutes <= 0 || resolutionMinutes <= 0 {
+		return errors.New("les délais doivent être positifs")
+	}
+	policy := SLAPolicy{Priority: priority}
+	if err := db.Where(SLAPolicy{Priority: priority}).FirstOrCreate(&policy).Error; err != nil {
+		return err
+	}
+	policy.ResponseMinutes = responseMinutes
+	policy.ResolutionMinutes = resolutionMinutes
+	policy.Calendar = cal
+	return db.Save(&policy).Error
+}
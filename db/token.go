@@ -0,0 +1,109 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Portées reconnues pour les jetons d'API personnels.
+const (
+	ScopeTicketsRead  = "tickets:read"
+	ScopeTicketsWrite = "tickets:write"
+	ScopeStatsRead    = "stats:read"
+	ScopeAlertsWrite  = "alerts:write"
+	ScopeAdmin        = "admin"
+)
+
+var Scopes = []string{ScopeTicketsRead, ScopeTicketsWrite, ScopeStatsRead, ScopeAlertsWrite, ScopeAdmin}
+
+const tokenPrefix = "gtm_"
+
+// APIToken est un jeton personnel pour les clients hors navigateur.
+// Seul le SHA-256 du jeton est stocké : le jeton en clair n'est montré qu'à la création.
+type APIToken struct {
+	gorm.Model
+	UserID     uint `gorm:"index"`
+	Name       string
+	Hint       string // derniers caractères, pour reconnaître le jeton dans la liste
+	Hash       string `gorm:"uniqueIndex"`
+	Scopes     string // portées séparées par des espaces
+	LastUsedAt *time.Time
+}
+
+func (t APIToken) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIToken génère un jeton pour user et renvoie sa valeur en clair.
+func CreateAPIToken(db *gorm.DB, user User, name string, scopes []string) (string, APIToken, error) {
+	var kept []string
+	for _, s := range scopes {
+		for _, known := range Scopes {
+			if s == known {
+				kept = append(kept, s)
+				break
+			}
+		}
+	}
+	if len(kept) == 0 {
+		return "", APIToken{}, errors.New("aucune portée valide")
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", APIToken{}, err
+	}
+	plain := tokenPrefix + hex.EncodeToString(buf)
+
+	token := APIToken{
+		UserID: user.ID,
+		Name:   name,
+		Hint:   plain[len(plain)-4:],
+		Hash:   hashToken(plain),
+		Scopes: strings.Join(kept, " "),
+	}
+	if err := db.Create(&token).Error; err != nil {
+		return "", APIToken{}, err
+	}
+	return plain, token, nil
+}
+
+// LookupAPIToken retrouve un jeton non révoqué et son propriétaire.
+func LookupAPIToken(db *gorm.DB, plain string) (APIToken, User, error) {
+	var token APIToken
+	var user User
+	if !strings.HasPrefix(plain, tokenPrefix) {
+		return token, user, gorm.ErrRecordNotFound
+	}
+	if err := db.Where("hash = ?", hashToken(plain)).First(&token).Error; err != nil {
+		return token, user, err
+	}
+	if err := db.First(&user, token.UserID).Error; err != nil {
+		return token, user, err
+	}
+
+	now := time.Now()
+	db.Model(&token).UpdateColumn("last_used_at", now)
+	token.LastUsedAt = &now
+	return token, user, nil
+}
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"gorm.io/gorm"
+)
+
+// Double authentification par codes TOTP (RFC 6238 : 6 chiffres, période de
+// 30 s, SHA-1, compatibles avec les applications d'authentification
+// courantes). Un utilisateur enrôlé donne un code après son mot de passe ;
+// s'il perd son téléphone, un code de secours à usage unique le remplace.
+
+const (
+	totpIssuer = "Go Ticket Manager"
+	totpPeriod = 30
+	// RecoveryCodeCount codes de secours sont générés à l'activation.
+	RecoveryCodeCount = 10
+)
+
+var b32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// RecoveryCode est un code de secours ; comme pour les jetons, seul son
+// SHA-256 est stocké.
+type RecoveryCode struct {
+	ID        uint   `gorm:"primarykey"`
+	UserID    uint   `gorm:"index"`
+	Hash      string `gorm:"index"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+var (
+	ErrInvalidTOTP  = errors.New("code invalide")
+	ErrTOTPRequired = errors.New("la double authentification est obligatoire pour votre rôle")
+	ErrTOTPEnabled  = errors.New("la double authentification est déjà active")
+)
+
+// TOTPRequired indique si le rôle de l'utilisateur impose la double
+// authentification ; une passkey y satisfait aussi (voir HasSecondFactor).
+func TOTPRequired(db *gorm.DB, user User) bool {
+	var count int64
+	db.Model(&Role{}).Where("name = ? AND require_totp = ?", user.Role, true).Count(&count)
+	return count > 0
+}
+
+// StartTOTPEnrollment génère un nouveau secret pour user et l'enregistre sans
+// activer la double authentification : elle ne l'est qu'au premier code
+// valide (EnableTOTP). Un enrôlement inachevé est remplacé ; un second
+// facteur actif se retire d'abord (ResetTOTP).
+func StartTOTPEnrollment(db *gorm.DB, user *User) (*otp.Key, error) {
+	if user.TOTPEnabled {
+		return nil, ErrTOTPEnabled
+	}
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: user.Username})
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPSecret = key.Secret()
+	user.TOTPEnabled = false
+	user.TOTPLastStep = 0
+	err = db.Model(user).Select("totp_secret", "totp_enabled", "totp_last_step").Updates(user).Error
+	return key, err
+}
+
+// TOTPKey renvoie la clé de l'enrôlement en cours, pour afficher son QR code.
+func TOTPKey(user User) (*otp.Key, error) {
+	secret, err := b32NoPadding.DecodeString(user.TOTPSecret)
+	if err != nil {
+		return nil, err
+	}
+	return totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: user.Username, Secret: secret})
+}
+
+// CheckTOTP vérifie un code de l'utilisateur, en tolérant une période de
+// décalage d'horloge. Un code accepté ne l'est qu'une fois : la période est
+// retenue dans TOTPLastStep.
+func CheckTOTP(db *gorm.DB, user *User, code string) bool {
+	code = strings.TrimSpace(code)
+	if user.TOTPSecret == "" || len(code) != 6 {
+		return false
+	}
+	step := time.Now().Unix() / totpPeriod
+	for _, s := range []int64{step - 1, step, step + 1} {
+		if s <= user.TOTPLastStep {
+			continue
+		}
+		want, err := totp.GenerateCodeCustom(user.TOTPSecret, time.Unix(s*totpPeriod, 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil || subtle.ConstantTimeCompare([]byte(want), []byte(code)) != 1 {
+			continue
+		}
+		// Mise à jour conditionnelle : deux requêtes simultanées ne peuvent
+		// pas consommer le même code.
+		res := db.Model(&User{}).Where("id = ? AND totp_last_step < ?", user.ID, s).UpdateColumn("totp_last_step", s)
+		if res.Error != nil || res.RowsAffected != 1 {
+			return false
+		}
+		user.TOTPLastStep = s
+		return true
+	}
+	return false
+}
+
+// EnableTOTP active la double authentification si code est valide pour le
+// secret en cours d'enrôlement, et renvoie les codes de secours en clair.
+func EnableTOTP(db *gorm.DB, user *User, code string) ([]string, error) {
+	if user.TOTPEnabled || !CheckTOTP(db, user, code) {
+		return nil, ErrInvalidTOTP
+	}
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).UpdateColumn("totp_enabled", true).Error; err != nil {
+			return err
+		}
+		var err error
+		codes, err = newRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPEnabled = true
+	return codes, nil
+}
+
+// ResetTOTP retire le second facteur de l'utilisateur et ses codes de secours.
+func ResetTOTP(db *gorm.DB, userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).Where("id = ?", userID).Updates(map[string]any{
+			"totp_secret": "", "totp_enabled": false, "totp_last_step": 0,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+	})
+}
+
+// RegenerateRecoveryCodes remplace les codes de secours de l'utilisateur.
+func RegenerateRecoveryCodes(db *gorm.DB, userID uint) ([]string, error) {
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = newRecoveryCodes(tx, userID)
+		return err
+	})
+	return codes, err
+}
+
+func newRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, RecoveryCodeCount)
+	rows := make([]RecoveryCode, RecoveryCodeCount)
+	for i := range codes {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		plain := strings.ToLower(b32NoPadding.EncodeToString(buf))[:10]
+		codes[i] = plain[:5] + "-" + plain[5:]
+		rows[i] = RecoveryCode{UserID: userID, Hash: hashToken(plain)}
+	}
+	return codes, tx.Create(&rows).Error
+}
+
+// UseRecoveryCode consomme un code de secours inutilisé de l'utilisateur.
+// Tirets, espaces et majuscules sont ignorés.
+func UseRecoveryCode(db *gorm.DB, user User, code string) bool {
+	plain := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(plain) != 10 {
+		return false
+	}
+	res := db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND hash = ? AND used_at IS NULL", user.ID, hashToken(plain)).
+		UpdateColumn("used_at", time.Now())
+	return res.Error == nil && res.RowsAffected == 1
+}
+
+// RecoveryCodesLeft renvoie le nombre de codes de secours inutilisés.
+func RecoveryCodesLeft(db *gorm.DB, userID uint) int64 {
+	var count int64
+	db.Model(&RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count)
+	return count
+}
+
+// CheckSecondFactor accepte un code TOTP ou, à défaut, un code de secours.
+func CheckSecondFactor(db *gorm.DB, user *User, code string) bool {
+	return CheckTOTP(db, user, code) || UseRecoveryCode(db, *user, code)
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SavedView est une liste de tickets enregistrée sous un nom : les paramètres
+// d'un TicketFilter (filtres, tri, taille de page). Une vue est privée, ou
+// partagée avec tous les utilisateurs d'un rôle.
+type SavedView struct {
+	gorm.Model
+	OwnerID    uint `gorm:"index"`
+	Owner      User
+	Name       string
+	Query      string // TicketFilter.Query() encodé, sans curseur
+	SharedRole string // vide : vue privée
+}
+
+// SavedViewPin épingle une vue dans la navigation d'un utilisateur.
+type SavedViewPin struct {
+	UserID uint `gorm:"uniqueIndex:idx_view_pin"`
+	ViewID uint `gorm:"uniqueIndex:idx_view_pin"`
+}
+
+var ErrInvalidView = errors.New("vue invalide")
+
+// Filter relit le filtre de la vue.
+func (v SavedView) Filter() (TicketFilter, error) {
+	values, err := url.ParseQuery(v.Query)
+	if err != nil {
+		return TicketFilter{}, err
+	}
+	return ParseTicketFilter(values)
+}
+
+// CreateView enregistre une vue ; rawQuery est validé puis normalisé.
+func CreateView(db *gorm.DB, owner User, name, rawQuery, sharedRole string, pin bool) (SavedView, error) {
+	view := SavedView{OwnerID: owner.ID, Name: strings.TrimSpace(name), SharedRole: sharedRole}
+	if view.Name == "" {
+		return view, ErrInvalidView
+	}
+	if sharedRole != "" && !isViewRole(db, sharedRole) {
+		return view, ErrInvalidView
+	}
+	values, err := url.ParseQuery(strings.TrimPrefix(rawQuery, "?"))
+	if err != nil {
+		return view, ErrInvalidView
+	}
+	f, err := ParseTicketFilter(values)
+	if err != nil {
+		return view, err
+	}
+	view.Query = f.Query().Encode()
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&view).Error; err != nil {
+			return err
+		}
+		if pin {
+			return tx.Create(&SavedViewPin{UserID: owner.ID, ViewID: view.ID}).Error
+		}
+		return nil
+	})
+	return view, err
+}
+
+// ViewRoles renvoie les rôles avec lesquels une vue peut être partagée :
+// ceux qui ouvrent la supervision (permission ticket.read.any).
+func ViewRoles(db *gorm.DB) ([]string, error) {
+	return RoleNamesWith(db, PermTicketReadAny)
+}
+
+func isViewRole(db *gorm.DB, role string) bool {
+	return RoleHas(db, role, PermTicketReadAny)
+}
+
+// visibleViews limite q aux vues de user et à celles partagées avec son rôle ;
+// manage (permission view.manage) lève la restriction, pour que ces vues
+// puissent être supprimées.
+func visibleViews(q *gorm.DB, user User, manage bool) *gorm.DB {
+	if manage {
+		return q
+	}
+	return q.Where("saved_views.owner_id = ? OR (saved_views.shared_role <> '' AND saved_views.shared_role = ?)", user.ID, user.Role)
+}
+
+// VisibleViews renvoie les vues que user peut ouvrir, par nom.
+func VisibleViews(db *gorm.DB, user User, manage bool) ([]SavedView, error) {
+	var views []SavedView
+	err := visibleViews(db.Preload("Owner"), user, manage).Order("name, id").Find(&views).Error
+	return views, err
+}
+
+// PinnedViews renvoie les vues épinglées par user, parmi celles qu'il peut
+// encore ouvrir.
+func PinnedViews(db *gorm.DB, user User, manage bool) ([]SavedView, error) {
+	var views []SavedView
+	q := db.Joins("JOIN saved_view_pins ON saved_view_pins.view_id = saved_views.id AND saved_view_pins.user_id = ?", user.ID)
+	err := visibleViews(q, user, manage).Order("saved_views.name, saved_views.id").Find(&views).Error
+	return views, err
+}
+
+// FindView charge la vue id si user peut l'ouvrir.
+func FindView(db *gorm.DB, user User, id uint, manage bool) (SavedView, error) {
+	var view SavedView
+	err := visibleViews(db, user, manage).First(&view, id).Error
+	return view, err
+}
+
+// IsPinned renvoie l'ensemble des vues épinglées par userID.
+func IsPinned(db *gorm.DB, userID uint) map[uint]bool {
+	var pins []SavedViewPin
+	db.Where("user_id = ?", userID).Find(&pins)
+	out := make(map[uint]bool, len(pins))
+	for _, p := range pins {
+		out[p.ViewID] = true
+	}
+	return out
+}
+
+// TogglePin épingle la vue pour userID, ou la retire de sa navigation.
+func TogglePin(db *gorm.DB, userID, viewID uint) error {
+	res := db.Where("user_id = ? AND view_id = ?", userID, viewID).Delete(&SavedViewPin{})
+	if res.Error != nil || res.RowsAffected > 0 {
+		return res.Error
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&SavedViewPin{UserID: userID, ViewID: viewID}).Error
+}
+
+// DeleteView supprime la vue et ses épinglages.
+func DeleteView(db *gorm.DB, view SavedView) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("view_id = ?", view.ID).Delete(&SavedViewPin{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&view).Error
+	})
+}
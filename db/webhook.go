@@ -0,0 +1,166 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Webhook est un abonnement aux événements des tickets : chaque événement
+// retenu est envoyé en JSON (POST) à URL, signé avec Secret.
+type Webhook struct {
+	gorm.Model
+	URL         string
+	Description string
+	Secret      string
+	// Events liste les types d'événements retenus, séparés par des virgules ;
+	// vide, tous les événements sont envoyés.
+	Events string
+	Active bool
+}
+
+// WebhookEvents liste les événements proposés aux abonnements.
+var WebhookEvents = []string{
+	EventTicketCreated,
+	EventTicketUpdated,
+	EventTicketCommented,
+	EventTicketDeleted,
+}
+
+var ErrInvalidWebhookURL = errors.New("l'URL doit être en http(s) et complète")
+
+// Wants indique si l'abonnement retient les événements de type t.
+func (w Webhook) Wants(t string) bool {
+	if w.Events == "" {
+		return true
+	}
+	for _, e := range strings.Split(w.Events, ",") {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (w Webhook) EventList() []string {
+	if w.Events == "" {
+		return nil
+	}
+	return strings.Split(w.Events, ",")
+}
+
+// CreateWebhook enregistre un abonnement actif avec un secret aléatoire.
+// Les événements inconnus sont ignorés.
+func CreateWebhook(db *gorm.DB, rawURL, description string, events []string) (Webhook, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, ErrInvalidWebhookURL
+	}
+	var kept []string
+	for _, e := range events {
+		for _, known := range WebhookEvents {
+			if e == known {
+				kept = append(kept, e)
+			}
+		}
+	}
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return Webhook{}, err
+	}
+	w := Webhook{
+		URL:         u.String(),
+		Description: description,
+		Secret:      "whsec_" + hex.EncodeToString(buf),
+		Events:      strings.Join(kept, ","),
+		Active:      true,
+	}
+	return w, db.Create(&w).Error
+}
+
+// WebhookDelivery est un envoi d'événement à un abonnement : la file
+// d'envoi et, une fois traité, le journal des livraisons.
+type WebhookDelivery struct {
+	gorm.Model
+	WebhookID     uint `gorm:"index"`
+	Webhook       Webhook
+	Event         string
+	TicketID      uint
+	Payload       string
+	Status        string `gorm:"index"`
+	Attempts      int
+	NextAttemptAt time.Time `gorm:"index"`
+	ResponseCode  int
+	LastError     string
+	DeliveredAt   *time.Time
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed" // abandonné après le nombre maximal de tentatives
+)
+
+// EnqueueDelivery met un envoi en file, à faire dès que possible.
+func EnqueueDelivery(db *gorm.DB, d *WebhookDelivery) error {
+	d.Status = DeliveryPending
+	d.NextAttemptAt = time.Now().UTC()
+	return db.Create(d).Error
+}
+
+// DueDeliveries renvoie au plus limit envois dus, avec leur abonnement, même
+// supprimé depuis : les événements survenus avant la suppression sont livrés.
+// Comme pour les e-mails, les dates de la file sont en UTC.
+func DueDeliveries(db *gorm.DB, now time.Time, limit int) ([]WebhookDelivery, error) {
+	var out []WebhookDelivery
+	err := db.Preload("Webhook", func(q *gorm.DB) *gorm.DB { return q.Unscoped() }).
+		Where("status = ? AND next_attempt_at <= ?", DeliveryPending, now.UTC()).
+		Order("next_attempt_at, id").Limit(limit).Find(&out).Error
+	return out, err
+}
+
+// ClaimDelivery réserve l'envoi pendant lease ; false s'il a déjà été pris.
+func ClaimDelivery(db *gorm.DB, d *WebhookDelivery, lease time.Duration) (bool, error) {
+	until := time.Now().UTC().Add(lease)
+	res := db.Model(&WebhookDelivery{}).
+		Where("id = ? AND status = ? AND next_attempt_at = ?", d.ID, DeliveryPending, d.NextAttemptAt).
+		Update("next_attempt_at", until)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	d.NextAttemptAt = until
+	return res.RowsAffected > 0, nil
+}
+
+// RecordDeliveryAttempt note le résultat d'une tentative. Sans erreur,
+// l'envoi est livré ; sinon il est retenté après retry, ou abandonné si
+// retry est nul.
+func RecordDeliveryAttempt(db *gorm.DB, d *WebhookDelivery, code int, sendErr error, retry time.Duration) error {
+	d.Attempts++
+	d.ResponseCode = code
+	d.LastError = ""
+	switch {
+	case sendErr == nil:
+		now := time.Now()
+		d.Status, d.DeliveredAt = DeliveryDelivered, &now
+	case retry <= 0:
+		d.Status, d.LastError = DeliveryFailed, sendErr.Error()
+	default:
+		d.LastError = sendErr.Error()
+		d.NextAttemptAt = time.Now().UTC().Add(retry)
+	}
+	return db.Model(d).Select("attempts", "response_code", "last_error", "status", "delivered_at", "next_attempt_at").
+		Updates(d).Error
+}
+
+// RetryDelivery remet un envoi en file pour une nouvelle série de tentatives.
+func RetryDelivery(db *gorm.DB, id uint) error {
+	return db.Model(&WebhookDelivery{}).Where("id = ?", id).Updates(map[string]any{
+		"status": DeliveryPending, "attempts": 0, "next_attempt_at": time.Now().UTC(),
+	}).Error
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"time"
+
+	"sae/workflow"
+
+	"gorm.io/gorm"
+)
+
+// TransitionError signale une transition refusée par le workflow, pour la
+// distinguer d'une erreur de base quand le changement se fait dans SaveTicket.
+type TransitionError struct {
+	Err error
+}
+
+func (e *TransitionError) Error() string { return e.Err.Error() }
+func (e *TransitionError) Unwrap() error { return e.Err }
+
+// ChangeTicketState fait franchir au ticket la transition vers to si le
+// workflow l'autorise pour role, et la trace dans l'historique. Le ticket
+// n'est pas enregistré : l'appelant le sauvegarde avec ses autres changements.
+func ChangeTicketState(db *gorm.DB, wf *workflow.Definition, ticket *Ticket, to, role, actor string, fields map[string]string) error {
+	if ticket.State == to {
+		return nil
+	}
+	if err := wf.Check(ticket.State, to, role, fields); err != nil {
+		return &TransitionError{Err: err}
+	}
+
+	from := ticket.State
+	LogTicketChange(db, *ticket, actor, "State", from, to)
+	MarkFirstResponse(ticket, actor)
+	ticket.State = to
+	if wf.IsClosed(to) {
+		ticket.ClosedAt = time.Now()
+	} else {
+		ticket.ClosedAt = time.Time{}
+	}
+
+	if r := fields["resolution"]; r != "" && r != ticket.Resolution {
+		LogTicketChange(db, *ticket, actor, "Resolution", ticket.Resolution, r)
+		ticket.Resolution = r
+	}
+	Publish(db, Event{Type: EventTicketStateChanged, Ticket: *ticket, Actor: actor, Data: map[string]string{
+		"from": from, "to": to, "resolution": ticket.Resolution,
+	}})
+	return nil
+}
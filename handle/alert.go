@@ -0,0 +1,269 @@
+package handle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// -------------------- API v1 : alertes de supervision --------------------
+
+// AlertPayload est le corps envoyé par Alertmanager (webhook_config) ; les
+// autres outils peuvent envoyer le même format, seul "alerts" est exigé.
+type AlertPayload struct {
+	Status            string            `json:"status"`
+	Receiver          string            `json:"receiver"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Alerts            []AlertItem       `json:"alerts" binding:"required"`
+}
+
+type AlertItem struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+}
+
+type AlertResult struct {
+	Fingerprint string `json:"fingerprint"`
+	TicketID    uint   `json:"ticket_id,omitempty"`
+	// Action vaut created, updated, resolved ou ignored.
+	Action string `json:"action"`
+}
+
+// alertPriorities traduit le label severity en priorité de ticket ; une
+// sévérité absente ou inconnue donne la priorité par défaut.
+var alertPriorities = map[string]string{
+	"critical": "urgent",
+	"page":     "urgent",
+	"error":    "high",
+	"high":     "high",
+	"major":    "high",
+	"warning":  "medium",
+	"minor":    "medium",
+	"info":     "low",
+	"low":      "low",
+	"none":     "low",
+}
+
+func alertPriority(a AlertItem) string {
+	if p, ok := alertPriorities[strings.ToLower(a.Labels["severity"])]; ok {
+		return p
+	}
+	return db.DefaultPriority
+}
+
+// alertFingerprint reprend l'empreinte fournie, ou la calcule à partir des
+// labels triés pour les émetteurs qui n'en envoient pas.
+func alertFingerprint(a AlertItem) string {
+	if a.Fingerprint != "" {
+		return a.Fingerprint
+	}
+	keys := make([]string, 0, len(a.Labels))
+	for k := range a.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\n", k, a.Labels[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func alertTitle(a AlertItem) string {
+	name := a.Labels["alertname"]
+	if name == "" {
+		name = "Alerte"
+	}
+	if s := a.Annotations["summary"]; s != "" {
+		return name + " : " + s
+	}
+	return name
+}
+
+func alertDescription(a AlertItem) string {
+	var b strings.Builder
+	if d := a.Annotations["description"]; d != "" {
+		b.WriteString(d + "\n\n")
+	}
+	keys := make([]string, 0, len(a.Labels))
+	for k := range a.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b.WriteString("Labels :\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "  %s = %s\n", k, a.Labels[k])
+	}
+	if !a.StartsAt.IsZero() {
+		fmt.Fprintf(&b, "\nDébut : %s\n", a.StartsAt.Local().Format("02/01/2006 15:04:05"))
+	}
+	if a.GeneratorURL != "" {
+		fmt.Fprintf(&b, "Source : %s\n", a.GeneratorURL)
+	}
+	return b.String()
+}
+
+// POST /api/v1/alerts : chaque alerte à l'état firing ouvre un ticket, ou met
+// à jour le ticket encore ouvert de la même empreinte ; une alerte resolved
+// ferme ce ticket (ou y ajoute un message, selon GTM_ALERT_RESOLVE). Réservé
+// à la permission alert.create (vérifiée par la route) ; le compte est le
+// demandeur des tickets créés.
+func APIReceiveAlerts(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	var in AlertPayload
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body", "details": err.Error()})
+		return
+	}
+
+	// Tout le lot ou rien : en cas d'erreur, l'émetteur renvoie le même lot.
+	results := make([]AlertResult, 0, len(in.Alerts))
+	err := database.Transaction(func(tx *gorm.DB) error {
+		for _, a := range in.Alerts {
+			if a.Status == "" {
+				a.Status = in.Status
+			}
+			res, err := applyAlert(c, tx, a)
+			if err != nil {
+				return fmt.Errorf("alerte %s : %w", res.Fingerprint, err)
+			}
+			results = append(results, res)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "alert processing failed", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+func applyAlert(c *gin.Context, tx *gorm.DB, a AlertItem) (AlertResult, error) {
+	wf := getWorkflow(c)
+	user, role := currentUser(c), currentRole(c)
+	res := AlertResult{Fingerprint: alertFingerprint(a), Action: "ignored"}
+	now := time.Now()
+
+	alert, found := db.LatestAlert(tx, res.Fingerprint)
+	if found && wf.IsClosed(alert.Ticket.State) {
+		found = false
+	}
+	// Ticket fermé ou supprimé depuis : l'alerte n'est plus ouverte.
+	if !found && alert.OpenFingerprint != nil {
+		if err := db.CloseAlert(tx, &alert); err != nil {
+			return res, err
+		}
+	}
+
+	if a.Status == db.AlertResolved {
+		if !found || alert.Status == db.AlertResolved {
+			return res, nil
+		}
+		ticket := alert.Ticket
+		res.TicketID, res.Action = ticket.ID, "resolved"
+		ends := a.EndsAt
+		if ends.IsZero() {
+			ends = now
+		}
+		note := "Alerte résolue le " + ends.Local().Format("02/01/2006 15:04:05") + "."
+		if err := resolveAlertTicket(c, tx, &ticket, note, role, user); err != nil {
+			return res, err
+		}
+		alert.Status, alert.EndsAt, alert.LastSeenAt = db.AlertResolved, &ends, now
+		if wf.IsClosed(ticket.State) {
+			alert.OpenFingerprint = nil
+		}
+		return res, tx.Omit(clause.Associations).Save(&alert).Error
+	}
+
+	priority := alertPriority(a)
+	if found {
+		ticket := alert.Ticket
+		res.TicketID, res.Action = ticket.ID, "updated"
+		if alert.Status == db.AlertResolved {
+			if _, err := db.AddTicketComment(tx, ticket, user, "L'alerte est de nouveau active.", nil, false); err != nil {
+				return res, err
+			}
+		}
+		// Une sévérité qui s'aggrave relève la priorité ; elle ne la baisse jamais.
+		if db.PriorityRank(priority) > db.PriorityRank(ticket.Priority) {
+			err := db.SaveTicket(tx, &ticket, func(tx *gorm.DB) error {
+				return db.SetTicketPriority(tx, getCalendars(c), &ticket, priority, user)
+			})
+			if err != nil {
+				return res, err
+			}
+		}
+		alert.Status, alert.EndsAt, alert.LastSeenAt = db.AlertFiring, nil, now
+		alert.OpenFingerprint = &alert.Fingerprint
+		alert.Firings++
+		return res, tx.Omit(clause.Associations).Save(&alert).Error
+	}
+
+	ticket := db.Ticket{
+		Title:       alertTitle(a),
+		Description: alertDescription(a),
+		User:        user,
+		State:       wf.Initial,
+		Priority:    priority,
+	}
+	if err := db.CreateTicket(tx, getCalendars(c), &ticket); err != nil {
+		return res, err
+	}
+	res.TicketID, res.Action = ticket.ID, "created"
+	starts := a.StartsAt
+	if starts.IsZero() {
+		starts = now
+	}
+	alert = db.Alert{
+		Fingerprint:     res.Fingerprint,
+		OpenFingerprint: &res.Fingerprint,
+		Name:            a.Labels["alertname"],
+		TicketID:        ticket.ID,
+		Status:          db.AlertFiring,
+		StartsAt:        starts,
+		LastSeenAt:      now,
+		Firings:         1,
+	}
+	return res, tx.Create(&alert).Error
+}
+
+// resolveAlertTicket ferme le ticket par la première transition vers un état
+// fermé que le workflow permet ; à défaut, ou avec GTM_ALERT_RESOLVE=comment,
+// la résolution est seulement signalée par un message.
+func resolveAlertTicket(c *gin.Context, tx *gorm.DB, ticket *db.Ticket, note, role, user string) error {
+	wf := getWorkflow(c)
+	if getConfig(c).AlertResolve != "comment" {
+		fields := map[string]string{"resolution": note}
+		for _, to := range wf.Next(ticket.State, role) {
+			if !wf.IsClosed(to) || wf.Check(ticket.State, to, role, fields) != nil {
+				continue
+			}
+			return db.SaveTicket(tx, ticket, func(tx *gorm.DB) error {
+				return db.ChangeTicketState(tx, wf, ticket, to, role, user, fields)
+			})
+		}
+	}
+	_, err := db.AddTicketComment(tx, *ticket, user, note, nil, false)
+	return err
+}
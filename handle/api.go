@@ -0,0 +1,528 @@
+package handle
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// -------------------- API v1 : tickets --------------------
+
+type TicketResponse struct {
+	ID          uint           `json:"id"`
+	Title       string         `json:"title"`
+	Description string         `json:"description"`
+	User        string         `json:"user"`
+	State       string         `json:"state"`
+	Priority    string         `json:"priority"`
+	Resolution  string         `json:"resolution,omitempty"`
+	AssigneeID  *uint          `json:"assignee_id"`
+	Assignee    string         `json:"assignee,omitempty"`
+	Labels      []string       `json:"labels"`
+	Queue       string         `json:"queue,omitempty"`
+	Fields      map[string]any `json:"fields"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	ClosedAt    *time.Time     `json:"closed_at"`
+	SLA         *SLAInfo       `json:"sla,omitempty"`
+}
+
+type SLAInfo struct {
+	FirstResponseAt    *time.Time `json:"first_response_at"`
+	ResponseDueAt      *time.Time `json:"response_due_at"`
+	ResolutionDueAt    *time.Time `json:"resolution_due_at"`
+	ResponseBreached   bool       `json:"response_breached"`
+	ResolutionBreached bool       `json:"resolution_breached"`
+	RemainingMinutes   *int64     `json:"remaining_minutes,omitempty"`
+}
+
+func newTicketResponse(t db.Ticket) TicketResponse {
+	r := TicketResponse{
+		ID:          t.ID,
+		Title:       t.Title,
+		Description: t.Description,
+		User:        t.User,
+		State:       t.State,
+		Priority:    t.Priority,
+		Resolution:  t.Resolution,
+		AssigneeID:  t.AssigneeID,
+		CreatedAt:   t.CreatedAt,
+		UpdatedAt:   t.UpdatedAt,
+	}
+	if t.Assignee != nil {
+		r.Assignee = t.Assignee.Username
+	}
+	if t.Queue != nil {
+		r.Queue = t.Queue.Name
+	}
+	r.Labels = make([]string, 0, len(t.Labels))
+	for _, l := range t.Labels {
+		r.Labels = append(r.Labels, l.Name)
+	}
+	// Une valeur par champ, une liste pour un choix multiple.
+	r.Fields = map[string]any{}
+	for _, v := range t.FieldValues {
+		if v.Field == nil {
+			continue
+		}
+		if v.Field.Type != db.FieldMultiSelect {
+			r.Fields[v.Field.Name] = v.Value
+			continue
+		}
+		values, _ := r.Fields[v.Field.Name].([]string)
+		r.Fields[v.Field.Name] = append(values, v.Value)
+	}
+	if sla := t.SLA(); sla.HasPolicy {
+		r.SLA = &SLAInfo{
+			FirstResponseAt:    t.FirstResponseAt,
+			ResponseDueAt:      t.ResponseDueAt,
+			ResolutionDueAt:    t.ResolutionDueAt,
+			ResponseBreached:   sla.ResponseBreached,
+			ResolutionBreached: sla.ResolutionBreached,
+		}
+		if !sla.Closed {
+			minutes := int64(sla.Remaining / time.Minute)
+			r.SLA.RemainingMinutes = &minutes
+		}
+	}
+	if !t.ClosedAt.IsZero() {
+		closed := t.ClosedAt
+		r.ClosedAt = &closed
+	}
+	return r
+}
+
+// Champs optionnels : un champ absent du JSON n'est pas modifié.
+// assignee_id à 0 désassigne le ticket ; resolution accompagne un changement
+// d'état quand le workflow l'exige ; labels (noms) remplace les étiquettes ;
+// queue est le nom de la file ("" : non classé) ; fields associe aux noms
+// des champs personnalisés une valeur (texte ou nombre), une liste pour un
+// choix multiple, ou null pour l'effacer.
+type TicketInput struct {
+	Title       *string        `json:"title"`
+	Description *string        `json:"description"`
+	User        *string        `json:"user"`
+	State       *string        `json:"state"`
+	Priority    *string        `json:"priority"`
+	AssigneeID  *uint          `json:"assignee_id"`
+	Labels      *[]string      `json:"labels"`
+	Queue       *string        `json:"queue"`
+	Fields      map[string]any `json:"fields"`
+	Resolution  string         `json:"resolution"`
+}
+
+// loadTicket charge le ticket :id et vérifie que l'appelant a le droit de le voir.
+func loadTicket(c *gin.Context, database *gorm.DB) (db.Ticket, bool) {
+	var ticket db.Ticket
+	id, ok := paramID(c, "id")
+	if !ok {
+		return ticket, false
+	}
+	if err := db.PreloadFieldValues(database.Preload("Assignee").Preload("Labels").Preload("Queue")).First(&ticket, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "ticket not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed", "details": err.Error()})
+		}
+		return ticket, false
+	}
+	if !canSeeTicket(c, ticket) {
+		// On ne révèle pas l'existence d'un ticket appartenant à un autre client.
+		c.JSON(http.StatusNotFound, gin.H{"error": "ticket not found"})
+		return ticket, false
+	}
+	return ticket, true
+}
+
+// GET /api/v1/tickets : un client ne voit que ses tickets, Supervisor/Admin voient tout.
+// Mêmes filtres, tri et pagination que les listes HTML (voir db.TicketFilter).
+func APIListTickets(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	f, err := ticketFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid filter", "details": err.Error()})
+		return
+	}
+	page, err := db.ListTickets(database, f)
+	if errors.Is(err, db.ErrInvalidFilter) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid filter", "details": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed", "details": err.Error()})
+		return
+	}
+
+	// Le corps reste un tableau ; la page suivante est annoncée par les en-têtes.
+	if page.NextCursor != "" {
+		query := f.Query()
+		query.Set("cursor", page.NextCursor)
+		c.Header("X-Next-Cursor", page.NextCursor)
+		c.Header("Link", "<"+c.Request.URL.Path+"?"+query.Encode()+`>; rel="next"`)
+	}
+	out := make([]TicketResponse, 0, len(page.Tickets))
+	for _, t := range page.Tickets {
+		out = append(out, newTicketResponse(t))
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// GET /api/v1/tickets/:id
+func APIGetTicket(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	ticket, ok := loadTicket(c, database)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, newTicketResponse(ticket))
+}
+
+// POST /api/v1/tickets : comme POST /form ; choisir le demandeur exige la
+// permission ticket.edit et la priorité ticket.update.priority, comme dans
+// /admin/ticket/add.
+func APICreateTicket(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	var in TicketInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body", "details": err.Error()})
+		return
+	}
+	if in.Title == nil || *in.Title == "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "title is required"})
+		return
+	}
+
+	if in.State != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "a ticket is created in the initial state; change it with PATCH"})
+		return
+	}
+
+	ticket := db.Ticket{
+		Title: *in.Title,
+		User:  currentUser(c),
+		State: getWorkflow(c).Initial,
+	}
+	if in.Description != nil {
+		ticket.Description = *in.Description
+	}
+	if in.Labels != nil {
+		labels, ok := inputLabels(c, database, *in.Labels)
+		if !ok {
+			return
+		}
+		ticket.Labels = labels
+	}
+	if in.Queue != nil {
+		queue, ok := inputQueue(c, database, *in.Queue)
+		if !ok {
+			return
+		}
+		if queue != nil {
+			ticket.QueueID, ticket.Queue = &queue.ID, queue
+		}
+	}
+
+	_, values, ok := inputFields(c, database, ticket.QueueID, in.Fields, false)
+	if !ok {
+		return
+	}
+
+	if in.User != nil {
+		if !can(c, db.PermTicketEdit) {
+			missingPermission(c, db.PermTicketEdit)
+			return
+		}
+		ticket.User = *in.User
+	}
+	if in.Priority != nil {
+		if !can(c, db.PermTicketUpdatePriority) {
+			missingPermission(c, db.PermTicketUpdatePriority)
+			return
+		}
+		ticket.Priority = *in.Priority
+	}
+
+	err := database.Transaction(func(tx *gorm.DB) error {
+		if err := db.CreateTicket(tx, getCalendars(c), &ticket); err != nil {
+			return err
+		}
+		return db.InitTicketFields(tx, ticket.ID, values)
+	})
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidPriority) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid priority"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "create failed", "details": err.Error()})
+		return
+	}
+	db.LoadFieldValues(database, &ticket)
+	c.Header("Location", "/api/v1/tickets/"+strconv.FormatUint(uint64(ticket.ID), 10))
+	c.JSON(http.StatusCreated, newTicketResponse(ticket))
+}
+
+// PATCH /api/v1/tickets/:id : chaque champ reçu exige sa permission (mêmes
+// règles que les routes HTML).
+func APIUpdateTicket(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	ticket, ok := loadTicket(c, database)
+	if !ok {
+		return
+	}
+
+	var in TicketInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body", "details": err.Error()})
+		return
+	}
+
+	checks := []struct {
+		set  bool
+		perm string
+	}{
+		{in.Title != nil || in.Description != nil || in.User != nil || in.Queue != nil, db.PermTicketEdit},
+		{in.State != nil, db.PermTicketUpdateState},
+		{in.Priority != nil, db.PermTicketUpdatePriority},
+		{in.AssigneeID != nil, db.PermTicketAssign},
+		{in.Labels != nil, db.PermTicketUpdateLabels},
+		{in.Fields != nil, db.PermTicketUpdateFields},
+	}
+	for _, check := range checks {
+		if check.set && !can(c, check.perm) {
+			missingPermission(c, check.perm)
+			return
+		}
+	}
+	role := currentRole(c)
+	if in.Priority != nil && !db.IsPriority(*in.Priority) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid priority"})
+		return
+	}
+
+	// Tout est validé avant la moindre modification : le changement est
+	// ensuite appliqué en une seule transaction.
+	var labels []db.Label
+	if in.Labels != nil {
+		if labels, ok = inputLabels(c, database, *in.Labels); !ok {
+			return
+		}
+	}
+	queueID := ticket.QueueID
+	if in.Queue != nil {
+		queue, ok := inputQueue(c, database, *in.Queue)
+		if !ok {
+			return
+		}
+		queueID = nil
+		if queue != nil {
+			queueID = &queue.ID
+		}
+	}
+	// Les champs sont ceux de la file d'arrivée.
+	var fields []db.CustomField
+	var values db.FieldValues
+	if in.Fields != nil {
+		if fields, values, ok = inputFields(c, database, queueID, in.Fields, true); !ok {
+			return
+		}
+	}
+	if in.Queue != nil && !sameQueue(queueID, ticket.QueueID) {
+		if err := db.CheckRequiredFields(database, ticket.ID, queueID, values); err != nil {
+			if errors.Is(err, db.ErrInvalidFieldValue) {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid field", "details": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed", "details": err.Error()})
+			}
+			return
+		}
+	}
+
+	user := currentUser(c)
+	err := db.SaveTicket(database, &ticket, func(tx *gorm.DB) error {
+		if in.State != nil {
+			fields := map[string]string{"resolution": in.Resolution}
+			if err := db.ChangeTicketState(tx, getWorkflow(c), &ticket, *in.State, role, user, fields); err != nil {
+				return err
+			}
+		}
+		if in.AssigneeID != nil {
+			if err := db.AssignTicket(tx, &ticket, *in.AssigneeID, user); err != nil {
+				return err
+			}
+		}
+		if in.Labels != nil {
+			if err := db.SetTicketLabels(tx, &ticket, labels, user); err != nil {
+				return err
+			}
+		}
+		if in.Queue != nil {
+			var id uint
+			if queueID != nil {
+				id = *queueID
+			}
+			if err := db.MoveTicket(tx, &ticket, id, user); err != nil {
+				return err
+			}
+		}
+		if in.Fields != nil {
+			if err := db.SetTicketFields(tx, ticket, fields, values, user); err != nil {
+				return err
+			}
+		}
+
+		apply := func(field string, dst *string, v *string) {
+			if v == nil || *dst == *v {
+				return
+			}
+			db.LogTicketChange(tx, ticket, user, field, *dst, *v)
+			*dst = *v
+		}
+		apply("Title", &ticket.Title, in.Title)
+		apply("Description", &ticket.Description, in.Description)
+		apply("User", &ticket.User, in.User)
+		if in.Priority != nil {
+			return db.SetTicketPriority(tx, getCalendars(c), &ticket, *in.Priority, user)
+		}
+		return nil
+	})
+	if !TicketSaved(c, err) {
+		return
+	}
+	if in.Fields != nil {
+		db.LoadFieldValues(database, &ticket)
+	}
+	c.JSON(http.StatusOK, newTicketResponse(ticket))
+}
+
+// missingPermission refuse la requête, en nommant la permission manquante.
+func missingPermission(c *gin.Context, perm string) {
+	c.JSON(http.StatusForbidden, gin.H{"error": "forbidden", "details": "missing permission " + perm})
+}
+
+// inputLabels résout les noms d'étiquettes reçus en JSON.
+func inputLabels(c *gin.Context, database *gorm.DB, names []string) ([]db.Label, bool) {
+	labels, err := db.LabelsByName(database, names)
+	if errors.Is(err, db.ErrUnknownLabel) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "unknown label"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed", "details": err.Error()})
+		return nil, false
+	}
+	return labels, true
+}
+
+// inputQueue résout le nom de file reçu en JSON ; "" : non classé.
+func inputQueue(c *gin.Context, database *gorm.DB, name string) (*db.Queue, bool) {
+	queue, err := db.FindQueueByName(database, name)
+	if errors.Is(err, db.ErrUnknownQueue) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "unknown queue"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed", "details": err.Error()})
+		return nil, false
+	}
+	return queue, true
+}
+
+// inputFields valide les champs personnalisés reçus en JSON pour un ticket de
+// la file queueID. En modification (partial), seuls les champs présents sont
+// validés et remplacés ; à la création, les champs obligatoires sont exigés.
+func inputFields(c *gin.Context, database *gorm.DB, queueID *uint, in map[string]any, partial bool) ([]db.CustomField, db.FieldValues, bool) {
+	fields, err := db.FieldsFor(database, queueID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed", "details": err.Error()})
+		return nil, nil, false
+	}
+	known := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		known[f.Name] = true
+	}
+	for name := range in {
+		if !known[name] {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "unknown field", "details": name})
+			return nil, nil, false
+		}
+	}
+	if partial {
+		var present []db.CustomField
+		for _, f := range fields {
+			if _, ok := in[f.Name]; ok {
+				present = append(present, f)
+			}
+		}
+		fields = present
+	}
+
+	values, err := db.ParseFieldValues(fields, func(name string) []string {
+		return jsonFieldValues(in[name])
+	})
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid field", "details": err.Error()})
+		return nil, nil, false
+	}
+	return fields, values, true
+}
+
+// jsonFieldValues convertit une valeur JSON en valeurs de formulaire.
+func jsonFieldValues(v any) []string {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}
+	case []any:
+		var out []string
+		for _, item := range v {
+			out = append(out, jsonFieldValues(item)...)
+		}
+		return out
+	}
+	return []string{fmt.Sprint(v)}
+}
+
+// DELETE /api/v1/tickets/:id : le propriétaire ou un Admin.
+func APIDeleteTicket(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	ticket, ok := loadTicket(c, database)
+	if !ok {
+		return
+	}
+	if !can(c, db.PermTicketDeleteAny) && ticket.User != currentUser(c) {
+		missingPermission(c, db.PermTicketDeleteAny)
+		return
+	}
+	if err := db.DeleteTicket(database, ticket, currentUser(c)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "delete failed", "details": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
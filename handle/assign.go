@@ -0,0 +1,93 @@
+package handle
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// -------------------- Assignation --------------------
+
+// AssignTicket traite le formulaire d'assignation des écrans superviseur et
+// admin : assignee_id vide désassigne, "me" assigne à l'utilisateur courant.
+// Depuis la vue "mes tickets assignés" (from=assigned), on y revient.
+func AssignTicket(redirect string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		database := getDB(c)
+		if database == nil {
+			return
+		}
+
+		id, _ := strconv.Atoi(c.Param("id"))
+		var ticket db.Ticket
+		if err := database.First(&ticket, id).Error; err != nil || !canSeeTicket(c, ticket) {
+			c.String(http.StatusNotFound, "Ticket introuvable")
+			return
+		}
+
+		var assigneeID uint
+		switch raw := c.PostForm("assignee_id"); raw {
+		case "":
+		case "me":
+			user, ok := loadCurrentUser(c, database)
+			if !ok {
+				return
+			}
+			assigneeID = user.ID
+		default:
+			v, err := strconv.ParseUint(raw, 10, 64)
+			if err != nil {
+				c.String(http.StatusBadRequest, "Agent invalide")
+				return
+			}
+			assigneeID = uint(v)
+		}
+
+		err := db.SaveTicket(database, &ticket, func(tx *gorm.DB) error {
+			return db.AssignTicket(tx, &ticket, assigneeID, currentUser(c))
+		})
+		if !TicketSaved(c, err) {
+			return
+		}
+		if c.PostForm("from") == "assigned" {
+			c.Redirect(http.StatusSeeOther, "/supervisor/assigned")
+			return
+		}
+		c.Redirect(http.StatusSeeOther, redirect)
+	}
+}
+
+// GET /supervisor/assigned : les tickets assignés à l'utilisateur courant.
+func AssignedTickets(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+
+	data, ok := TicketListing(c, func(f *db.TicketFilter) {
+		f.Assignee, f.Me = db.AssigneeMe, user.Username
+	})
+	if !ok {
+		return
+	}
+	tickets := data["tickets"].([]db.Ticket)
+	data["agents"], _ = db.Agents(database)
+	data["states"] = StateChoices(getWorkflow(c), currentRole(c), tickets)
+	data["isSupervisor"] = true
+	data["assignedView"] = true
+	data["pinnedViews"] = PinnedViewCounts(c)
+	// Une vue enregistrée depuis cette page garde le critère "assignés à moi".
+	query, _ := url.ParseQuery(data["viewQuery"].(string))
+	query.Set("assignee", db.AssigneeMe)
+	data["viewQuery"] = query.Encode()
+	c.HTML(http.StatusOK, "tickets.html", data)
+}
@@ -0,0 +1,432 @@
+package handle
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"sae/config"
+	"sae/db"
+	"sae/storage"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// -------------------- Pièces jointes --------------------
+
+func getConfig(c *gin.Context) config.Config {
+	v, _ := c.Get("config")
+	cfg, _ := v.(config.Config)
+	return cfg
+}
+
+func getStorage(c *gin.Context) storage.Store {
+	v, _ := c.Get("storage")
+	store, _ := v.(storage.Store)
+	return store
+}
+
+// upload est un fichier reçu et déjà contrôlé (taille, type détecté).
+type upload struct {
+	header *multipart.FileHeader
+	mime   string
+}
+
+// uploadFormSlack est la place laissée, dans le corps d'un envoi, aux champs
+// texte du formulaire et aux en-têtes multipart.
+const uploadFormSlack = 1 << 20
+
+// LimitUploads borne le corps d'une requête d'envoi avant que gin ne le lise :
+// au plus MaxUploadFiles fichiers de MaxUploadSize. Sans cette limite, la
+// taille de chaque fichier n'est contrôlée qu'une fois tout le corps reçu.
+func LimitUploads(c *gin.Context) {
+	cfg := getConfig(c)
+	limit := cfg.MaxUploadSize*max(cfg.MaxUploadFiles, 1) + uploadFormSlack
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+
+	var tooLarge *http.MaxBytesError
+	if _, err := c.MultipartForm(); errors.As(err, &tooLarge) {
+		msg := fmt.Sprintf("Envoi trop volumineux : au plus %d fichier(s) de %d Mo", max(cfg.MaxUploadFiles, 1), cfg.MaxUploadSize>>20)
+		if strings.HasPrefix(c.Request.URL.Path, "/api/") {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request too large", "details": msg})
+		} else {
+			c.String(http.StatusRequestEntityTooLarge, msg)
+			c.Abort()
+		}
+		return
+	}
+	c.Next()
+}
+
+// checkUploads contrôle tous les fichiers avant d'en stocker un seul, pour
+// ne pas créer de ticket ou de commentaire à moitié joint.
+func checkUploads(cfg config.Config, files []*multipart.FileHeader) ([]upload, error) {
+	if n := max(cfg.MaxUploadFiles, 1); int64(len(files)) > n {
+		return nil, fmt.Errorf("%d fichier(s) au plus par envoi", n)
+	}
+	var out []upload
+	for _, fh := range files {
+		if fh.Size > cfg.MaxUploadSize {
+			return nil, fmt.Errorf("%s dépasse la taille maximale (%d Mo)", fh.Filename, cfg.MaxUploadSize>>20)
+		}
+
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		mimeType, err := storage.DetectType(f, cfg.TypeAllowed)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s : %w", fh.Filename, err)
+		}
+		out = append(out, upload{header: fh, mime: mimeType})
+	}
+	return out, nil
+}
+
+// storeUpload envoie le contenu au stockage en calculant son empreinte, puis
+// enregistre la ligne Attachment.
+func storeUpload(database *gorm.DB, store storage.Store, ticket db.Ticket, commentID *uint, u upload, user string) (db.Attachment, error) {
+	key, err := storage.NewKey()
+	if err != nil {
+		return db.Attachment{}, err
+	}
+
+	src, err := u.header.Open()
+	if err != nil {
+		return db.Attachment{}, err
+	}
+	defer src.Close()
+
+	hash := sha256.New()
+	ctx := context.Background()
+	if err := store.Put(ctx, key, io.TeeReader(src, hash), u.header.Size, u.mime); err != nil {
+		return db.Attachment{}, err
+	}
+
+	attachment := db.Attachment{
+		TicketID:   ticket.ID,
+		CommentID:  commentID,
+		Filename:   filepath.Base(u.header.Filename),
+		Size:       u.header.Size,
+		MimeType:   u.mime,
+		Checksum:   hex.EncodeToString(hash.Sum(nil)),
+		StorageKey: key,
+		UploadedBy: user,
+	}
+	if err := database.Create(&attachment).Error; err != nil {
+		store.Delete(ctx, key)
+		return db.Attachment{}, err
+	}
+	// Les fichiers d'un commentaire sont tracés avec le commentaire lui-même.
+	if commentID == nil {
+		db.LogTicketChange(database, ticket, user, "Attachment", "", attachment.Filename)
+	}
+	return attachment, nil
+}
+
+// storeUploads enregistre les fichiers. À appeler dans une transaction : en
+// cas d'erreur, les blobs déjà envoyés sont renvoyés avec elle, et l'appelant
+// les retire avec discardUploads si la transaction est annulée.
+func storeUploads(database *gorm.DB, store storage.Store, ticket db.Ticket, commentID *uint, uploads []upload, user string) ([]db.Attachment, error) {
+	var out []db.Attachment
+	for _, u := range uploads {
+		a, err := storeUpload(database, store, ticket, commentID, u, user)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// discardUploads retire du stockage les blobs d'une transaction annulée.
+func discardUploads(store storage.Store, stored []db.Attachment) {
+	for _, a := range stored {
+		store.Delete(context.Background(), a.StorageKey)
+	}
+}
+
+// formFiles renvoie les fichiers du champ "attachments" d'un formulaire
+// multipart (aucun si le formulaire n'est pas multipart).
+func formFiles(c *gin.Context) []*multipart.FileHeader {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil
+	}
+	return form.File["attachments"]
+}
+
+// removeAttachment supprime la ligne, trace la suppression et, une fois la
+// transaction validée, retire le blob stocké.
+func removeAttachment(database *gorm.DB, store storage.Store, ticket db.Ticket, a db.Attachment, user string) error {
+	err := database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Delete(&a).Error; err != nil {
+			return err
+		}
+		// Les fichiers d'un commentaire sont tracés avec le commentaire lui-même.
+		if a.CommentID == nil {
+			db.LogTicketChange(tx, ticket, user, "Attachment", a.Filename, "")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return store.Delete(context.Background(), a.StorageKey)
+}
+
+// findVisibleAttachment charge la pièce jointe :id et son ticket, en
+// appliquant les règles de visibilité du ticket et des notes internes.
+func findVisibleAttachment(c *gin.Context, database *gorm.DB) (db.Attachment, db.Ticket, bool) {
+	var a db.Attachment
+	var ticket db.Ticket
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := database.First(&a, id).Error; err != nil {
+		return a, ticket, false
+	}
+	if err := database.First(&ticket, a.TicketID).Error; err != nil || !canSeeTicket(c, ticket) {
+		return a, ticket, false
+	}
+	if !db.AttachmentVisible(database, a, can(c, db.PermTicketInternal)) {
+		return a, ticket, false
+	}
+	return a, ticket, true
+}
+
+func serveAttachment(c *gin.Context, store storage.Store, a db.Attachment) {
+	blob, err := store.Get(c.Request.Context(), a.StorageKey)
+	if err != nil {
+		c.String(http.StatusNotFound, "Contenu introuvable")
+		return
+	}
+	defer blob.Close()
+
+	c.DataFromReader(http.StatusOK, a.Size, a.MimeType, blob, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename}),
+		"X-Content-Type-Options": "nosniff",
+	})
+}
+
+// POST /ticket/:id/attachments
+func TicketUploadAttachments(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	ticket, ok := findVisibleTicket(c, database)
+	if !ok {
+		return
+	}
+	cfg := getConfig(c)
+
+	uploads, err := checkUploads(cfg, formFiles(c))
+	if err != nil {
+		renderTicketPage(c, database, ticket, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	store := getStorage(c)
+	var stored []db.Attachment
+	err = database.Transaction(func(tx *gorm.DB) error {
+		stored, err = storeUploads(tx, store, ticket, nil, uploads, currentUser(c))
+		return err
+	})
+	if err != nil {
+		discardUploads(store, stored)
+		renderTicketPage(c, database, ticket, http.StatusInternalServerError, gin.H{"error": "Erreur lors de l'enregistrement du fichier"})
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/ticket/"+strconv.Itoa(int(ticket.ID)))
+}
+
+// GET /attachments/:id
+func DownloadAttachment(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	a, _, ok := findVisibleAttachment(c, database)
+	if !ok {
+		c.String(http.StatusNotFound, "Pièce jointe introuvable")
+		return
+	}
+	serveAttachment(c, getStorage(c), a)
+}
+
+// POST /attachments/:id/delete : l'auteur de l'envoi, un Supervisor ou un Admin.
+func DeleteAttachment(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	a, ticket, ok := findVisibleAttachment(c, database)
+	if !ok {
+		c.String(http.StatusNotFound, "Pièce jointe introuvable")
+		return
+	}
+	if a.UploadedBy != currentUser(c) && !can(c, db.PermAttachmentDeleteAny) {
+		c.String(http.StatusForbidden, "Vous n'avez pas le droit de supprimer ce fichier")
+		return
+	}
+	if err := removeAttachment(database, getStorage(c), ticket, a, currentUser(c)); err != nil {
+		c.String(http.StatusInternalServerError, "Échec de la suppression")
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/ticket/"+strconv.Itoa(int(ticket.ID)))
+}
+
+// -------------------- API v1 : pièces jointes --------------------
+
+type AttachmentResponse struct {
+	ID         uint      `json:"id"`
+	TicketID   uint      `json:"ticket_id"`
+	CommentID  *uint     `json:"comment_id"`
+	Filename   string    `json:"filename"`
+	Size       int64     `json:"size"`
+	MimeType   string    `json:"mime_type"`
+	Checksum   string    `json:"sha256"`
+	UploadedBy string    `json:"uploaded_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	URL        string    `json:"url"`
+}
+
+func newAttachmentResponse(a db.Attachment) AttachmentResponse {
+	return AttachmentResponse{
+		ID:         a.ID,
+		TicketID:   a.TicketID,
+		CommentID:  a.CommentID,
+		Filename:   a.Filename,
+		Size:       a.Size,
+		MimeType:   a.MimeType,
+		Checksum:   a.Checksum,
+		UploadedBy: a.UploadedBy,
+		CreatedAt:  a.CreatedAt,
+		URL:        "/api/v1/attachments/" + strconv.Itoa(int(a.ID)),
+	}
+}
+
+// GET /api/v1/tickets/:id/attachments
+func APIListAttachments(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	ticket, ok := loadTicket(c, database)
+	if !ok {
+		return
+	}
+	attachments, err := db.TicketAttachments(database, ticket.ID, can(c, db.PermTicketInternal))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed", "details": err.Error()})
+		return
+	}
+	out := make([]AttachmentResponse, 0, len(attachments))
+	for _, a := range attachments {
+		out = append(out, newAttachmentResponse(a))
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// POST /api/v1/tickets/:id/attachments : multipart, un ou plusieurs champs
+// "file" (ou "attachments"), et comment_id optionnel.
+func APIUploadAttachments(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	ticket, ok := loadTicket(c, database)
+	if !ok {
+		return
+	}
+	cfg := getConfig(c)
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "multipart form expected", "details": err.Error()})
+		return
+	}
+	files := append(form.File["file"], form.File["attachments"]...)
+	if len(files) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "no file"})
+		return
+	}
+
+	commentID := parseParentID(c.PostForm("comment_id"))
+	if commentID != nil {
+		var comment db.TicketComment
+		err := database.Where("ticket_id = ?", ticket.ID).First(&comment, *commentID).Error
+		if err != nil || (comment.Internal && !can(c, db.PermTicketInternal)) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid comment_id"})
+			return
+		}
+	}
+
+	uploads, err := checkUploads(cfg, files)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	store := getStorage(c)
+	var stored []db.Attachment
+	err = database.Transaction(func(tx *gorm.DB) error {
+		stored, err = storeUploads(tx, store, ticket, commentID, uploads, currentUser(c))
+		return err
+	})
+	if err != nil {
+		discardUploads(store, stored)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "upload failed", "details": err.Error()})
+		return
+	}
+	out := make([]AttachmentResponse, 0, len(stored))
+	for _, a := range stored {
+		out = append(out, newAttachmentResponse(a))
+	}
+	c.JSON(http.StatusCreated, out)
+}
+
+// GET /api/v1/attachments/:id
+func APIDownloadAttachment(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	a, _, ok := findVisibleAttachment(c, database)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "attachment not found"})
+		return
+	}
+	serveAttachment(c, getStorage(c), a)
+}
+
+// DELETE /api/v1/attachments/:id
+func APIDeleteAttachment(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	a, ticket, ok := findVisibleAttachment(c, database)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "attachment not found"})
+		return
+	}
+	if a.UploadedBy != currentUser(c) && !can(c, db.PermAttachmentDeleteAny) {
+		missingPermission(c, db.PermAttachmentDeleteAny)
+		return
+	}
+	if err := removeAttachment(database, getStorage(c), ticket, a, currentUser(c)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "delete failed", "details": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
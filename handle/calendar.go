@@ -0,0 +1,63 @@
+package handle
+
+import (
+	"net/http"
+	"time"
+
+	"sae/calendar"
+
+	"github.com/gin-gonic/gin"
+)
+
+// -------------------- Temps d'horloge / temps ouvré --------------------
+
+// statsCalendar lit les paramètres ?time=wall|business et ?calendar=<nom>
+// des routes /api/stats. Le calendrier renvoyé est nil en temps d'horloge ;
+// en temps ouvré, le calendrier par défaut est pris si aucun n'est nommé.
+func statsCalendar(c *gin.Context) (*calendar.Calendar, bool) {
+	switch c.DefaultQuery("time", "wall") {
+	case "wall":
+		return nil, true
+	case "business":
+		cal, err := getCalendars(c).Get(c.Query("calendar"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown calendar", "details": err.Error()})
+			return nil, false
+		}
+		return cal, true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "time must be wall or business"})
+		return nil, false
+	}
+}
+
+// TimeBasis décrit, dans les réponses JSON, la base de calcul des durées.
+type TimeBasis struct {
+	Time     string `json:"time"`
+	Calendar string `json:"calendar,omitempty"`
+}
+
+func timeBasis(cal *calendar.Calendar) TimeBasis {
+	if cal == nil {
+		return TimeBasis{Time: "wall"}
+	}
+	return TimeBasis{Time: "business", Calendar: cal.Name}
+}
+
+// minutesAverage accumule des durées et en donne la moyenne en minutes.
+type minutesAverage struct {
+	total time.Duration
+	n     int
+}
+
+func (a *minutesAverage) add(d time.Duration) {
+	a.total += d
+	a.n++
+}
+
+func (a minutesAverage) minutes() float64 {
+	if a.n == 0 {
+		return 0
+	}
+	return a.total.Minutes() / float64(a.n)
+}
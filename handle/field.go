@@ -0,0 +1,156 @@
+package handle
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// -------------------- Administration des champs personnalisés --------------------
+
+// fieldDefinition lit le formulaire d'un champ : name, label, type, options
+// (une par ligne), required, position et queues (files cochées).
+func fieldDefinition(c *gin.Context) (db.CustomField, []uint, error) {
+	position, _ := strconv.Atoi(c.PostForm("position"))
+	f := db.CustomField{
+		Name:     c.PostForm("name"),
+		Label:    c.PostForm("label"),
+		Type:     c.PostForm("type"),
+		Options:  c.PostForm("options"),
+		Required: c.PostForm("required") != "",
+		Position: position,
+	}
+	var queues []uint
+	for _, raw := range c.PostFormArray("queues") {
+		v, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return f, nil, db.ErrUnknownQueue
+		}
+		queues = append(queues, uint(v))
+	}
+	return f, queues, nil
+}
+
+func fieldAdminError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, db.ErrInvalidField):
+		c.String(http.StatusBadRequest, "Champ invalide : nom en minuscules (lettres, chiffres, _), type connu, options sans virgule pour une liste de choix")
+	case errors.Is(err, db.ErrUnknownQueue):
+		c.String(http.StatusBadRequest, "File inconnue")
+	default:
+		c.String(http.StatusBadRequest, "Champ invalide (nom déjà utilisé ?)")
+	}
+}
+
+// POST /admin/fields
+func AdminCreateField(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	f, queues, err := fieldDefinition(c)
+	if err == nil {
+		_, err = db.CreateField(database, f, queues)
+	}
+	if err != nil {
+		fieldAdminError(c, err)
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin#fields")
+}
+
+// POST /admin/fields/:id/edit : le nom et le type ne changent pas.
+func AdminUpdateField(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	var field db.CustomField
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := database.First(&field, id).Error; err != nil {
+		c.String(http.StatusNotFound, "Champ introuvable")
+		return
+	}
+	in, queues, err := fieldDefinition(c)
+	if err == nil {
+		err = db.UpdateField(database, &field, in, queues)
+	}
+	if err != nil {
+		fieldAdminError(c, err)
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin#fields")
+}
+
+// POST /admin/fields/:id/delete : les valeurs saisies sont supprimées.
+func AdminDeleteField(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := db.DeleteField(database, uint(id)); err != nil {
+		c.String(http.StatusInternalServerError, "Échec suppression")
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin#fields")
+}
+
+// -------------------- Valeurs des champs --------------------
+
+// FormFieldValues lit et valide, dans un formulaire, les champs qui
+// s'appliquent à un ticket de la file queueID (entrées cf_<nom>).
+func FormFieldValues(c *gin.Context, queueID *uint) (db.FieldValues, error) {
+	_, values, err := formFieldValues(c, getDB(c), queueID)
+	return values, err
+}
+
+func formFieldValues(c *gin.Context, database *gorm.DB, queueID *uint) ([]db.CustomField, db.FieldValues, error) {
+	fields, err := db.FieldsFor(database, queueID)
+	if err != nil {
+		return nil, nil, err
+	}
+	values, err := db.ParseFieldValues(fields, func(name string) []string {
+		return c.PostFormArray("cf_" + name)
+	})
+	return fields, values, err
+}
+
+// fieldErrorMessage rend lisible une erreur de validation des champs.
+func fieldErrorMessage(err error) string {
+	var fe *db.FieldError
+	if errors.As(err, &fe) {
+		return "Champ « " + fe.Field.Label + " » : " + fe.Reason
+	}
+	return "Erreur serveur"
+}
+
+// POST /ticket/:id/fields : modification des champs personnalisés depuis la
+// page du ticket (permission ticket.update.fields, vérifiée par la route).
+func TicketUpdateFields(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	ticket, ok := findVisibleTicket(c, database)
+	if !ok {
+		return
+	}
+	fields, values, err := formFieldValues(c, database, ticket.QueueID)
+	if err != nil {
+		renderTicketPage(c, database, ticket, http.StatusBadRequest, gin.H{"error": fieldErrorMessage(err)})
+		return
+	}
+	err = db.SaveTicket(database, &ticket, func(tx *gorm.DB) error {
+		return db.SetTicketFields(tx, ticket, fields, values, currentUser(c))
+	})
+	if !TicketSaved(c, err) {
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/ticket/"+strconv.Itoa(int(ticket.ID)))
+}
@@ -1 +1,136 @@
-package handle
\ No newline at end of file
+package handle
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"sae/calendar"
+	"sae/db"
+	"sae/workflow"
+
+	"github.com/gin-gonic/gin"
+)
+
+// -------------------- Identité --------------------
+
+// Les middlewares d'authentification de server.go déposent l'utilisateur,
+// son rôle et les permissions de ce rôle dans le contexte, quel que soit le
+// moyen d'authentification.
+
+func currentUser(c *gin.Context) string {
+	return c.GetString("user")
+}
+
+func currentRole(c *gin.Context) string {
+	return c.GetString("role")
+}
+
+// permissions renvoie les permissions du rôle de l'utilisateur courant.
+func permissions(c *gin.Context) db.PermissionSet {
+	v, _ := c.Get("permissions")
+	perms, _ := v.(db.PermissionSet)
+	return perms
+}
+
+// can indique si le rôle de l'utilisateur courant accorde la permission.
+func can(c *gin.Context, perm string) bool {
+	return permissions(c).Has(perm)
+}
+
+// Can est can pour les routes déclarées dans server.go.
+func Can(c *gin.Context, perm string) bool {
+	return can(c, perm)
+}
+
+// canSeeTicket : le demandeur voit son ticket, la permission ticket.read.any
+// donne accès aux autres, dans les files de l'agent (voir scopeToQueues).
+func canSeeTicket(c *gin.Context, ticket db.Ticket) bool {
+	if ticket.User == currentUser(c) {
+		return true
+	}
+	return can(c, db.PermTicketReadAny) && inQueueScope(c, getDB(c), ticket)
+}
+
+// CanSeeTicket est canSeeTicket pour les routes déclarées dans server.go.
+func CanSeeTicket(c *gin.Context, ticket db.Ticket) bool {
+	return canSeeTicket(c, ticket)
+}
+
+// TicketSaved répond à l'échec d'un db.SaveTicket et indique s'il a réussi :
+// une transition refusée ou une valeur invalide est une erreur du client,
+// le reste une erreur serveur.
+func TicketSaved(c *gin.Context, err error) bool {
+	if err == nil {
+		return true
+	}
+	api := strings.HasPrefix(c.Request.URL.Path, "/api/")
+	var rejected *db.TransitionError
+	switch {
+	case errors.As(err, &rejected):
+		if api {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid transition", "details": err.Error()})
+		} else {
+			c.String(http.StatusBadRequest, "Transition invalide : "+err.Error())
+		}
+	case errors.Is(err, db.ErrInvalidPriority):
+		if api {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid priority"})
+		} else {
+			c.String(http.StatusBadRequest, "Priorité invalide")
+		}
+	case errors.Is(err, db.ErrInvalidAssignee):
+		if api {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "assignee lacks the " + db.PermTicketHandle + " permission"})
+		} else {
+			c.String(http.StatusBadRequest, "Agent invalide")
+		}
+	default:
+		if api {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed", "details": err.Error()})
+		} else {
+			c.String(http.StatusInternalServerError, "Échec mise à jour")
+		}
+	}
+	return false
+}
+
+func getWorkflow(c *gin.Context) *workflow.Definition {
+	v, _ := c.Get("workflow")
+	wf, _ := v.(*workflow.Definition)
+	if wf == nil {
+		return workflow.Default()
+	}
+	return wf
+}
+
+func getCalendars(c *gin.Context) *calendar.Set {
+	v, _ := c.Get("calendars")
+	cals, _ := v.(*calendar.Set)
+	if cals == nil {
+		return calendar.Default()
+	}
+	return cals
+}
+
+// StateChoices renvoie, pour chaque ticket, les états proposés dans les
+// listes déroulantes : l'état courant puis ceux que role peut atteindre.
+func StateChoices(wf *workflow.Definition, role string, tickets []db.Ticket) map[uint][]string {
+	out := make(map[uint][]string, len(tickets))
+	for _, t := range tickets {
+		out[t.ID] = append([]string{t.State}, wf.Next(t.State, role)...)
+	}
+	return out
+}
+
+// -------------------- Paramètres --------------------
+
+func paramID(c *gin.Context, name string) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param(name), 10, 64)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return 0, false
+	}
+	return uint(id), true
+}
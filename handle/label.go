@@ -0,0 +1,124 @@
+package handle
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// -------------------- Administration des étiquettes --------------------
+
+// POST /admin/labels : name, color (#rrggbb) et description.
+func AdminCreateLabel(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	if _, err := db.CreateLabel(database, c.PostForm("name"), c.PostForm("color"), c.PostForm("description")); err != nil {
+		if errors.Is(err, db.ErrInvalidLabel) {
+			c.String(http.StatusBadRequest, err.Error())
+		} else {
+			c.String(http.StatusBadRequest, "Étiquette invalide (nom déjà utilisé ?)")
+		}
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin#labels")
+}
+
+// POST /admin/labels/:id/edit
+func AdminUpdateLabel(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	var label db.Label
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := database.First(&label, id).Error; err != nil {
+		c.String(http.StatusNotFound, "Étiquette introuvable")
+		return
+	}
+	if err := db.UpdateLabel(database, &label, c.PostForm("name"), c.PostForm("color"), c.PostForm("description")); err != nil {
+		if errors.Is(err, db.ErrInvalidLabel) {
+			c.String(http.StatusBadRequest, err.Error())
+		} else {
+			c.String(http.StatusBadRequest, "Étiquette invalide (nom déjà utilisé ?)")
+		}
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin#labels")
+}
+
+// POST /admin/labels/:id/delete : l'étiquette est retirée des tickets.
+func AdminDeleteLabel(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := db.DeleteLabel(database, uint(id), currentUser(c)); err != nil {
+		c.String(http.StatusInternalServerError, "Échec suppression")
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin#labels")
+}
+
+// -------------------- Étiquettes des tickets --------------------
+
+// FormLabels lit les étiquettes cochées d'un formulaire (champ "labels",
+// identifiants).
+func FormLabels(c *gin.Context) ([]db.Label, error) {
+	return formLabels(c, getDB(c))
+}
+
+func formLabels(c *gin.Context, database *gorm.DB) ([]db.Label, error) {
+	var ids []uint
+	for _, raw := range c.PostFormArray("labels") {
+		v, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return nil, db.ErrUnknownLabel
+		}
+		ids = append(ids, uint(v))
+	}
+	return db.LabelsByID(database, ids)
+}
+
+// TicketLabels traite le formulaire d'étiquettes des écrans superviseur :
+// les cases cochées remplacent les étiquettes du ticket. Comme pour
+// l'assignation, from=assigned ramène à la vue "mes tickets assignés".
+func TicketLabels(redirect string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		database := getDB(c)
+		if database == nil {
+			return
+		}
+
+		id, _ := strconv.Atoi(c.Param("id"))
+		var ticket db.Ticket
+		if err := database.First(&ticket, id).Error; err != nil || !canSeeTicket(c, ticket) {
+			c.String(http.StatusNotFound, "Ticket introuvable")
+			return
+		}
+
+		labels, err := formLabels(c, database)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Étiquette inconnue")
+			return
+		}
+		err = db.SaveTicket(database, &ticket, func(tx *gorm.DB) error {
+			return db.SetTicketLabels(tx, &ticket, labels, currentUser(c))
+		})
+		if !TicketSaved(c, err) {
+			return
+		}
+		if c.PostForm("from") == "assigned" {
+			c.Redirect(http.StatusSeeOther, "/supervisor/assigned")
+			return
+		}
+		c.Redirect(http.StatusSeeOther, redirect)
+	}
+}
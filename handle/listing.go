@@ -0,0 +1,147 @@
+package handle
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// -------------------- Listes de tickets --------------------
+
+// ticketFilter lit le filtre dans les paramètres de la requête, avec la
+// visibilité de l'appelant : un client ne voit que ses propres tickets.
+func ticketFilter(c *gin.Context) (db.TicketFilter, error) {
+	f, err := db.ParseTicketFilter(c.Request.URL.Query())
+	if err != nil {
+		return f, err
+	}
+	restrictFilter(c, &f)
+	return f, nil
+}
+
+func restrictFilter(c *gin.Context, f *db.TicketFilter) {
+	f.Me = currentUser(c)
+	if !can(c, db.PermTicketReadAny) {
+		f.User = currentUser(c)
+	}
+	scopeToQueues(c, getDB(c), f, currentUser(c))
+}
+
+// scopeToQueues limite la liste d'un agent membre de files à ces files ;
+// sans adhésion, ou avec la permission ticket.read.all_queues, il voit tous
+// les tickets.
+func scopeToQueues(c *gin.Context, database *gorm.DB, f *db.TicketFilter, username string) {
+	if can(c, db.PermTicketReadAllQueues) || database == nil {
+		return
+	}
+	if ids, err := db.MemberQueueIDs(database, username); err == nil && len(ids) > 0 {
+		f.MemberOf = ids
+	}
+}
+
+// inQueueScope applique à un seul ticket la limite de scopeToQueues : un agent
+// membre de files voit les tickets de ces files, ceux qui lui sont assignés et
+// ceux qu'il a ouverts.
+func inQueueScope(c *gin.Context, database *gorm.DB, ticket db.Ticket) bool {
+	if database == nil {
+		return false
+	}
+	me := currentUser(c)
+	var f db.TicketFilter
+	scopeToQueues(c, database, &f, me)
+	if f.MemberOf == nil || ticket.User == me || (ticket.QueueID != nil && slices.Contains(f.MemberOf, *ticket.QueueID)) {
+		return true
+	}
+	if ticket.AssigneeID == nil {
+		return false
+	}
+	var user db.User
+	return database.Select("id").Where("username = ?", me).First(&user).Error == nil && user.ID == *ticket.AssigneeID
+}
+
+// TicketListing charge la page de tickets demandée par les paramètres de la
+// requête et prépare les données communes aux tableaux HTML (formulaire de
+// filtre, lien vers la page suivante). force fixe les critères propres à la
+// page, par exemple l'agent assigné pour /supervisor/assigned.
+func TicketListing(c *gin.Context, force func(*db.TicketFilter)) (gin.H, bool) {
+	database := getDB(c)
+	if database == nil {
+		return nil, false
+	}
+	f, err := db.ParseTicketFilter(c.Request.URL.Query())
+	if err == nil {
+		// Le formulaire reprend les critères choisis, pas ceux imposés par la page.
+		query := f.Query()
+		restrictFilter(c, &f)
+		if force != nil {
+			force(&f)
+		}
+		var page db.TicketPage
+		if page, err = db.ListTickets(database, f); err == nil {
+			return listingData(c, f, query, page), true
+		}
+	}
+	if errors.Is(err, db.ErrInvalidFilter) {
+		c.String(http.StatusBadRequest, err.Error())
+	} else {
+		c.String(http.StatusInternalServerError, "Erreur chargement tickets")
+	}
+	return nil, false
+}
+
+// sortLabels nomme les champs de tri dans le formulaire de filtre.
+var sortLabels = map[string]string{
+	"id":                "Numéro",
+	"created_at":        "Création",
+	"updated_at":        "Mise à jour",
+	"closed_at":         "Fermeture",
+	"priority":          "Priorité",
+	"state":             "État",
+	"title":             "Titre",
+	"resolution_due_at": "Échéance SLA",
+}
+
+func listingData(c *gin.Context, f db.TicketFilter, query url.Values, page db.TicketPage) gin.H {
+	data := gin.H{
+		"tickets":      page.Tickets,
+		"f":            query,
+		"sort":         f.Sort,
+		"filtered":     len(query) > 0,
+		"paged":        f.Cursor != "",
+		"viewQuery":    query.Encode(),
+		"listPath":     c.Request.URL.Path,
+		"sorts":        db.TicketSorts,
+		"sortLabels":   sortLabels,
+		"priorities":   db.Priorities,
+		"stateOptions": getWorkflow(c).States,
+	}
+	data["labels"], _ = db.Labels(getDB(c))
+	data["viewRoles"], _ = db.ViewRoles(getDB(c))
+	fields, _ := db.CustomFields(getDB(c))
+	data["customFields"] = db.NewFieldViews(fields, nil)
+	queues, _ := db.Queues(getDB(c))
+	data["queues"] = queues
+	if f.MemberOf != nil {
+		var mine []string
+		for _, q := range queues {
+			if slices.Contains(f.MemberOf, q.ID) {
+				mine = append(mine, q.Name)
+			}
+		}
+		data["memberOf"] = mine
+	}
+	if page.NextCursor != "" {
+		next := url.Values{"cursor": {page.NextCursor}}
+		for k, v := range query {
+			next[k] = v
+		}
+		data["nextURL"] = c.Request.URL.Path + "?" + next.Encode()
+	}
+	return data
+}
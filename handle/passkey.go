@@ -0,0 +1,279 @@
+package handle
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"sae/config"
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"gorm.io/gorm"
+)
+
+// -------------------- Passkeys (WebAuthn) --------------------
+
+// Chaque cérémonie se fait en deux appels JSON : .../begin renvoie les
+// options à passer à navigator.credentials.create() ou .get(), .../finish
+// reçoit la réponse de l'authentificateur. Le défi est gardé en base entre
+// les deux (voir db.PasskeyChallenge).
+
+// NewWebAuthn configure go-webauthn : sans réglage, le site est l'hôte de
+// GTM_BASE_URL et la seule origine acceptée, celle de cette URL.
+func NewWebAuthn(cfg config.Config) (*webauthn.WebAuthn, error) {
+	base, err := url.Parse(cfg.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	rpID := cfg.WebAuthnRPID
+	if rpID == "" {
+		rpID = base.Hostname()
+	}
+	origins := cfg.WebAuthnOrigins
+	if len(origins) == 0 {
+		origins = []string{base.Scheme + "://" + base.Host}
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: "Go Ticket Manager",
+		RPOrigins:     origins,
+	})
+}
+
+func getWebAuthn(c *gin.Context) *webauthn.WebAuthn {
+	v, _ := c.Get("webauthn")
+	w, _ := v.(*webauthn.WebAuthn)
+	return w
+}
+
+// passkeyCookie porte le jeton du défi de la cérémonie en cours.
+const passkeyCookie = "passkey_challenge"
+
+func passkeyError(c *gin.Context, status int, msg string, err error) {
+	body := gin.H{"error": msg}
+	if err != nil {
+		body["details"] = err.Error()
+	}
+	c.AbortWithStatusJSON(status, body)
+}
+
+// beginPasskey garde le défi de la cérémonie et renvoie ses options.
+func beginPasskey(c *gin.Context, database *gorm.DB, userID uint, kind string, options any, session *webauthn.SessionData, err error) {
+	if err != nil {
+		passkeyError(c, http.StatusInternalServerError, "cannot start ceremony", err)
+		return
+	}
+	plain, err := db.SavePasskeyChallenge(database, userID, kind, session)
+	if err != nil {
+		passkeyError(c, http.StatusInternalServerError, "cannot start ceremony", err)
+		return
+	}
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(passkeyCookie, plain, 300, "/", "", c.Request.TLS != nil, true)
+	c.JSON(http.StatusOK, options)
+}
+
+// takePasskey consomme le défi de la cérémonie ; il doit avoir été émis pour
+// userID (0 pour une connexion sans nom d'utilisateur).
+func takePasskey(c *gin.Context, database *gorm.DB, userID uint, kind string) (webauthn.SessionData, bool) {
+	plain, _ := c.Cookie(passkeyCookie)
+	c.SetCookie(passkeyCookie, "", -1, "/", "", c.Request.TLS != nil, true)
+	owner, session, err := db.TakePasskeyChallenge(database, plain, kind)
+	if err != nil || owner != userID {
+		passkeyError(c, http.StatusBadRequest, "ceremony expired or unknown", nil)
+		return session, false
+	}
+	return session, true
+}
+
+// POST /login/passkey/begin : connexion sans mot de passe ; le navigateur
+// propose les passkeys enregistrées pour ce site.
+func PasskeyLoginBegin(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	options, session, err := getWebAuthn(c).BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	beginPasskey(c, database, 0, db.PasskeyLogin, options, session, err)
+}
+
+// POST /login/passkey/finish : une passkey vérifiée par l'authentificateur
+// (code, empreinte) vaut mot de passe et second facteur.
+func PasskeyLoginFinish(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	session, ok := takePasskey(c, database, 0, db.PasskeyLogin)
+	if !ok {
+		return
+	}
+	found, cred, err := getWebAuthn(c).FinishPasskeyLogin(func(_, handle []byte) (webauthn.User, error) {
+		return db.PasskeyUserByHandle(database, handle)
+	}, session, c.Request)
+	if err != nil {
+		passkeyError(c, http.StatusUnauthorized, "passkey rejected", err)
+		return
+	}
+	user := found.(db.PasskeyUser).User
+	if err := db.UsePasskey(database, user.ID, cred); err != nil {
+		passkeyError(c, http.StatusUnauthorized, "passkey rejected", err)
+		return
+	}
+	db.ResetLoginFailures(database, &user)
+	if err := StartSession(c, database, user, ""); err != nil {
+		passkeyError(c, http.StatusInternalServerError, "cannot open session", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"redirect": "/home"})
+}
+
+// pendingPasskeyLogin est pendingLogin pour les appels JSON de la seconde
+// étape.
+func pendingPasskeyLogin(c *gin.Context, database *gorm.DB) (db.UserSession, db.PasskeyUser, bool) {
+	s, user, ok := LookupSession(c, database)
+	if !ok || s.Stage != db.SessionSecondFactor {
+		passkeyError(c, http.StatusUnauthorized, "no pending login", nil)
+		return s, db.PasskeyUser{}, false
+	}
+	if lockedOut(database, s, user) {
+		setSessionCookie(c, "", -1)
+		passkeyError(c, http.StatusTooManyRequests, "account locked", nil)
+		return s, db.PasskeyUser{}, false
+	}
+	pu, err := db.LoadPasskeyUser(database, user)
+	if err != nil || len(pu.Credentials) == 0 {
+		passkeyError(c, http.StatusBadRequest, "no passkey registered", err)
+		return s, pu, false
+	}
+	return s, pu, true
+}
+
+// POST /login/2fa/passkey/begin : passkey en seconde étape, après le mot de passe.
+func PasskeySecondFactorBegin(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	_, pu, ok := pendingPasskeyLogin(c, database)
+	if !ok {
+		return
+	}
+	options, session, err := getWebAuthn(c).BeginLogin(pu)
+	beginPasskey(c, database, pu.ID, db.PasskeySecondFactor, options, session, err)
+}
+
+// POST /login/2fa/passkey/finish : comme un code faux, un échec compte dans
+// les essais de la session en attente et dans ceux du compte.
+func PasskeySecondFactorFinish(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	s, pu, ok := pendingPasskeyLogin(c, database)
+	if !ok {
+		return
+	}
+	session, ok := takePasskey(c, database, pu.ID, db.PasskeySecondFactor)
+	if !ok {
+		return
+	}
+	cred, err := getWebAuthn(c).FinishLogin(pu, session, c.Request)
+	if err == nil {
+		err = db.UsePasskey(database, pu.ID, cred)
+	}
+	if err != nil {
+		if !failSecondFactor(database, &s, &pu.User) {
+			setSessionCookie(c, "", -1)
+		}
+		passkeyError(c, http.StatusUnauthorized, "passkey rejected", err)
+		return
+	}
+
+	database.Delete(&s)
+	db.ResetLoginFailures(database, &pu.User)
+	if err := StartSession(c, database, pu.User, ""); err != nil {
+		passkeyError(c, http.StatusInternalServerError, "cannot open session", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"redirect": "/home"})
+}
+
+// POST /profile/passkeys/begin : enregistrement d'une passkey. Elle doit être
+// découvrable (resident key) pour servir à la connexion sans nom d'utilisateur.
+func PasskeyRegisterBegin(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+	pu, err := db.LoadPasskeyUser(database, user)
+	if err != nil {
+		passkeyError(c, http.StatusInternalServerError, "cannot load passkeys", err)
+		return
+	}
+	options, session, err := getWebAuthn(c).BeginRegistration(pu,
+		webauthn.WithExclusions(webauthn.Credentials(pu.Credentials).CredentialDescriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	beginPasskey(c, database, user.ID, db.PasskeyRegister, options, session, err)
+}
+
+// POST /profile/passkeys/finish?name= : enregistre la passkey créée.
+func PasskeyRegisterFinish(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+	session, ok := takePasskey(c, database, user.ID, db.PasskeyRegister)
+	if !ok {
+		return
+	}
+	pu, err := db.LoadPasskeyUser(database, user)
+	if err != nil {
+		passkeyError(c, http.StatusInternalServerError, "cannot load passkeys", err)
+		return
+	}
+	cred, err := getWebAuthn(c).FinishRegistration(pu, session, c.Request)
+	if err != nil {
+		passkeyError(c, http.StatusBadRequest, "registration rejected", err)
+		return
+	}
+	if _, err := db.AddPasskey(database, user, c.Query("name"), cred); err != nil {
+		passkeyError(c, http.StatusBadRequest, "cannot save passkey", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"redirect": "/profile#passkeys"})
+}
+
+// POST /profile/passkeys/:id/delete : la dernière passkey ne se supprime pas
+// si le rôle impose un second facteur et que le TOTP n'est pas actif.
+func ProfileDeletePasskey(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+
+	id, _ := strconv.Atoi(c.Param("id"))
+	keys, _ := db.UserPasskeys(database, user.ID)
+	if len(keys) == 1 && keys[0].ID == uint(id) && !user.TOTPEnabled && db.TOTPRequired(database, user) {
+		renderProfile(c, database, user, http.StatusBadRequest, gin.H{"error": db.ErrTOTPRequired.Error()})
+		return
+	}
+	db.DeletePasskey(database, user.ID, uint(id))
+	c.Redirect(http.StatusFound, "/profile#passkeys")
+}
@@ -0,0 +1,367 @@
+package handle
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"sae/config"
+	"sae/db"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const testOrigin = "https://tickets.example.com"
+
+// authenticator est un authentificateur logiciel : une clé ECDSA P-256 et son
+// compteur de signatures, de quoi jouer les cérémonies sans navigateur.
+type authenticator struct {
+	key     *ecdsa.PrivateKey
+	id      []byte
+	handle  []byte // user handle reçu à l'enregistrement
+	counter uint32
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &authenticator{key: key, id: id}
+}
+
+var b64 = base64.RawURLEncoding
+
+// Drapeaux des données d'authentification : présence (UP), vérification de
+// l'utilisateur (UV), données de la clé jointes (AT).
+const (
+	flagUP = 0x01
+	flagUV = 0x04
+	flagAT = 0x40
+)
+
+func (a *authenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte("tickets.example.com"))
+	out := append(rpIDHash[:], flags)
+	out = binary.BigEndian.AppendUint32(out, a.counter)
+	return append(out, attested...)
+}
+
+func clientData(t *testing.T, kind string, challenge protocol.URLEncodedBase64) []byte {
+	t.Helper()
+	data, err := json.Marshal(protocol.CollectedClientData{
+		Type:      protocol.CeremonyType(kind),
+		Challenge: b64.EncodeToString(challenge),
+		Origin:    testOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// create répond aux options de navigator.credentials.create() (attestation
+// "none").
+func (a *authenticator) create(t *testing.T, options []byte) []byte {
+	t.Helper()
+	var cc protocol.CredentialCreation
+	if err := json.Unmarshal(options, &cc); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := cc.Response.User.ID.(string)
+	handle, err := b64.DecodeString(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.handle = handle
+
+	pub := a.key.PublicKey
+	var coseKey []byte
+	coseKey, err = cbor.Marshal(map[int]any{1: 2, 3: -7, -1: 1, -2: pub.X.FillBytes(make([]byte, 32)), -3: pub.Y.FillBytes(make([]byte, 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.id)))
+	attested = append(append(attested, a.id...), coseKey...)
+	object, err := cbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(flagUP|flagUV|flagAT, attested),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return credentialJSON(t, a.id, map[string]string{
+		"clientDataJSON":    b64.EncodeToString(clientData(t, "webauthn.create", cc.Response.Challenge)),
+		"attestationObject": b64.EncodeToString(object),
+	})
+}
+
+// get répond aux options de navigator.credentials.get(), signé avec le
+// compteur courant.
+func (a *authenticator) get(t *testing.T, options []byte) []byte {
+	t.Helper()
+	var ca protocol.CredentialAssertion
+	if err := json.Unmarshal(options, &ca); err != nil {
+		t.Fatal(err)
+	}
+	authData := a.authData(flagUP|flagUV, nil)
+	client := clientData(t, "webauthn.get", ca.Response.Challenge)
+	hash := sha256.Sum256(client)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), hash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return credentialJSON(t, a.id, map[string]string{
+		"clientDataJSON":    b64.EncodeToString(client),
+		"authenticatorData": b64.EncodeToString(authData),
+		"signature":         b64.EncodeToString(sig),
+		"userHandle":        b64.EncodeToString(a.handle),
+	})
+}
+
+func credentialJSON(t *testing.T, id []byte, response map[string]string) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]any{
+		"id":       b64.EncodeToString(id),
+		"rawId":    b64.EncodeToString(id),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// client rejoue les requêtes d'un navigateur : il garde les cookies posés.
+type client struct {
+	router  *gin.Engine
+	cookies map[string]string
+}
+
+func (cl *client) post(t *testing.T, path string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range cl.cookies {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	rec := httptest.NewRecorder()
+	cl.router.ServeHTTP(rec, req)
+	for _, ck := range rec.Result().Cookies() {
+		if ck.MaxAge < 0 {
+			delete(cl.cookies, ck.Name)
+		} else {
+			cl.cookies[ck.Name] = ck.Value
+		}
+	}
+	return rec
+}
+
+// ceremony joue begin puis finish, answer fabriquant la réponse de
+// l'authentificateur aux options reçues.
+func (cl *client) ceremony(t *testing.T, prefix string, answer func(*testing.T, []byte) []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := cl.post(t, prefix+"/begin", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s/begin : %d %s", prefix, rec.Code, rec.Body)
+	}
+	return cl.post(t, prefix+"/finish", answer(t, rec.Body.Bytes()))
+}
+
+func setupPasskeys(t *testing.T) (*gorm.DB, *client, db.User) {
+	t.Helper()
+	database, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.AutoMigrate(&db.User{}, &db.Role{}, &db.RolePermission{}, &db.UserSession{}, &db.Passkey{}, &db.PasskeyChallenge{}, &db.RecoveryCode{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := db.User{Username: "alice", Role: db.RoleClient}
+	if err := database.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWebAuthn(config.Config{BaseURL: testOrigin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("db", database)
+		c.Set("webauthn", w)
+	})
+	// /profile suppose une session ouverte : celle d'alice.
+	profile := r.Group("/profile", func(c *gin.Context) { c.Set("user", user.Username) })
+	profile.POST("/passkeys/begin", PasskeyRegisterBegin)
+	profile.POST("/passkeys/finish", PasskeyRegisterFinish)
+	r.POST("/login/passkey/begin", PasskeyLoginBegin)
+	r.POST("/login/passkey/finish", PasskeyLoginFinish)
+	r.POST("/login/2fa/passkey/begin", PasskeySecondFactorBegin)
+	r.POST("/login/2fa/passkey/finish", PasskeySecondFactorFinish)
+	return database, &client{router: r, cookies: map[string]string{}}, user
+}
+
+func register(t *testing.T, cl *client, a *authenticator) {
+	t.Helper()
+	if rec := cl.ceremony(t, "/profile/passkeys", a.create); rec.Code != http.StatusOK {
+		t.Fatalf("enregistrement refusé : %d %s", rec.Code, rec.Body)
+	}
+}
+
+// openSessions renvoie les sessions complètes (hors seconde étape) de l'utilisateur.
+func openSessions(t *testing.T, database *gorm.DB, userID uint) int64 {
+	t.Helper()
+	var n int64
+	if err := database.Model(&db.UserSession{}).Where("user_id = ? AND stage = ''", userID).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPasskeyRegisterThenLogin(t *testing.T) {
+	database, cl, user := setupPasskeys(t)
+	a := newAuthenticator(t)
+	register(t, cl, a)
+
+	keys, err := db.UserPasskeys(database, user.ID)
+	if err != nil || len(keys) != 1 || !bytes.Equal(keys[0].CredentialID, a.id) {
+		t.Fatalf("passkeys enregistrées : %+v, %v", keys, err)
+	}
+
+	a.counter++
+	var finish []byte
+	rec := cl.ceremony(t, "/login/passkey", func(t *testing.T, options []byte) []byte {
+		finish = a.get(t, options)
+		return finish
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("connexion refusée : %d %s", rec.Code, rec.Body)
+	}
+	if cl.cookies[SessionCookie] == "" || openSessions(t, database, user.ID) != 1 {
+		t.Fatal("connexion sans session ouverte")
+	}
+
+	// Un défi ne sert qu'une fois : rejouer la réponse est refusé.
+	if rec := cl.post(t, "/login/passkey/finish", finish); rec.Code != http.StatusBadRequest {
+		t.Fatalf("réponse rejouée : %d, attendu 400", rec.Code)
+	}
+}
+
+func TestPasskeySecondFactor(t *testing.T) {
+	database, cl, user := setupPasskeys(t)
+	a := newAuthenticator(t)
+	register(t, cl, a)
+
+	// Des échecs antérieurs : la connexion réussie les efface.
+	database.Model(&user).UpdateColumn("failed_logins", 3)
+
+	// Mot de passe vérifié : la session attend la seconde étape.
+	plain, pending, err := db.CreateSession(database, user, db.SessionSecondFactor, "", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl.cookies[SessionCookie] = plain
+
+	a.counter++
+	if rec := cl.ceremony(t, "/login/2fa/passkey", a.get); rec.Code != http.StatusOK {
+		t.Fatalf("seconde étape refusée : %d %s", rec.Code, rec.Body)
+	}
+	if err := database.First(&db.UserSession{}, pending.ID).Error; err == nil {
+		t.Error("session en attente toujours ouverte")
+	}
+	if cl.cookies[SessionCookie] == plain || openSessions(t, database, user.ID) != 1 {
+		t.Fatal("seconde étape sans session complète")
+	}
+	database.First(&user, user.ID)
+	if user.FailedLogins != 0 {
+		t.Fatalf("%d échecs après la connexion, attendu 0", user.FailedLogins)
+	}
+}
+
+// Connaître le mot de passe ne donne pas d'essais illimités sur le second
+// facteur : les échecs verrouillent le compte comme des mots de passe faux.
+func TestPasskeySecondFactorLockout(t *testing.T) {
+	database, cl, user := setupPasskeys(t)
+	register(t, cl, newAuthenticator(t))
+	intruder := newAuthenticator(t)
+
+	plain, _, err := db.CreateSession(database, user, db.SessionSecondFactor, "", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl.cookies[SessionCookie] = plain
+	for i := 0; i < 5; i++ {
+		if rec := cl.ceremony(t, "/login/2fa/passkey", intruder.get); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("essai %d : %d, attendu 401", i+1, rec.Code)
+		}
+	}
+	database.First(&user, user.ID)
+	if user.FailedLogins != 5 || !db.LoginLocked(user, time.Now()) {
+		t.Fatalf("%d échecs, verrouillé jusqu'à %v : compte non verrouillé", user.FailedLogins, user.LockedUntil)
+	}
+
+	// Une autre session en attente, ouverte avant le verrouillage, est fermée.
+	plain, pending, err := db.CreateSession(database, user, db.SessionSecondFactor, "", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl.cookies[SessionCookie] = plain
+	if rec := cl.post(t, "/login/2fa/passkey/begin", nil); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("compte verrouillé : %d, attendu 429", rec.Code)
+	}
+	if err := database.First(&db.UserSession{}, pending.ID).Error; err == nil {
+		t.Error("session en attente toujours ouverte")
+	}
+}
+
+func TestPasskeyCounterRollback(t *testing.T) {
+	database, cl, user := setupPasskeys(t)
+	a := newAuthenticator(t)
+	a.counter = 10
+	register(t, cl, a)
+
+	a.counter = 11
+	if rec := cl.ceremony(t, "/login/passkey", a.get); rec.Code != http.StatusOK {
+		t.Fatalf("connexion refusée : %d %s", rec.Code, rec.Body)
+	}
+
+	// Une copie de la clé, restée à un compteur plus ancien.
+	a.counter = 5
+	if rec := cl.ceremony(t, "/login/passkey", a.get); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("compteur en recul : %d, attendu 401", rec.Code)
+	}
+	if n := openSessions(t, database, user.ID); n != 1 {
+		t.Fatalf("%d sessions ouvertes, attendu 1", n)
+	}
+	pu, err := db.LoadPasskeyUser(database, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pu.Credentials[0].Authenticator.SignCount; got != 11 {
+		t.Fatalf("compteur enregistré %d, attendu 11", got)
+	}
+}
@@ -0,0 +1,128 @@
+package handle
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// -------------------- Profil --------------------
+
+func loadCurrentUser(c *gin.Context, database *gorm.DB) (db.User, bool) {
+	var user db.User
+	if err := database.Where("username = ?", currentUser(c)).First(&user).Error; err != nil {
+		c.String(http.StatusInternalServerError, "Utilisateur introuvable")
+		return user, false
+	}
+	return user, true
+}
+
+func renderProfile(c *gin.Context, database *gorm.DB, user db.User, status int, extra gin.H) {
+	var tokens []db.APIToken
+	database.Where("user_id = ?", user.ID).Order("created_at desc").Find(&tokens)
+	sessions, _ := db.UserSessions(database, user.ID)
+	passkeys, _ := db.UserPasskeys(database, user.ID)
+
+	data := gin.H{
+		"user":           user,
+		"tokens":         tokens,
+		"scopes":         db.Scopes,
+		"isAgent":        db.IsAgent(database, user),
+		"sessions":       sessions,
+		"currentSession": currentSessionID(c),
+		"totpRequired":   db.TOTPRequired(database, user),
+		"recoveryLeft":   db.RecoveryCodesLeft(database, user.ID),
+		"passkeys":       passkeys,
+	}
+	if user.TOTPSecret != "" && !user.TOTPEnabled {
+		data["totpSetup"], _ = totpSetup(user)
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+	c.HTML(status, "profile.html", data)
+}
+
+func ProfilePage(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+	renderProfile(c, database, user, http.StatusOK, nil)
+}
+
+// POST /profile/email : adresse utilisée pour les notifications (vide pour
+// ne plus en recevoir).
+func ProfileUpdateEmail(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+
+	email, err := db.NormalizeEmail(c.PostForm("email"))
+	if err != nil {
+		renderProfile(c, database, user, http.StatusBadRequest, gin.H{"error": "Adresse e-mail invalide"})
+		return
+	}
+	if err := db.SetUserEmail(database, &user, email); errors.Is(err, db.ErrEmailTaken) {
+		renderProfile(c, database, user, http.StatusConflict, gin.H{"error": "Adresse e-mail déjà utilisée par un autre compte"})
+		return
+	} else if err != nil {
+		renderProfile(c, database, user, http.StatusInternalServerError, gin.H{"error": "Erreur serveur"})
+		return
+	}
+	c.Redirect(http.StatusFound, "/profile")
+}
+
+// Le jeton en clair est affiché une seule fois, directement dans la réponse.
+func ProfileCreateToken(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+
+	name := c.PostForm("name")
+	if name == "" {
+		renderProfile(c, database, user, http.StatusBadRequest, gin.H{"error": "Le nom du jeton est obligatoire"})
+		return
+	}
+
+	plain, _, err := db.CreateAPIToken(database, user, name, c.PostFormArray("scopes"))
+	if err != nil {
+		renderProfile(c, database, user, http.StatusBadRequest, gin.H{"error": "Impossible de créer le jeton : " + err.Error()})
+		return
+	}
+	renderProfile(c, database, user, http.StatusOK, gin.H{"newToken": plain})
+}
+
+func ProfileRevokeToken(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+
+	id, _ := strconv.Atoi(c.Param("id"))
+	database.Where("user_id = ?", user.ID).Delete(&db.APIToken{}, id)
+	c.Redirect(http.StatusFound, "/profile")
+}
@@ -0,0 +1,157 @@
+package handle
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// -------------------- Administration des files --------------------
+
+// POST /admin/queues : name et description ; les membres se choisissent
+// ensuite dans le formulaire de modification.
+func AdminCreateQueue(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	if _, err := db.CreateQueue(database, c.PostForm("name"), c.PostForm("description")); err != nil {
+		if errors.Is(err, db.ErrInvalidQueue) {
+			c.String(http.StatusBadRequest, err.Error())
+		} else {
+			c.String(http.StatusBadRequest, "File invalide (nom déjà utilisé ?)")
+		}
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin#queues")
+}
+
+// POST /admin/queues/:id/edit : name, description et members (identifiants
+// des Supervisor/Admin cochés, qui remplacent les membres actuels).
+func AdminUpdateQueue(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	var queue db.Queue
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := database.First(&queue, id).Error; err != nil {
+		c.String(http.StatusNotFound, "File introuvable")
+		return
+	}
+
+	var members []uint
+	for _, raw := range c.PostFormArray("members") {
+		v, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Membre invalide")
+			return
+		}
+		members = append(members, uint(v))
+	}
+
+	err := database.Transaction(func(tx *gorm.DB) error {
+		if err := db.UpdateQueue(tx, &queue, c.PostForm("name"), c.PostForm("description")); err != nil {
+			return err
+		}
+		return db.SetQueueMembers(tx, &queue, members)
+	})
+	switch {
+	case err == nil:
+	case errors.Is(err, db.ErrInvalidQueue), errors.Is(err, db.ErrInvalidMember):
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	default:
+		c.String(http.StatusBadRequest, "File invalide (nom déjà utilisé ?)")
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin#queues")
+}
+
+// POST /admin/queues/:id/delete : les tickets de la file deviennent non classés.
+func AdminDeleteQueue(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := db.DeleteQueue(database, uint(id), currentUser(c)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.String(http.StatusNotFound, "File introuvable")
+		} else {
+			c.String(http.StatusInternalServerError, "Échec suppression")
+		}
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin#queues")
+}
+
+// -------------------- Classement des tickets --------------------
+
+// FormQueue lit la file choisie dans un formulaire (champ "queue_id", vide
+// pour un ticket non classé).
+func FormQueue(c *gin.Context) (*db.Queue, error) {
+	raw := c.PostForm("queue_id")
+	if raw == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return nil, db.ErrUnknownQueue
+	}
+	return db.FindQueue(getDB(c), uint(id))
+}
+
+// sameQueue compare deux classements (nil : non classé).
+func sameQueue(a, b *uint) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+// POST /admin/ticket/queue/:id : déplace le ticket dans une autre file.
+func AdminMoveTicket(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	id, _ := strconv.Atoi(c.Param("id"))
+	var ticket db.Ticket
+	if err := database.First(&ticket, id).Error; err != nil || !canSeeTicket(c, ticket) {
+		c.String(http.StatusNotFound, "Ticket introuvable")
+		return
+	}
+
+	queue, err := FormQueue(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, "File inconnue")
+		return
+	}
+	var queueID uint
+	var target *uint
+	if queue != nil {
+		queueID, target = queue.ID, &queue.ID
+	}
+	// La file d'arrivée peut exiger des champs que le ticket n'a pas.
+	if !sameQueue(target, ticket.QueueID) {
+		if err := db.CheckRequiredFields(database, ticket.ID, target, nil); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, db.ErrInvalidFieldValue) {
+				status = http.StatusBadRequest
+			}
+			c.String(status, fieldErrorMessage(err))
+			return
+		}
+	}
+	err = db.SaveTicket(database, &ticket, func(tx *gorm.DB) error {
+		return db.MoveTicket(tx, &ticket, queueID, currentUser(c))
+	})
+	if !TicketSaved(c, err) {
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/admin")
+}
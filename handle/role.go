@@ -0,0 +1,102 @@
+package handle
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// -------------------- Administration des rôles --------------------
+
+func roleAdminError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, db.ErrInvalidRole), errors.Is(err, db.ErrRoleInUse), errors.Is(err, db.ErrBuiltinRole):
+		c.String(http.StatusBadRequest, err.Error())
+	case errors.Is(err, db.ErrGrantDenied):
+		c.String(http.StatusForbidden, err.Error())
+	case errors.Is(err, db.ErrUnknownRole):
+		c.String(http.StatusNotFound, "Rôle introuvable")
+	default:
+		c.String(http.StatusBadRequest, "Rôle invalide (nom déjà utilisé ?)")
+	}
+}
+
+// POST /admin/roles : name, description, permissions (cases cochées) et
+// require_totp.
+func AdminCreateRole(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	if err := db.CheckGrant(permissions(c), db.PermissionSet{}, c.PostFormArray("permissions")); err != nil {
+		roleAdminError(c, err)
+		return
+	}
+	if _, err := db.CreateRole(database, c.PostForm("name"), c.PostForm("description"), c.PostFormArray("permissions"), c.PostForm("require_totp") != ""); err != nil {
+		roleAdminError(c, err)
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin#roles")
+}
+
+// POST /admin/roles/:id/edit : description, permissions et require_totp ; le
+// nom ne change pas, et Admin garde toutes les permissions. Imposer la double
+// authentification à son propre rôle demande de l'avoir activée soi-même,
+// sans quoi l'admin perdrait sa session à la requête suivante.
+func AdminUpdateRole(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	var role db.Role
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := database.First(&role, id).Error; err != nil {
+		c.String(http.StatusNotFound, "Rôle introuvable")
+		return
+	}
+	// On n'accorde pas une permission qu'on n'a pas soi-même.
+	current, err := db.RolePermissions(database, role.Name)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Erreur serveur")
+		return
+	}
+	if err := db.CheckGrant(permissions(c), current, c.PostFormArray("permissions")); err != nil {
+		roleAdminError(c, err)
+		return
+	}
+	requireTOTP := c.PostForm("require_totp") != ""
+	if requireTOTP && !role.RequireTOTP && role.Name == currentRole(c) {
+		me, ok := loadCurrentUser(c, database)
+		if !ok {
+			return
+		}
+		// Un TOTP actif ou une passkey : ce que la connexion exige ensuite.
+		if !db.HasSecondFactor(database, me) {
+			c.String(http.StatusBadRequest, "Activez d'abord un second facteur sur votre compte, TOTP ou passkey (/profile)")
+			return
+		}
+	}
+	if err := db.UpdateRole(database, &role, c.PostForm("description"), c.PostFormArray("permissions"), requireTOTP); err != nil {
+		roleAdminError(c, err)
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin#roles")
+}
+
+// POST /admin/roles/:id/delete : seulement un rôle personnalisé sans utilisateur.
+func AdminDeleteRole(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := db.DeleteRole(database, uint(id)); err != nil {
+		roleAdminError(c, err)
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin#roles")
+}
@@ -0,0 +1,88 @@
+package handle
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// -------------------- Recherche --------------------
+
+// searchQuery prépare la recherche avec la visibilité de l'appelant : un
+// client ne cherche que dans ses tickets, sans les notes internes ; un agent
+// membre de files, dans ces files (voir scopeToQueues).
+func searchQuery(c *gin.Context, text string, limit int) db.SearchQuery {
+	q := db.SearchQuery{Text: text, Limit: limit, WithInternal: can(c, db.PermTicketInternal)}
+	if !can(c, db.PermTicketReadAny) {
+		q.User = currentUser(c)
+	}
+	var f db.TicketFilter
+	scopeToQueues(c, getDB(c), &f, currentUser(c))
+	q.MemberOf, q.Me = f.MemberOf, currentUser(c)
+	return q
+}
+
+// GET /search?q=
+func SearchPage(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	text := strings.TrimSpace(c.Query("q"))
+	hits, err := db.SearchTickets(database, searchQuery(c, text, 50))
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "search.html", gin.H{
+			"q":     text,
+			"error": "La recherche a échoué",
+		})
+		return
+	}
+	c.HTML(http.StatusOK, "search.html", gin.H{
+		"q":       text,
+		"hits":    hits,
+		"isStaff": can(c, db.PermTicketReadAny),
+	})
+}
+
+type SearchResult struct {
+	Ticket TicketResponse `json:"ticket"`
+	// Snippet est échappé pour HTML, les termes trouvés entre <mark> et </mark>.
+	Snippet   string  `json:"snippet"`
+	CommentID *uint   `json:"comment_id,omitempty"`
+	Rank      float64 `json:"rank"`
+}
+
+// GET /api/v1/search?q=&limit= : mêmes résultats que /search, du plus
+// pertinent au moins pertinent (limit : 50 par défaut, 100 au plus).
+func APISearch(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	text := strings.TrimSpace(c.Query("q"))
+	if text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.Query("limit"))
+
+	hits, err := db.SearchTickets(database, searchQuery(c, text, limit))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "search failed", "details": err.Error()})
+		return
+	}
+	out := make([]SearchResult, 0, len(hits))
+	for _, h := range hits {
+		out = append(out, SearchResult{
+			Ticket:    newTicketResponse(h.Ticket),
+			Snippet:   string(h.SnippetHTML()),
+			CommentID: h.CommentID,
+			Rank:      h.Rank,
+		})
+	}
+	c.JSON(http.StatusOK, out)
+}
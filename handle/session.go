@@ -0,0 +1,141 @@
+package handle
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// -------------------- Sessions --------------------
+
+// SessionCookie porte le jeton de la session navigateur (voir db.UserSession).
+const SessionCookie = "session"
+
+func setSessionCookie(c *gin.Context, value string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(SessionCookie, value, maxAge, "/", "", c.Request.TLS != nil, true)
+}
+
+// pendingLoginTTL est la durée laissée pour la seconde étape de la connexion.
+const pendingLoginTTL = 5 * time.Minute
+
+func sessionTTL(c *gin.Context) time.Duration {
+	if ttl := getConfig(c).SessionTTL; ttl > 0 {
+		return ttl
+	}
+	return 7 * 24 * time.Hour
+}
+
+// StartSession ouvre une session pour user et pose le cookie. Avec stage non
+// vide, la session attend la seconde étape de la connexion (/login/2fa).
+func StartSession(c *gin.Context, database *gorm.DB, user db.User, stage string) error {
+	ttl := sessionTTL(c)
+	if stage != "" {
+		ttl = pendingLoginTTL
+	}
+	plain, _, err := db.CreateSession(database, user, stage, c.Request.UserAgent(), c.ClientIP(), ttl)
+	if err != nil {
+		return err
+	}
+	setSessionCookie(c, plain, int(ttl.Seconds()))
+	return nil
+}
+
+// LookupSession retrouve la session du cookie et son utilisateur. L'activité
+// prolonge la session, et le cookie avec elle : il n'expire qu'après
+// GTM_SESSION_TTL d'inactivité.
+func LookupSession(c *gin.Context, database *gorm.DB) (db.UserSession, db.User, bool) {
+	plain, err := c.Cookie(SessionCookie)
+	if err != nil || plain == "" {
+		return db.UserSession{}, db.User{}, false
+	}
+	s, user, err := db.LookupSession(database, plain)
+	if err != nil {
+		return s, user, false
+	}
+	if ttl := sessionTTL(c); db.TouchSession(database, &s, ttl) {
+		setSessionCookie(c, plain, int(ttl.Seconds()))
+	}
+	return s, user, true
+}
+
+// EndSession ferme la session du cookie et l'efface.
+func EndSession(c *gin.Context, database *gorm.DB) {
+	if plain, err := c.Cookie(SessionCookie); err == nil && plain != "" {
+		db.EndSession(database, plain)
+	}
+	setSessionCookie(c, "", -1)
+}
+
+// currentSessionID renvoie la session de la requête, 0 pour un jeton d'API.
+func currentSessionID(c *gin.Context) uint {
+	v, _ := c.Get("session")
+	s, _ := v.(db.UserSession)
+	return s.ID
+}
+
+// POST /profile/sessions/:id/revoke : déconnecte un de ses appareils.
+func ProfileRevokeSession(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+
+	id, _ := strconv.Atoi(c.Param("id"))
+	db.RevokeSession(database, user.ID, uint(id))
+	if uint(id) == currentSessionID(c) {
+		setSessionCookie(c, "", -1)
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	c.Redirect(http.StatusFound, "/profile#sessions")
+}
+
+// POST /profile/sessions/revoke : déconnecte tous ses appareils sauf celui-ci.
+func ProfileRevokeOtherSessions(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+
+	db.RevokeUserSessions(database, user.ID, currentSessionID(c))
+	c.Redirect(http.StatusFound, "/profile#sessions")
+}
+
+// POST /admin/user/logout/:id : ferme toutes les sessions d'un utilisateur.
+// Ses jetons d'API restent valables.
+func AdminRevokeUserSessions(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	var user db.User
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := database.First(&user, id).Error; err != nil {
+		c.String(http.StatusNotFound, "Utilisateur introuvable")
+		return
+	}
+	// Comme pour la modification : pas d'action sur un compte plus privilégié.
+	if !db.CanAssignRole(database, currentRole(c), user.Role) {
+		c.String(http.StatusForbidden, "Ce rôle a des permissions que vous n'avez pas")
+		return
+	}
+	if _, err := db.RevokeUserSessions(database, user.ID, 0); err != nil {
+		c.String(http.StatusInternalServerError, "Impossible de fermer les sessions")
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin")
+}
@@ -0,0 +1,144 @@
+package handle
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// -------------------- Administration des SLA --------------------
+
+// errInvalidDelay signale un délai qui n'est pas un nombre de minutes.
+var errInvalidDelay = errors.New("délai invalide")
+
+// POST /admin/sla : par priorité, response_<priorité> et
+// resolution_<priorité> en minutes, et calendar_<priorité> (vide : temps
+// d'horloge).
+func AdminUpdateSLA(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+
+	// Toutes les priorités ou aucune : une valeur invalide ne laisse pas les
+	// précédentes modifiées.
+	var failed string
+	err := database.Transaction(func(tx *gorm.DB) error {
+		for _, p := range db.Priorities {
+			failed = p
+			response, err := strconv.Atoi(c.PostForm("response_" + p))
+			if err != nil {
+				return errInvalidDelay
+			}
+			resolution, err := strconv.Atoi(c.PostForm("resolution_" + p))
+			if err != nil {
+				return errInvalidDelay
+			}
+			if err := db.UpdateSLAPolicy(tx, getCalendars(c), p, response, resolution, c.PostForm("calendar_"+p)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errInvalidDelay) {
+		c.String(http.StatusBadRequest, "Délais invalides pour la priorité "+failed)
+		return
+	}
+	if err != nil {
+		c.String(http.StatusBadRequest, "Délais invalides pour la priorité "+failed+" : "+err.Error())
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin")
+}
+
+// -------------------- Statistiques SLA --------------------
+
+type SLAPriorityStats struct {
+	Priority           string `json:"priority"`
+	Tickets            int64  `json:"tickets"`
+	Open               int64  `json:"open"`
+	ResponseBreached   int64  `json:"response_breached"`
+	ResolutionBreached int64  `json:"resolution_breached"`
+	OpenBreached       int64  `json:"open_breached"`
+}
+
+type SLAStats struct {
+	TimeBasis
+	ResponseBreached     int64              `json:"response_breached"`
+	ResolutionBreached   int64              `json:"resolution_breached"`
+	OpenBreached         int64              `json:"open_breached"`
+	AvgResponseMinutes   float64            `json:"avg_response_minutes"`
+	AvgResolutionMinutes float64            `json:"avg_resolution_minutes"`
+	ByPriority           []SLAPriorityStats `json:"by_priority"`
+}
+
+// GET /api/stats/sla : nombre de tickets hors délai, au total et par
+// priorité, et délais moyens de première réponse et de résolution
+// (?time=wall|business, ?calendar=). Les tickets sans échéance (créés avant
+// les SLA) sont ignorés.
+func StatsSLA(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	cal, ok := statsCalendar(c)
+	if !ok {
+		return
+	}
+
+	var tickets []db.Ticket
+	if err := database.Where("resolution_due_at IS NOT NULL").Find(&tickets).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed", "details": err.Error()})
+		return
+	}
+
+	byPriority := map[string]*SLAPriorityStats{}
+	out := SLAStats{TimeBasis: timeBasis(cal), ByPriority: []SLAPriorityStats{}}
+	var response, resolution minutesAverage
+	for _, p := range db.Priorities {
+		byPriority[p] = &SLAPriorityStats{Priority: p}
+	}
+
+	now := time.Now()
+	for _, t := range tickets {
+		row, ok := byPriority[t.Priority]
+		if !ok {
+			continue
+		}
+		s := t.SLAAt(now)
+		row.Tickets++
+		if t.FirstResponseAt != nil {
+			response.add(cal.Between(t.CreatedAt, *t.FirstResponseAt))
+		}
+		if s.Closed {
+			resolution.add(cal.Between(t.CreatedAt, t.ClosedAt))
+		}
+		if !s.Closed {
+			row.Open++
+		}
+		if s.ResponseBreached {
+			row.ResponseBreached++
+			out.ResponseBreached++
+		}
+		if s.ResolutionBreached {
+			row.ResolutionBreached++
+			out.ResolutionBreached++
+			if !s.Closed {
+				row.OpenBreached++
+				out.OpenBreached++
+			}
+		}
+	}
+	out.AvgResponseMinutes = response.minutes()
+	out.AvgResolutionMinutes = resolution.minutes()
+	for _, p := range db.Priorities {
+		out.ByPriority = append(out.ByPriority, *byPriority[p])
+	}
+	c.JSON(http.StatusOK, out)
+}
@@ -4,6 +4,7 @@ import (
     "fmt"
     "net/http"
     "strconv"
+    "time"
 
     "github.com/gin-gonic/gin"
     "gorm.io/gorm"
@@ -20,6 +21,10 @@ func getDB(c *gin.Context) *gorm.DB {
     return v.(*gorm.DB)
 }
 
+// closedSince filtre les tickets réellement fermés : un ticket jamais fermé
+// a une date de fermeture zéro, pas NULL (même règle que db.TicketFilter).
+const closedSince = "closed_at > ?"
+
 // -------------------- Page HTML --------------------
 
 func StatsPage(c *gin.Context) {
@@ -31,17 +36,23 @@ func StatsPage(c *gin.Context) {
 // -------------------- Résumé --------------------
 
 type Summary struct {
+    TimeBasis
     TotalTickets         int64   `json:"total_tickets"`
     OpenTickets          int64   `json:"open_tickets"`
     ClosedTickets        int64   `json:"closed_tickets"`
     AvgResolutionMinutes float64 `json:"avg_resolution_minutes"` // attendu par le front
 }
 
+// ?time=business&calendar=<nom> : temps moyen de résolution en heures ouvrées.
 func StatsSummary(c *gin.Context) {
     db := getDB(c)
     if db == nil {
         return
     }
+    cal, ok := statsCalendar(c)
+    if !ok {
+        return
+    }
 
     // Compteurs
     var total, open, closed int64
@@ -59,11 +70,28 @@ func StatsSummary(c *gin.Context) {
     row2 := db.Raw(`
         SELECT IFNULL(AVG( (julianday(closed_at) - julianday(created_at)) * 24.0 * 60.0 ), 0)
         FROM tickets
-        WHERE closed_at IS NOT NULL
-    `).Row()
+        WHERE `+closedSince, time.Time{}).Row()
     _ = row2.Scan(&avgRes)
 
+    // En temps ouvré, le calcul se fait ticket par ticket avec le calendrier
+    if cal != nil {
+        var spans []struct {
+            CreatedAt time.Time
+            ClosedAt  time.Time
+        }
+        if err := db.Raw(`SELECT created_at, closed_at FROM tickets WHERE `+closedSince, time.Time{}).Scan(&spans).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed", "details": err.Error()})
+            return
+        }
+        var avg minutesAverage
+        for _, s := range spans {
+            avg.add(cal.Between(s.CreatedAt, s.ClosedAt))
+        }
+        avgRes = avg.minutes()
+    }
+
     c.JSON(http.StatusOK, Summary{
+        TimeBasis:            timeBasis(cal),
         TotalTickets:         total,
         OpenTickets:          open,
         ClosedTickets:        closed,
@@ -88,9 +116,9 @@ func StatsTimeSeries(c *gin.Context) {
     typ := c.DefaultQuery("type", "created")  // created | closed
     limStr := c.DefaultQuery("limit", "")
 
-    dateCol := "created_at"
+    dateCol, where := "created_at", "created_at > ?"
     if typ == "closed" {
-        dateCol = "closed_at"
+        dateCol, where = "closed_at", closedSince
     }
 
     // Bucket SQLite vers date ISO compatible Chart.js
@@ -122,14 +150,14 @@ func StatsTimeSeries(c *gin.Context) {
     query := fmt.Sprintf(`
         SELECT %s AS x, COUNT(*) AS y
         FROM tickets
-        WHERE %s IS NOT NULL
+        WHERE %s
         GROUP BY x
         ORDER BY x
         LIMIT %d
-    `, bucketExpr, dateCol, limit)
+    `, bucketExpr, where, limit)
 
     var rows []TimePoint
-    if err := db.Raw(query).Scan(&rows).Error; err != nil {
+    if err := db.Raw(query, time.Time{}).Scan(&rows).Error; err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed", "details": err.Error()})
         return
     }
@@ -159,9 +187,9 @@ func StatsByUser(c *gin.Context) {
         lim = 10
     }
 
-    where := "t.created_at IS NOT NULL"
+    where := "t.created_at > ?"
     if typ == "closed" {
-        where = "t.closed_at IS NOT NULL"
+        where = "t."+closedSince
     }
 
     query := fmt.Sprintf(`
@@ -175,7 +203,7 @@ func StatsByUser(c *gin.Context) {
     `, where, lim)
 
     var rows []UserCount
-    if err := db.Raw(query).Scan(&rows).Error; err != nil {
+    if err := db.Raw(query, time.Time{}).Scan(&rows).Error; err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed", "details": err.Error()})
         return
     }
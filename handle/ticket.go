@@ -0,0 +1,311 @@
+package handle
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// -------------------- Création --------------------
+
+func renderTicketForm(c *gin.Context, status int, message string) {
+	data := gin.H{}
+	if database := getDB(c); database != nil {
+		data["labels"], _ = db.Labels(database)
+		data["queues"], _ = db.Queues(database)
+		fields, _ := db.CustomFields(database)
+		data["customFields"] = db.NewFieldViews(fields, nil)
+	}
+	if message != "" {
+		data["error"] = message
+	}
+	c.HTML(status, "form.html", data)
+}
+
+// GET /form
+func TicketForm(c *gin.Context) {
+	renderTicketForm(c, http.StatusOK, "")
+}
+
+// POST /form : le ticket, sa file, ses étiquettes, ses champs personnalisés
+// et ses éventuelles pièces jointes.
+// Les fichiers sont contrôlés avant la création du ticket.
+func TicketCreate(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	cfg := getConfig(c)
+
+	uploads, err := checkUploads(cfg, formFiles(c))
+	if err != nil {
+		renderTicketForm(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	labels, err := formLabels(c, database)
+	if err != nil {
+		renderTicketForm(c, http.StatusBadRequest, "Étiquette inconnue")
+		return
+	}
+
+	queue, err := FormQueue(c)
+	if err != nil {
+		renderTicketForm(c, http.StatusBadRequest, "File inconnue")
+		return
+	}
+
+	ticket := db.Ticket{
+		Title:       c.PostForm("title"),
+		Description: c.PostForm("description"),
+		User:        currentUser(c),
+		State:       getWorkflow(c).Initial,
+		Labels:      labels,
+	}
+	if queue != nil {
+		ticket.QueueID = &queue.ID
+	}
+	_, values, err := formFieldValues(c, database, ticket.QueueID)
+	if err != nil {
+		renderTicketForm(c, http.StatusBadRequest, fieldErrorMessage(err))
+		return
+	}
+	// Le ticket, ses champs et ses fichiers sont enregistrés ensemble, ou pas du tout.
+	store := getStorage(c)
+	var stored []db.Attachment
+	err = database.Transaction(func(tx *gorm.DB) error {
+		if err := db.CreateTicket(tx, getCalendars(c), &ticket); err != nil {
+			return err
+		}
+		if err := db.InitTicketFields(tx, ticket.ID, values); err != nil {
+			return err
+		}
+		stored, err = storeUploads(tx, store, ticket, nil, uploads, ticket.User)
+		return err
+	})
+	if err != nil {
+		discardUploads(store, stored)
+		renderTicketForm(c, http.StatusInternalServerError, "Erreur serveur")
+		return
+	}
+	c.Redirect(http.StatusFound, "/tickets")
+}
+
+// -------------------- Page ticket et conversation --------------------
+
+// findVisibleTicket charge le ticket :id pour une page HTML ; 404 s'il
+// n'existe pas ou si l'utilisateur n'a pas le droit de le voir.
+func findVisibleTicket(c *gin.Context, database *gorm.DB) (db.Ticket, bool) {
+	var ticket db.Ticket
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := database.Preload("Labels").Preload("Queue").First(&ticket, id).Error; err != nil || !canSeeTicket(c, ticket) {
+		c.String(http.StatusNotFound, "Ticket introuvable")
+		return ticket, false
+	}
+	return ticket, true
+}
+
+func parseParentID(raw string) *uint {
+	if raw == "" {
+		return nil
+	}
+	v, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil || v == 0 {
+		return nil
+	}
+	id := uint(v)
+	return &id
+}
+
+func renderTicketPage(c *gin.Context, database *gorm.DB, ticket db.Ticket, status int, extra gin.H) {
+	comments, err := db.TicketComments(database, ticket.ID, can(c, db.PermTicketInternal))
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Erreur chargement des commentaires")
+		return
+	}
+
+	var ticketFiles []db.Attachment
+	database.Where("ticket_id = ? AND comment_id IS NULL", ticket.ID).Order("created_at, id").Find(&ticketFiles)
+
+	fields, _ := db.TicketFields(database, ticket)
+
+	data := gin.H{
+		"ticket":        ticket,
+		"fields":        fields,
+		"threads":       db.BuildCommentThreads(comments),
+		"attachments":   ticketFiles,
+		"user":          currentUser(c),
+		"isSupervisor":  can(c, db.PermTicketReadAny),
+		"canInternal":   can(c, db.PermTicketInternal),
+		"canEditFields": can(c, db.PermTicketUpdateFields),
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+	c.HTML(status, "ticket.html", data)
+}
+
+// GET /ticket/:id
+func TicketPage(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	ticket, ok := findVisibleTicket(c, database)
+	if !ok {
+		return
+	}
+	renderTicketPage(c, database, ticket, http.StatusOK, nil)
+}
+
+// POST /ticket/:id/comments : le demandeur, les superviseurs et les admins
+// peuvent écrire (ce sont exactement ceux qui voient le ticket).
+func TicketPostComment(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	ticket, ok := findVisibleTicket(c, database)
+	if !ok {
+		return
+	}
+
+	body := strings.TrimSpace(c.PostForm("body"))
+	if body == "" {
+		renderTicketPage(c, database, ticket, http.StatusBadRequest, gin.H{"error": "Le message est vide"})
+		return
+	}
+
+	// La case "note interne" n'est prise en compte qu'avec la permission ticket.internal.
+	internal := c.PostForm("internal") != "" && can(c, db.PermTicketInternal)
+
+	cfg := getConfig(c)
+	uploads, err := checkUploads(cfg, formFiles(c))
+	if err != nil {
+		renderTicketPage(c, database, ticket, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Le message et ses fichiers sont enregistrés ensemble, ou pas du tout.
+	store := getStorage(c)
+	var stored []db.Attachment
+	err = database.Transaction(func(tx *gorm.DB) error {
+		comment, err := db.AddTicketComment(tx, ticket, currentUser(c), body, parseParentID(c.PostForm("parent_id")), internal)
+		if err != nil {
+			return err
+		}
+		stored, err = storeUploads(tx, store, ticket, &comment.ID, uploads, currentUser(c))
+		return err
+	})
+	if err != nil {
+		discardUploads(store, stored)
+	}
+	if errors.Is(err, db.ErrInvalidParent) {
+		renderTicketPage(c, database, ticket, http.StatusBadRequest, gin.H{"error": "Message parent invalide"})
+		return
+	}
+	if err != nil {
+		renderTicketPage(c, database, ticket, http.StatusInternalServerError, gin.H{"error": "Erreur lors de l'enregistrement du message"})
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/ticket/"+strconv.Itoa(int(ticket.ID)))
+}
+
+// -------------------- API v1 : commentaires --------------------
+
+type CommentResponse struct {
+	ID        uint      `json:"id"`
+	TicketID  uint      `json:"ticket_id"`
+	ParentID  *uint     `json:"parent_id"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	Internal  bool      `json:"internal"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newCommentResponse(m db.TicketComment) CommentResponse {
+	return CommentResponse{
+		ID:        m.ID,
+		TicketID:  m.TicketID,
+		ParentID:  m.ParentID,
+		Author:    m.Author,
+		Body:      m.Body,
+		Internal:  m.Internal,
+		CreatedAt: m.CreatedAt,
+	}
+}
+
+type CommentInput struct {
+	Body     string `json:"body"`
+	ParentID *uint  `json:"parent_id"`
+	Internal bool   `json:"internal"`
+}
+
+// GET /api/v1/tickets/:id/comments : liste à plat, triée par date ; le fil
+// se reconstruit avec parent_id. Les notes internes sont absentes pour un Client.
+func APIListComments(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	ticket, ok := loadTicket(c, database)
+	if !ok {
+		return
+	}
+
+	comments, err := db.TicketComments(database, ticket.ID, can(c, db.PermTicketInternal))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed", "details": err.Error()})
+		return
+	}
+	out := make([]CommentResponse, 0, len(comments))
+	for _, m := range comments {
+		out = append(out, newCommentResponse(m))
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// POST /api/v1/tickets/:id/comments
+func APICreateComment(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	ticket, ok := loadTicket(c, database)
+	if !ok {
+		return
+	}
+
+	var in CommentInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body", "details": err.Error()})
+		return
+	}
+	in.Body = strings.TrimSpace(in.Body)
+	if in.Body == "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "body is required"})
+		return
+	}
+
+	if in.Internal && !can(c, db.PermTicketInternal) {
+		missingPermission(c, db.PermTicketInternal)
+		return
+	}
+
+	comment, err := db.AddTicketComment(database, ticket, currentUser(c), in.Body, in.ParentID, in.Internal)
+	if errors.Is(err, db.ErrInvalidParent) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "invalid parent_id"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "create failed", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, newCommentResponse(comment))
+}
@@ -0,0 +1,291 @@
+package handle
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html/template"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// -------------------- Double authentification --------------------
+
+// totpSetup prépare l'affichage d'un enrôlement en cours : QR code de l'URL
+// otpauth:// et secret, par groupes de quatre, pour une saisie à la main.
+func totpSetup(user db.User) (gin.H, error) {
+	key, err := db.TOTPKey(user)
+	if err != nil {
+		return nil, err
+	}
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for s := key.Secret(); s != ""; {
+		n := min(4, len(s))
+		groups = append(groups, s[:n])
+		s = s[n:]
+	}
+	return gin.H{
+		"qr":     template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())),
+		"secret": strings.Join(groups, " "),
+	}, nil
+}
+
+// pendingLogin retrouve la session en attente de seconde étape ; sans elle,
+// retour au formulaire de connexion.
+func pendingLogin(c *gin.Context, database *gorm.DB) (db.UserSession, db.User, bool) {
+	s, user, ok := LookupSession(c, database)
+	if !ok || s.Stage == "" {
+		c.Redirect(http.StatusFound, "/login")
+		return s, user, false
+	}
+	if lockedOut(database, s, user) {
+		setSessionCookie(c, "", -1)
+		c.String(http.StatusTooManyRequests, "Trop d'échecs de connexion : compte verrouillé temporairement, réessayez plus tard")
+		return s, user, false
+	}
+	return s, user, true
+}
+
+// lockedOut ferme la session en attente d'un compte verrouillé : ses essais
+// restants ne permettent pas de contourner le verrouillage.
+func lockedOut(database *gorm.DB, s db.UserSession, user db.User) bool {
+	if !db.LoginLocked(user, time.Now()) {
+		return false
+	}
+	database.Delete(&s)
+	return true
+}
+
+// failSecondFactor compte un second facteur faux dans les essais de la
+// session en attente et dans ceux du compte (voir db.FailLogin) : connaître
+// le mot de passe ne donne pas d'essais illimités sur le code. Renvoie false
+// si la session est fermée.
+func failSecondFactor(database *gorm.DB, s *db.UserSession, user *db.User) bool {
+	db.FailLogin(database, user, time.Now())
+	return db.FailSession(database, s) && !lockedOut(database, *s, *user)
+}
+
+func renderLoginTOTP(c *gin.Context, database *gorm.DB, s db.UserSession, user db.User, status int, extra gin.H) {
+	data := gin.H{
+		"user":        user,
+		"enroll":      s.Stage == db.SessionEnroll,
+		"hasPasskeys": db.HasPasskeys(database, user.ID),
+	}
+	if s.Stage == db.SessionEnroll {
+		if user.TOTPSecret == "" {
+			if _, err := db.StartTOTPEnrollment(database, &user); err != nil {
+				c.String(http.StatusInternalServerError, "Impossible de préparer la double authentification")
+				return
+			}
+		}
+		setup, err := totpSetup(user)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Impossible de préparer la double authentification")
+			return
+		}
+		data["setup"] = setup
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+	c.HTML(status, "login_2fa.html", data)
+}
+
+// GET /login/2fa : seconde étape de la connexion, ou enrôlement imposé par
+// le rôle.
+func LoginTOTPPage(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	s, user, ok := pendingLogin(c, database)
+	if !ok {
+		return
+	}
+	renderLoginTOTP(c, database, s, user, http.StatusOK, nil)
+}
+
+// POST /login/2fa : code TOTP ou code de secours ; à l'enrôlement, premier
+// code de l'application. Trop de codes faux ferment la session en attente.
+func LoginTOTP(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	s, user, ok := pendingLogin(c, database)
+	if !ok {
+		return
+	}
+
+	code := c.PostForm("code")
+	var recovery []string
+	var err error
+	switch s.Stage {
+	case db.SessionSecondFactor:
+		ok = db.CheckSecondFactor(database, &user, code)
+	case db.SessionEnroll:
+		recovery, err = db.EnableTOTP(database, &user, code)
+		ok = err == nil
+	}
+	if !ok {
+		// Un premier code faux à l'enrôlement ne révèle rien : seul un
+		// second facteur existant est protégé par le verrouillage.
+		var open bool
+		if s.Stage == db.SessionSecondFactor {
+			open = failSecondFactor(database, &s, &user)
+		} else {
+			open = db.FailSession(database, &s)
+		}
+		if !open {
+			setSessionCookie(c, "", -1)
+			c.Redirect(http.StatusFound, "/login")
+			return
+		}
+		renderLoginTOTP(c, database, s, user, http.StatusUnauthorized, gin.H{"error": "Code invalide"})
+		return
+	}
+
+	// Nouvelle session, nouveau jeton : celui de l'étape précédente ne sert plus.
+	database.Delete(&s)
+	db.ResetLoginFailures(database, &user)
+	if err := StartSession(c, database, user, ""); err != nil {
+		c.String(http.StatusInternalServerError, "Impossible d'ouvrir la session")
+		return
+	}
+	if recovery != nil {
+		c.HTML(http.StatusOK, "login_2fa.html", gin.H{"user": user, "recoveryCodes": recovery})
+		return
+	}
+	c.Redirect(http.StatusFound, "/home")
+}
+
+// POST /profile/2fa/setup : nouveau secret, à confirmer par un premier code.
+func ProfileStartTOTP(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+	if _, err := db.StartTOTPEnrollment(database, &user); err != nil {
+		renderProfile(c, database, user, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.Redirect(http.StatusFound, "/profile#2fa")
+}
+
+// POST /profile/2fa/enable : confirme l'enrôlement et affiche les codes de secours.
+func ProfileEnableTOTP(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+	codes, err := db.EnableTOTP(database, &user, c.PostForm("code"))
+	if err != nil {
+		renderProfile(c, database, user, http.StatusBadRequest, gin.H{"error": "Code invalide"})
+		return
+	}
+	renderProfile(c, database, user, http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// POST /profile/2fa/disable : retire le TOTP contre un code valide (TOTP ou de
+// secours), sauf si le rôle impose un second facteur et qu'aucune passkey ne
+// le remplace. Un enrôlement inachevé s'annule sans code.
+func ProfileDisableTOTP(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		if db.TOTPRequired(database, user) && !db.HasPasskeys(database, user.ID) {
+			renderProfile(c, database, user, http.StatusBadRequest, gin.H{"error": db.ErrTOTPRequired.Error()})
+			return
+		}
+		if !db.CheckSecondFactor(database, &user, c.PostForm("code")) {
+			renderProfile(c, database, user, http.StatusBadRequest, gin.H{"error": "Code invalide"})
+			return
+		}
+	}
+	if err := db.ResetTOTP(database, user.ID); err != nil {
+		renderProfile(c, database, user, http.StatusInternalServerError, gin.H{"error": "Impossible de désactiver la double authentification"})
+		return
+	}
+	c.Redirect(http.StatusFound, "/profile#2fa")
+}
+
+// POST /profile/2fa/recovery : nouveaux codes de secours contre un code TOTP ;
+// les anciens ne valent plus.
+func ProfileRecoveryCodes(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+	if !user.TOTPEnabled || !db.CheckTOTP(database, &user, c.PostForm("code")) {
+		renderProfile(c, database, user, http.StatusBadRequest, gin.H{"error": "Code invalide"})
+		return
+	}
+	codes, err := db.RegenerateRecoveryCodes(database, user.ID)
+	if err != nil {
+		renderProfile(c, database, user, http.StatusInternalServerError, gin.H{"error": "Impossible de générer les codes de secours"})
+		return
+	}
+	renderProfile(c, database, user, http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// POST /admin/user/reset-2fa/:id : retire les seconds facteurs (TOTP, codes de
+// secours, passkeys) d'un utilisateur qui a perdu son téléphone ou sa clé. Si
+// son rôle l'impose, il s'enrôlera de nouveau à sa prochaine connexion.
+// Avec le mot de passe, cela suffirait à prendre le compte : comme pour sa
+// modification, le rôle de l'utilisateur ne doit pas dépasser celui de
+// l'auteur.
+func AdminResetSecondFactor(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	var user db.User
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := database.First(&user, id).Error; err != nil {
+		c.String(http.StatusNotFound, "Utilisateur introuvable")
+		return
+	}
+	if !db.CanAssignRole(database, currentRole(c), user.Role) {
+		c.String(http.StatusForbidden, "Ce rôle a des permissions que vous n'avez pas")
+		return
+	}
+	if err := db.ResetSecondFactor(database, user.ID); err != nil {
+		c.String(http.StatusInternalServerError, "Impossible de réinitialiser la double authentification")
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin")
+}
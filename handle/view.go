@@ -0,0 +1,245 @@
+package handle
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// -------------------- Vues enregistrées --------------------
+
+// ViewCount est une vue et le nombre de tickets qu'elle contient.
+type ViewCount struct {
+	db.SavedView
+	Count  int64
+	Pinned bool
+}
+
+// viewCountTTL borne l'âge d'un compteur de vue : la navigation de chaque page
+// /supervisor les affiche et les redemande périodiquement, sans relancer un
+// COUNT par vue à chaque fois.
+const viewCountTTL = 30 * time.Second
+
+// viewCountKey identifie un compteur : il dépend de l'utilisateur (« moi »,
+// files dont il est membre) et des critères de la vue.
+type viewCountKey struct {
+	username string
+	query    string
+}
+
+type viewCount struct {
+	n  int64
+	at time.Time
+}
+
+var viewCounts = struct {
+	sync.Mutex
+	m map[viewCountKey]viewCount
+}{m: map[viewCountKey]viewCount{}}
+
+// cachedViewCount renvoie le compteur encore frais de key ; sinon ok est faux.
+func cachedViewCount(key viewCountKey, now time.Time) (int64, bool) {
+	viewCounts.Lock()
+	defer viewCounts.Unlock()
+	vc, ok := viewCounts.m[key]
+	if !ok || now.Sub(vc.at) > viewCountTTL {
+		return 0, false
+	}
+	return vc.n, true
+}
+
+// storeViewCount garde n pour key et oublie les compteurs périmés.
+func storeViewCount(key viewCountKey, n int64, now time.Time) {
+	viewCounts.Lock()
+	defer viewCounts.Unlock()
+	for k, vc := range viewCounts.m {
+		if now.Sub(vc.at) > viewCountTTL {
+			delete(viewCounts.m, k)
+		}
+	}
+	viewCounts.m[key] = viewCount{n: n, at: now}
+}
+
+func countViews(c *gin.Context, database *gorm.DB, user db.User, views []db.SavedView, pinned map[uint]bool) []ViewCount {
+	out := make([]ViewCount, 0, len(views))
+	now := time.Now()
+	// Les files de l'utilisateur ne sont chargées qu'une fois pour toutes les vues.
+	var scope db.TicketFilter
+	scopeToQueues(c, database, &scope, user.Username)
+	for _, v := range views {
+		vc := ViewCount{SavedView: v, Count: -1, Pinned: pinned[v.ID]}
+		key := viewCountKey{username: user.Username, query: v.Query}
+		if n, ok := cachedViewCount(key, now); ok {
+			vc.Count = n
+		} else if f, err := v.Filter(); err == nil {
+			f.Me = user.Username
+			f.MemberOf = scope.MemberOf
+			if n, err := db.CountTickets(database, f); err == nil {
+				vc.Count = n
+				storeViewCount(key, n, now)
+			}
+		}
+		out = append(out, vc)
+	}
+	return out
+}
+
+// PinnedViewCounts renvoie les vues épinglées par l'utilisateur courant et
+// leurs compteurs, pour la navigation des pages /supervisor.
+func PinnedViewCounts(c *gin.Context) []ViewCount {
+	database := getDB(c)
+	if database == nil {
+		return nil
+	}
+	var user db.User
+	if err := database.Where("username = ?", currentUser(c)).First(&user).Error; err != nil {
+		return nil
+	}
+	views, _ := db.PinnedViews(database, user, can(c, db.PermViewManage))
+	pinned := make(map[uint]bool, len(views))
+	for _, v := range views {
+		pinned[v.ID] = true
+	}
+	return countViews(c, database, user, views, pinned)
+}
+
+// GET /supervisor/views : les vues de l'utilisateur et celles partagées avec
+// son rôle ; toutes les vues avec la permission view.manage.
+func ViewsPage(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+	views, err := db.VisibleViews(database, user, can(c, db.PermViewManage))
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Erreur chargement des vues")
+		return
+	}
+	c.HTML(http.StatusOK, "views.html", gin.H{
+		"views":     countViews(c, database, user, views, db.IsPinned(database, user.ID)),
+		"me":        user,
+		"canManage": can(c, db.PermViewManage),
+	})
+}
+
+// POST /supervisor/views : name, query (paramètres de la liste), shared_role
+// (vide : vue privée) et pin.
+func CreateView(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+	view, err := db.CreateView(database, user, c.PostForm("name"), c.PostForm("query"), c.PostForm("shared_role"), c.PostForm("pin") != "")
+	if err != nil {
+		c.String(http.StatusBadRequest, "Vue invalide : "+err.Error())
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/supervisor/views/"+strconv.FormatUint(uint64(view.ID), 10))
+}
+
+func loadView(c *gin.Context, database *gorm.DB, user db.User) (db.SavedView, bool) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	view, err := db.FindView(database, user, uint(id), can(c, db.PermViewManage))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.String(http.StatusNotFound, "Vue introuvable")
+		} else {
+			c.String(http.StatusInternalServerError, "Erreur chargement de la vue")
+		}
+		return view, false
+	}
+	return view, true
+}
+
+// GET /supervisor/views/:id : ouvre la liste /supervisor avec les paramètres
+// de la vue.
+func OpenView(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+	view, ok := loadView(c, database, user)
+	if !ok {
+		return
+	}
+	target := "/supervisor?view=" + strconv.FormatUint(uint64(view.ID), 10)
+	if view.Query != "" {
+		target += "&" + view.Query
+	}
+	c.Redirect(http.StatusFound, target)
+}
+
+// POST /supervisor/views/:id/pin : épingle la vue, ou la retire de la navigation.
+func ToggleViewPin(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+	view, ok := loadView(c, database, user)
+	if !ok {
+		return
+	}
+	if err := db.TogglePin(database, user.ID, view.ID); err != nil {
+		c.String(http.StatusInternalServerError, "Échec mise à jour")
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/supervisor/views")
+}
+
+// POST /supervisor/views/:id/delete : le propriétaire ou un Admin.
+func DeleteView(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	user, ok := loadCurrentUser(c, database)
+	if !ok {
+		return
+	}
+	view, ok := loadView(c, database, user)
+	if !ok {
+		return
+	}
+	if view.OwnerID != user.ID && !can(c, db.PermViewManage) {
+		c.String(http.StatusForbidden, "Seul son auteur peut supprimer cette vue")
+		return
+	}
+	if err := db.DeleteView(database, view); err != nil {
+		c.String(http.StatusInternalServerError, "Échec suppression")
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/supervisor/views")
+}
+
+// GET /supervisor/views/counts : compteurs des vues épinglées, rafraîchis
+// périodiquement par la navigation ({"<id>": nombre}).
+func ViewCounts(c *gin.Context) {
+	out := map[string]int64{}
+	for _, v := range PinnedViewCounts(c) {
+		out[strconv.FormatUint(uint64(v.ID), 10)] = v.Count
+	}
+	c.JSON(http.StatusOK, out)
+}
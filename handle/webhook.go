@@ -0,0 +1,73 @@
+package handle
+
+import (
+	"net/http"
+	"strconv"
+
+	"sae/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// -------------------- Administration des webhooks --------------------
+
+// POST /admin/webhooks : url, description et events (cases à cocher ; aucune
+// case cochée = tous les événements).
+func AdminCreateWebhook(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	if _, err := db.CreateWebhook(database, c.PostForm("url"), c.PostForm("description"), c.PostFormArray("events")); err != nil {
+		c.String(http.StatusBadRequest, "Webhook invalide : "+err.Error())
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin#webhooks")
+}
+
+// POST /admin/webhooks/:id/toggle : active ou désactive l'abonnement.
+func AdminToggleWebhook(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	var hook db.Webhook
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := database.First(&hook, id).Error; err != nil {
+		c.String(http.StatusNotFound, "Webhook introuvable")
+		return
+	}
+	if err := database.Model(&hook).Update("active", !hook.Active).Error; err != nil {
+		c.String(http.StatusInternalServerError, "Erreur serveur")
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin#webhooks")
+}
+
+func AdminDeleteWebhook(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := database.Delete(&db.Webhook{}, id).Error; err != nil {
+		c.String(http.StatusInternalServerError, "Erreur serveur")
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin#webhooks")
+}
+
+// POST /admin/webhooks/deliveries/:id/retry : relance un envoi (échoué ou
+// non), avec un nouveau jeu de tentatives.
+func AdminRetryDelivery(c *gin.Context) {
+	database := getDB(c)
+	if database == nil {
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+	if err := db.RetryDelivery(database, uint(id)); err != nil {
+		c.String(http.StatusInternalServerError, "Erreur serveur")
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin#deliveries")
+}
@@ -0,0 +1,283 @@
+// Package inbound transforme les e-mails reçus en tickets et en messages.
+//
+// Les e-mails sont lus dans un Maildir (GTM_MAILDIR), alimenté par le
+// serveur de messagerie (fetchmail, getmail, livraison locale de Postfix...).
+// Un e-mail d'un utilisateur connu (db.User.Email, unique) :
+//   - envoyé à l'adresse de réponse d'un ticket (Reply-To des
+//     notifications, qui porte le jeton de réponse du ticket), devient un
+//     message public sur ce ticket, sans le texte cité ;
+//   - qui cite un ticket sans ce jeton (In-Reply-To, References ou
+//     « [Ticket #N] » dans le sujet) est refusé : l'expéditeur, lu dans
+//     l'en-tête From, peut être usurpé ;
+//   - sinon, ouvre un nouveau ticket, si son rôle le permet (ticket.create).
+//
+// Les pièces jointes autorisées (taille, type) sont conservées. Un e-mail
+// traité passe de new/ à cur/ ; un e-mail refusé y est marqué supprimé (T).
+package inbound
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"sae/calendar"
+	"sae/config"
+	"sae/db"
+	"sae/storage"
+	"sae/workflow"
+
+	"gorm.io/gorm"
+)
+
+type Poller struct {
+	DB        *gorm.DB
+	Store     storage.Store
+	Config    config.Config
+	Workflow  *workflow.Definition
+	Calendars *calendar.Set
+	Dir       string
+	Interval  time.Duration
+}
+
+// errRejected marque un e-mail volontairement ignoré (expéditeur inconnu,
+// réponse automatique...), par opposition à une erreur de traitement.
+var errRejected = errors.New("e-mail refusé")
+
+func rejected(format string, args ...any) error {
+	return fmt.Errorf("%w : %s", errRejected, fmt.Sprintf(format, args...))
+}
+
+// Start relève le Maildir périodiquement jusqu'à l'annulation de ctx.
+func (p *Poller) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(p.Interval)
+		defer ticker.Stop()
+		for {
+			if err := p.Poll(); err != nil {
+				log.Println("Import des e-mails :", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Poll traite tous les e-mails de new/. Un e-mail en erreur reste dans new/
+// pour être retenté au passage suivant.
+func (p *Poller) Poll() error {
+	for _, sub := range []string{"new", "cur", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(p.Dir, sub), 0o700); err != nil {
+			return err
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(p.Dir, "new"))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(p.Dir, "new", e.Name())
+		flags := "S"
+		if err := p.importFile(path); errors.Is(err, errRejected) {
+			log.Printf("Import de %s : %v", e.Name(), err)
+			flags = "ST"
+		} else if err != nil {
+			log.Printf("Import de %s : %v", e.Name(), err)
+			continue
+		}
+		dest := filepath.Join(p.Dir, "cur", e.Name()+":2,"+flags)
+		if err := os.Rename(path, dest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Poller) importFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	msg, err := parseMessage(f)
+	if err != nil {
+		return rejected("illisible : %v", err)
+	}
+	if msg.MessageID == "" {
+		// Sans Message-ID, le nom du fichier (unique dans un Maildir) en tient lieu.
+		msg.MessageID = "<" + filepath.Base(path) + "@maildir>"
+	}
+	return p.Import(msg)
+}
+
+// Import enregistre un e-mail déjà analysé.
+func (p *Poller) Import(msg *message) error {
+	if msg.AutoSubmitted {
+		return rejected("réponse automatique de %s", msg.From)
+	}
+	if db.InboundMailSeen(p.DB, msg.MessageID) {
+		return rejected("%s déjà importé", msg.MessageID)
+	}
+
+	var user db.User
+	if err := p.DB.Where("LOWER(email) = ?", msg.From).First(&user).Error; err != nil {
+		return rejected("aucun utilisateur pour %s", msg.From)
+	}
+
+	text := msg.Text
+	if text == "" && msg.HTML != "" {
+		text = htmlToText(msg.HTML)
+	}
+
+	// Les blobs sont écrits pendant la transaction : ceux d'un import annulé
+	// sont retirés ensuite.
+	var stored []string
+	err := p.DB.Transaction(func(tx *gorm.DB) error {
+		record := db.InboundMail{
+			MessageID:  msg.MessageID,
+			From:       msg.From,
+			Subject:    msg.Subject,
+			ReceivedAt: time.Now(),
+		}
+
+		ticket, ok, err := p.thread(tx, msg, user)
+		if err != nil {
+			return err
+		}
+		if ok {
+			body := stripQuoted(text)
+			if body == "" && len(msg.Files) == 0 {
+				return rejected("réponse vide de %s sur le ticket %d", msg.From, ticket.ID)
+			}
+			if body == "" {
+				body = "(pièces jointes)"
+			}
+			comment, err := db.AddTicketComment(tx, ticket, user.Username, body, nil, false)
+			if err != nil {
+				return err
+			}
+			record.CommentID = &comment.ID
+		} else {
+			if !db.RoleHas(tx, user.Role, db.PermTicketCreate) {
+				return rejected("%s n'a pas le droit d'ouvrir un ticket", msg.From)
+			}
+			title := cleanSubject(msg.Subject)
+			if title == "" {
+				title = "(sans sujet)"
+			}
+			ticket = db.Ticket{
+				Title:       title,
+				Description: strings.TrimSpace(text),
+				User:        user.Username,
+				State:       p.Workflow.Initial,
+			}
+			if err := db.CreateTicket(tx, p.Calendars, &ticket); err != nil {
+				return err
+			}
+		}
+		record.TicketID = ticket.ID
+
+		for _, f := range msg.Files {
+			key, err := p.storeFile(tx, ticket, record.CommentID, f, user.Username)
+			if err != nil {
+				log.Printf("Import %s : pièce jointe %q ignorée : %v", msg.MessageID, f.Name, err)
+				continue
+			}
+			stored = append(stored, key)
+		}
+		return tx.Create(&record).Error
+	})
+	if err != nil {
+		for _, key := range stored {
+			p.Store.Delete(context.Background(), key)
+		}
+	}
+	return err
+}
+
+// thread retrouve le ticket auquel l'e-mail répond. Seule l'adresse de
+// réponse, avec le jeton du ticket, rattache l'e-mail ; il faut en outre que
+// l'expéditeur ait le droit d'y écrire (le demandeur, ou un agent). Un
+// e-mail qui cite un ticket sans jeton valide est refusé.
+func (p *Poller) thread(tx *gorm.DB, msg *message, user db.User) (db.Ticket, bool, error) {
+	var ticket db.Ticket
+	for _, to := range msg.To {
+		m := replyAddress.FindStringSubmatch(to)
+		if m == nil {
+			continue
+		}
+		id, _ := strconv.ParseUint(m[1], 10, 64)
+		if err := tx.First(&ticket, id).Error; err != nil || !db.ReplyTokenValid(ticket, m[2]) {
+			return ticket, false, rejected("jeton de réponse invalide pour le ticket %d (%s)", id, msg.From)
+		}
+		if ticket.User != user.Username && !db.RoleHas(tx, user.Role, db.PermTicketReadAny) {
+			return ticket, false, rejected("%s n'a pas accès au ticket %d", msg.From, id)
+		}
+		return ticket, true, nil
+	}
+
+	if id, ok := db.TicketForMessageIDs(tx, msg.Refs); ok {
+		return ticket, false, rejected("réponse au ticket %d sans jeton de réponse (%s)", id, msg.From)
+	}
+	if m := ticketToken.FindStringSubmatch(msg.Subject); m != nil {
+		return ticket, false, rejected("réponse au ticket %s sans jeton de réponse (%s)", m[1], msg.From)
+	}
+	return ticket, false, nil
+}
+
+// storeFile applique aux pièces jointes reçues les mêmes contrôles qu'aux
+// fichiers envoyés par formulaire. Renvoie la clé du blob écrit, à retirer
+// si la transaction est annulée.
+func (p *Poller) storeFile(tx *gorm.DB, ticket db.Ticket, commentID *uint, f file, user string) (string, error) {
+	size := int64(len(f.Data))
+	if size > p.Config.MaxUploadSize {
+		return "", fmt.Errorf("taille %d supérieure au maximum", size)
+	}
+	mimeType, err := storage.DetectType(bytes.NewReader(f.Data), p.Config.TypeAllowed)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := storage.NewKey()
+	if err != nil {
+		return "", err
+	}
+	ctx := context.Background()
+	if err := p.Store.Put(ctx, key, bytes.NewReader(f.Data), size, mimeType); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(f.Data)
+	attachment := db.Attachment{
+		TicketID:   ticket.ID,
+		CommentID:  commentID,
+		Filename:   filepath.Base(f.Name),
+		Size:       size,
+		MimeType:   mimeType,
+		Checksum:   hex.EncodeToString(sum[:]),
+		StorageKey: key,
+		UploadedBy: user,
+	}
+	if err := tx.Create(&attachment).Error; err != nil {
+		p.Store.Delete(ctx, key)
+		return "", err
+	}
+	if commentID == nil {
+		db.LogTicketChange(tx, ticket, user, "Attachment", "", attachment.Filename)
+	}
+	return key, nil
+}
@@ -0,0 +1,263 @@
+package inbound
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// message est un e-mail reçu, réduit à ce dont l'import a besoin.
+type message struct {
+	From      string   // adresse, en minuscules
+	To        []string // To, Cc, Delivered-To et X-Original-To, en minuscules
+	Subject   string
+	MessageID string
+	// Refs liste les Message-ID cités : In-Reply-To d'abord, puis References
+	// du plus récent au plus ancien.
+	Refs          []string
+	Text          string
+	HTML          string
+	Files         []file
+	AutoSubmitted bool
+}
+
+type file struct {
+	Name string
+	Data []byte
+}
+
+var decoder = mime.WordDecoder{CharsetReader: charsetReader}
+
+func parseMessage(r io.Reader) (*message, error) {
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	from, err := mail.ParseAddress(decodeHeader(m.Header.Get("From")))
+	if err != nil {
+		return nil, fmt.Errorf("expéditeur : %w", err)
+	}
+
+	msg := &message{
+		From:      strings.ToLower(from.Address),
+		Subject:   strings.TrimSpace(decodeHeader(m.Header.Get("Subject"))),
+		MessageID: strings.TrimSpace(m.Header.Get("Message-ID")),
+	}
+	for _, h := range []string{"To", "Cc", "Delivered-To", "X-Original-To"} {
+		for _, v := range m.Header[h] {
+			addrs, err := mail.ParseAddressList(decodeHeader(v))
+			if err != nil {
+				continue
+			}
+			for _, a := range addrs {
+				msg.To = append(msg.To, strings.ToLower(a.Address))
+			}
+		}
+	}
+	msg.Refs = append(msg.Refs, messageIDs(m.Header.Get("In-Reply-To"))...)
+	refs := messageIDs(m.Header.Get("References"))
+	for i := len(refs) - 1; i >= 0; i-- {
+		msg.Refs = append(msg.Refs, refs[i])
+	}
+
+	// Réponses automatiques (absences, rebonds) : RFC 3834 et en-têtes usuels.
+	auto := strings.ToLower(m.Header.Get("Auto-Submitted"))
+	precedence := strings.ToLower(m.Header.Get("Precedence"))
+	msg.AutoSubmitted = (auto != "" && auto != "no") || precedence == "bulk" || precedence == "auto_reply" ||
+		m.Header.Get("X-Autoreply") != "" || m.Header.Get("X-Autorespond") != ""
+
+	if err := walkPart(msg, m.Header.Get("Content-Type"), m.Header.Get("Content-Transfer-Encoding"), "", m.Body, 0); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// walkPart parcourt une partie MIME : le premier texte rencontré devient le
+// corps, les fichiers nommés deviennent des pièces jointes.
+func walkPart(msg *message, contentType, encoding, disposition string, body io.Reader, depth int) error {
+	if depth > 10 {
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			// multipart décode lui-même le quoted-printable des parties.
+			err = walkPart(msg, part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"),
+				part.Header.Get("Content-Disposition"), part, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(decodeTransfer(body, encoding))
+	if err != nil {
+		return err
+	}
+
+	filename := ""
+	if _, dp, err := mime.ParseMediaType(disposition); err == nil {
+		filename = dp["filename"]
+	}
+	if filename == "" {
+		filename = params["name"]
+	}
+	isAttachment := strings.HasPrefix(strings.ToLower(disposition), "attachment")
+	if filename != "" || isAttachment {
+		if filename == "" {
+			filename = "piece-jointe"
+		}
+		msg.Files = append(msg.Files, file{Name: decodeHeader(filename), Data: data})
+		return nil
+	}
+
+	switch mediaType {
+	case "text/plain":
+		if msg.Text == "" {
+			msg.Text = toUTF8(data, params["charset"])
+		}
+	case "text/html":
+		if msg.HTML == "" {
+			msg.HTML = toUTF8(data, params["charset"])
+		}
+	}
+	return nil
+}
+
+func decodeTransfer(r io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+func decodeHeader(s string) string {
+	if out, err := decoder.DecodeHeader(s); err == nil {
+		return out
+	}
+	return s
+}
+
+// charsetReader accepte l'UTF-8 et le Latin-1 (et Windows-1252, traité comme
+// Latin-1), les seuls jeux de caractères rencontrés en pratique ici.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch {
+	case isLatin1(charset):
+		data, err := io.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		return strings.NewReader(latin1(data)), nil
+	case strings.EqualFold(charset, "utf-8"), strings.EqualFold(charset, "us-ascii"):
+		return input, nil
+	}
+	return nil, fmt.Errorf("jeu de caractères non pris en charge : %s", charset)
+}
+
+func isLatin1(charset string) bool {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "iso-8859-15", "latin1", "windows-1252":
+		return true
+	}
+	return false
+}
+
+// toUTF8 convertit un corps de texte ; sans jeu de caractères reconnu, un
+// contenu qui n'est pas de l'UTF-8 valide est lu comme du Latin-1.
+func toUTF8(data []byte, charset string) string {
+	if !isLatin1(charset) && utf8.Valid(data) {
+		return string(data)
+	}
+	return latin1(data)
+}
+
+func latin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+var messageIDPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+func messageIDs(header string) []string {
+	return messageIDPattern.FindAllString(header, -1)
+}
+
+var (
+	tagPattern      = regexp.MustCompile(`(?s)<(script|style)[^>]*>.*?</(script|style)>|<[^>]+>`)
+	blockTagPattern = regexp.MustCompile(`(?i)<(br|/p|/div|/li|/tr|/h[1-6])[^>]*>`)
+	blankLines      = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText donne une version texte lisible d'un message sans partie
+// text/plain.
+func htmlToText(s string) string {
+	s = blockTagPattern.ReplaceAllString(s, "\n")
+	s = tagPattern.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	return blankLines.ReplaceAllString(s, "\n\n")
+}
+
+// Début de la citation d'un message précédent, selon les clients courants.
+var quoteHeader = regexp.MustCompile(`(?i)^(on\b.*\bwrote:|le\b.*\ba écrit\s*:|-{2,}\s*(original message|message d'origine|forwarded message)\s*-{2,}|(from|de)\s*:\s.*@.*)$`)
+
+// stripQuoted retire d'une réponse le message cité et la signature.
+func stripQuoted(text string) string {
+	var out []string
+	sc := bufio.NewScanner(strings.NewReader(strings.ReplaceAll(text, "\r\n", "\n")))
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		trimmed := strings.TrimSpace(line)
+		if line == "-- " || quoteHeader.MatchString(trimmed) {
+			break
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		out = append(out, strings.TrimRight(line, " \t"))
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
+
+// replyAddress reconnaît l'adresse de réponse d'un ticket :
+// local+<numéro>-<jeton>@domaine (voir notify).
+var replyAddress = regexp.MustCompile(`^[^@+]+\+(\d+)-([0-9a-f]+)@`)
+
+var (
+	ticketToken   = regexp.MustCompile(`\[Ticket #(\d+)\]`)
+	replyPrefixes = regexp.MustCompile(`(?i)^\s*((re|fwd?|tr|aw|wg)\s*:\s*)+`)
+)
+
+// cleanSubject retire les préfixes de réponse et le jeton de ticket.
+func cleanSubject(s string) string {
+	s = ticketToken.ReplaceAllString(s, "")
+	s = replyPrefixes.ReplaceAllString(s, "")
+	return strings.TrimSpace(s)
+}
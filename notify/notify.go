@@ -0,0 +1,205 @@
+// Package notify envoie par e-mail les événements des tickets (création,
+// changement d'état ou de priorité, assignation, message, escalade) au
+// demandeur et à l'agent assigné.
+//
+// Les messages sont mis en forme dès l'événement et enregistrés dans la file
+// db.OutgoingMail, dans la même transaction que le changement ; un worker les
+// envoie ensuite par le relais SMTP configuré, en réessayant avec un délai
+// croissant en cas d'échec.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"sae/config"
+	"sae/db"
+
+	"gorm.io/gorm"
+)
+
+//go:embed templates/*.tmpl
+var defaultTemplates embed.FS
+
+// Events liste les événements notifiés ; chacun a son gabarit <événement>.tmpl.
+var Events = []string{
+	db.EventTicketCreated,
+	db.EventTicketStateChanged,
+	db.EventTicketPriorityChanged,
+	db.EventTicketAssigned,
+	db.EventTicketCommented,
+	db.EventTicketEscalated,
+}
+
+// Message est la donnée passée aux gabarits.
+type Message struct {
+	Event     db.Event
+	Ticket    db.Ticket
+	Data      map[string]string
+	Recipient db.User
+	// Role vaut "requester" pour le demandeur, "agent" sinon.
+	Role string
+	URL  string
+}
+
+type Notifier struct {
+	DB          *gorm.DB
+	SMTP        SMTPConfig
+	BaseURL     string
+	MaxAttempts int
+	templates   map[string]*template.Template
+}
+
+// New prépare le notifieur ; les gabarits de dir (GTM_MAIL_TEMPLATES)
+// remplacent, événement par événement, ceux intégrés au binaire.
+func New(database *gorm.DB, cfg config.Config) (*Notifier, error) {
+	n := &Notifier{
+		DB: database,
+		SMTP: SMTPConfig{
+			Addr:     cfg.SMTPAddr,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.SMTPFrom,
+		},
+		BaseURL:     strings.TrimSuffix(cfg.BaseURL, "/"),
+		MaxAttempts: int(cfg.MailMaxAttempts),
+		templates:   map[string]*template.Template{},
+	}
+	for _, event := range Events {
+		name := event + ".tmpl"
+		raw, err := defaultTemplates.ReadFile("templates/" + name)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.MailTemplateDir != "" {
+			custom, err := os.ReadFile(filepath.Join(cfg.MailTemplateDir, name))
+			if err == nil {
+				raw = custom
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		tpl, err := template.New(name).Option("missingkey=zero").Parse(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf("gabarit %s : %w", name, err)
+		}
+		n.templates[event] = tpl
+	}
+	return n, nil
+}
+
+// Subscribe branche le notifieur sur les événements des tickets.
+func (n *Notifier) Subscribe() {
+	db.Subscribe(n.enqueue)
+}
+
+// enqueue met en file un message par destinataire. Appelé dans la
+// transaction de l'événement : aucune requête réseau ici.
+func (n *Notifier) enqueue(tx *gorm.DB, e db.Event) {
+	tpl, ok := n.templates[e.Type]
+	if !ok {
+		return
+	}
+	for _, r := range recipients(tx, e) {
+		msg := Message{
+			Event:     e,
+			Ticket:    e.Ticket,
+			Data:      e.Data,
+			Recipient: r.user,
+			Role:      r.role,
+			URL:       fmt.Sprintf("%s/ticket/%d", n.BaseURL, e.Ticket.ID),
+		}
+		subject, body, err := render(tpl, msg)
+		if err != nil {
+			log.Printf("Notification %s du ticket %d : %v", e.Type, e.Ticket.ID, err)
+			continue
+		}
+		mail := db.OutgoingMail{
+			Event:     e.Type,
+			TicketID:  e.Ticket.ID,
+			To:        r.user.Email,
+			Subject:   subject,
+			Body:      body,
+			MessageID: n.SMTP.newMessageID(e.Ticket.ID),
+			ReplyTo:   n.SMTP.replyTo(e.Ticket.ID, e.Ticket.ReplyToken),
+		}
+		if err := db.EnqueueMail(tx, &mail); err != nil {
+			log.Printf("Notification %s du ticket %d : %v", e.Type, e.Ticket.ID, err)
+		}
+	}
+}
+
+// render exécute le gabarit ; sa première ligne est "Subject: ...", suivie
+// d'une ligne vide puis du corps du message.
+func render(tpl *template.Template, msg Message) (subject, body string, err error) {
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, msg); err != nil {
+		return "", "", err
+	}
+	head, rest, _ := strings.Cut(buf.String(), "\n")
+	subject, ok := strings.CutPrefix(strings.TrimSpace(head), "Subject:")
+	if !ok {
+		return "", "", fmt.Errorf("%s : la première ligne doit être \"Subject: ...\"", tpl.Name())
+	}
+	return strings.TrimSpace(subject), strings.TrimLeft(rest, "\n"), nil
+}
+
+// Start lance l'envoi de la file jusqu'à l'annulation de ctx.
+func (n *Notifier) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			n.SendDue(time.Now())
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// SendDue envoie les messages dus ; chacun n'est envoyé qu'une fois même si
+// plusieurs instances partagent la base.
+func (n *Notifier) SendDue(now time.Time) {
+	mails, err := db.DueMails(n.DB, now, 20)
+	if err != nil {
+		log.Println("File d'e-mails :", err)
+		return
+	}
+	for i := range mails {
+		m := &mails[i]
+		if ok, err := db.ClaimMail(n.DB, m, 5*time.Minute); err != nil || !ok {
+			continue
+		}
+		if err := n.SMTP.Send(m.To, m.ReplyTo, m.Subject, m.Body, m.MessageID); err != nil {
+			retry := backoff(m.Attempts + 1)
+			if m.Attempts+1 >= n.MaxAttempts {
+				retry = 0
+			}
+			log.Printf("E-mail %d vers %s (tentative %d) : %v", m.ID, m.To, m.Attempts+1, err)
+			db.MarkMailFailed(n.DB, m, err, retry)
+			continue
+		}
+		db.MarkMailSent(n.DB, m)
+	}
+}
+
+// backoff renvoie le délai avant la tentative suivante : 30 s, 1 min, 2 min…
+// plafonné à une heure.
+func backoff(attempts int) time.Duration {
+	d := 30 * time.Second
+	for i := 1; i < attempts && d < time.Hour; i++ {
+		d *= 2
+	}
+	return min(d, time.Hour)
+}
@@ -0,0 +1,303 @@
+package notify
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sae/calendar"
+	"sae/config"
+	"sae/db"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// smtpSink est un relais SMTP minimal, en mémoire : il accepte les messages
+// sans STARTTLS ni authentification, et refuse les reject premiers
+// destinataires avec une erreur temporaire.
+type smtpSink struct {
+	ln     net.Listener
+	mu     sync.Mutex
+	reject int
+	mails  []sunkMail
+}
+
+type sunkMail struct {
+	to   string
+	data string
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpSink{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 sink ESMTP")
+	var to string
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 sink")
+		case "MAIL":
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			s.mu.Lock()
+			rejected := s.reject > 0
+			if rejected {
+				s.reject--
+			}
+			s.mu.Unlock()
+			if rejected {
+				tp.PrintfLine("451 réessayez plus tard")
+				continue
+			}
+			to = strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.mails = append(s.mails, sunkMail{to: to, data: string(data)})
+			s.mu.Unlock()
+			tp.PrintfLine("250 ok")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+func (s *smtpSink) received() []sunkMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sunkMail(nil), s.mails...)
+}
+
+func (m sunkMail) header(t *testing.T) textproto.MIMEHeader {
+	t.Helper()
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(m.data)))
+	h, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// subject renvoie l'en-tête Subject décodé du message.
+func (m sunkMail) subject(t *testing.T) string {
+	t.Helper()
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.header(t).Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subject
+}
+
+// Subscribe ajoute un abonné global : le notifieur n'est branché qu'une fois
+// pour tout le package, et chaque test lui donne sa base.
+var (
+	subscribeOnce sync.Once
+	notifier      *Notifier
+)
+
+func setup(t *testing.T) (*gorm.DB, *smtpSink) {
+	t.Helper()
+	database, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.AutoMigrate(&db.User{}, &db.Ticket{}, &db.TicketHistory{}, &db.SLAPolicy{}, &db.OutgoingMail{}, &db.Label{}, &db.Queue{}, &db.TicketFieldValue{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SeedSLAPolicies(database); err != nil {
+		t.Fatal(err)
+	}
+	users := []db.User{
+		{Username: "alice", Role: "Client", Email: "alice@example.com"},
+		{Username: "bob", Role: "Supervisor", Email: "bob@example.com"},
+	}
+	if err := database.Create(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	sink := newSMTPSink(t)
+	subscribeOnce.Do(func() {
+		n, err := New(nil, config.Config{SMTPFrom: "Tickets <tickets@example.com>", BaseURL: "https://tickets.example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.Subscribe()
+		notifier = n
+	})
+	notifier.DB = database
+	notifier.SMTP.Addr = sink.ln.Addr().String()
+	notifier.MaxAttempts = 3
+	return database, sink
+}
+
+func createTicket(t *testing.T, database *gorm.DB) db.Ticket {
+	t.Helper()
+	ticket := db.Ticket{Title: "Imprimante", User: "alice", State: "Ouvert", Priority: "low"}
+	if err := db.CreateTicket(database, calendar.Default(), &ticket); err != nil {
+		t.Fatal(err)
+	}
+	return ticket
+}
+
+func countMails(t *testing.T, database *gorm.DB, status string) int64 {
+	t.Helper()
+	var n int64
+	if err := database.Model(&db.OutgoingMail{}).Where("status = ?", status).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSavedChangeIsSent(t *testing.T) {
+	database, sink := setup(t)
+	ticket := createTicket(t, database)
+
+	// La priorité est publiée avant le changement de titre : le message doit
+	// pourtant porter le ticket tel qu'enregistré.
+	err := db.SaveTicket(database, &ticket, func(tx *gorm.DB) error {
+		if err := db.SetTicketPriority(tx, calendar.Default(), &ticket, "high", "bob"); err != nil {
+			return err
+		}
+		ticket.Title = "Imprimante du 2e étage"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notifier.SendDue(time.Now())
+	mails := sink.received()
+	if len(mails) != 2 {
+		t.Fatalf("%d messages reçus, attendu 2 (création et priorité)", len(mails))
+	}
+	for _, m := range mails {
+		if m.to != "alice@example.com" {
+			t.Errorf("message envoyé à %s", m.to)
+		}
+	}
+	want := fmt.Sprintf("[Ticket #%d] Imprimante du 2e étage : priorité high", ticket.ID)
+	if got := mails[1].subject(t); got != want {
+		t.Errorf("sujet = %q, attendu %q", got, want)
+	}
+	// Les réponses vont à l'adresse du ticket, qui porte son jeton.
+	replyTo := fmt.Sprintf("<tickets+%d-%s@example.com>", ticket.ID, ticket.ReplyToken)
+	if got := mails[1].header(t).Get("Reply-To"); !strings.HasSuffix(got, replyTo) {
+		t.Errorf("Reply-To = %q, attendu %q", got, replyTo)
+	}
+	if n := countMails(t, database, db.MailSent); n != 2 {
+		t.Errorf("%d messages marqués envoyés", n)
+	}
+}
+
+func TestRolledBackChangeQueuesNothing(t *testing.T) {
+	database, sink := setup(t)
+	ticket := createTicket(t, database)
+	queued := countMails(t, database, db.MailPending)
+
+	err := db.SaveTicket(database, &ticket, func(tx *gorm.DB) error {
+		if err := db.SetTicketPriority(tx, calendar.Default(), &ticket, "high", "bob"); err != nil {
+			return err
+		}
+		return errors.New("refusé")
+	})
+	if err == nil {
+		t.Fatal("SaveTicket aurait dû échouer")
+	}
+	if n := countMails(t, database, db.MailPending); n != queued {
+		t.Fatalf("%d messages en file après l'annulation, attendu %d", n, queued)
+	}
+	var saved db.Ticket
+	database.First(&saved, ticket.ID)
+	if saved.Priority != "low" {
+		t.Fatalf("priorité enregistrée %q malgré l'annulation", saved.Priority)
+	}
+
+	notifier.SendDue(time.Now())
+	if n := len(sink.received()); n != 1 {
+		t.Fatalf("%d messages reçus, attendu le seul accusé de réception", n)
+	}
+}
+
+func TestRetryThenGiveUp(t *testing.T) {
+	database, sink := setup(t)
+	sink.mu.Lock()
+	sink.reject = 1
+	sink.mu.Unlock()
+	createTicket(t, database)
+
+	now := time.Now()
+	notifier.SendDue(now)
+	var m db.OutgoingMail
+	database.First(&m)
+	if m.Status != db.MailPending || m.Attempts != 1 || m.LastError == "" {
+		t.Fatalf("après un refus : %+v", m)
+	}
+	if len(sink.received()) != 0 {
+		t.Fatal("message reçu malgré le refus")
+	}
+
+	// Pas avant le délai de 30 s.
+	notifier.SendDue(now.Add(10 * time.Second))
+	if len(sink.received()) != 0 {
+		t.Fatal("message renvoyé avant le délai")
+	}
+	notifier.SendDue(now.Add(time.Minute))
+	if len(sink.received()) != 1 {
+		t.Fatal("message non renvoyé après le délai")
+	}
+
+	// Refusé à chaque tentative : abandonné après MaxAttempts.
+	sink.mu.Lock()
+	sink.reject = 100
+	sink.mu.Unlock()
+	createTicket(t, database)
+	for i := 0; i < notifier.MaxAttempts; i++ {
+		notifier.SendDue(now.Add(time.Duration(i+1) * time.Hour))
+	}
+	if n := countMails(t, database, db.MailFailed); n != 1 {
+		t.Fatalf("%d messages abandonnés, attendu 1", n)
+	}
+}
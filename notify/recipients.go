@@ -0,0 +1,56 @@
+package notify
+
+import (
+	"sae/db"
+
+	"gorm.io/gorm"
+)
+
+type recipient struct {
+	user db.User
+	role string
+}
+
+// recipients choisit les destinataires d'un événement :
+//   - le demandeur pour tout ce qui est visible de lui (pas les notes
+//     internes, ni les assignations ou escalades) ;
+//   - l'agent assigné, ou à défaut tous les agents pour une escalade.
+//
+// L'auteur du changement n'est pas notifié, sauf le demandeur pour
+// l'accusé de réception de son ticket. Les comptes sans e-mail sont ignorés.
+func recipients(tx *gorm.DB, e db.Event) []recipient {
+	var out []recipient
+	seen := map[string]bool{}
+	add := func(u db.User, role string) {
+		if u.Email == "" || seen[u.Username] {
+			return
+		}
+		if u.Username == e.Actor && e.Type != db.EventTicketCreated {
+			return
+		}
+		seen[u.Username] = true
+		out = append(out, recipient{user: u, role: role})
+	}
+
+	internal := e.Type == db.EventTicketCommented && e.Data["internal"] == "true"
+	toRequester := !internal && e.Type != db.EventTicketAssigned && e.Type != db.EventTicketEscalated
+	if toRequester {
+		var requester db.User
+		if err := tx.Where("username = ?", e.Ticket.User).First(&requester).Error; err == nil {
+			add(requester, "requester")
+		}
+	}
+
+	if e.Ticket.AssigneeID != nil {
+		var assignee db.User
+		if err := tx.First(&assignee, *e.Ticket.AssigneeID).Error; err == nil {
+			add(assignee, "agent")
+		}
+	} else if e.Type == db.EventTicketEscalated {
+		agents, _ := db.Agents(tx)
+		for _, a := range agents {
+			add(a, "agent")
+		}
+	}
+	return out
+}
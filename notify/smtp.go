@@ -0,0 +1,138 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTPConfig décrit le relais SMTP (GTM_SMTP_*). STARTTLS est utilisé dès
+// que le serveur le propose ; l'authentification n'est tentée que si un
+// utilisateur est configuré.
+type SMTPConfig struct {
+	Addr     string // hôte:port
+	Username string
+	Password string
+	From     string
+}
+
+// domain renvoie le domaine de l'expéditeur, utilisé dans les Message-ID.
+func (s SMTPConfig) domain() string {
+	if addr, err := mail.ParseAddress(s.From); err == nil {
+		if _, d, ok := strings.Cut(addr.Address, "@"); ok {
+			return d
+		}
+	}
+	return "localhost"
+}
+
+// newMessageID renvoie un Message-ID unique qui rappelle le ticket ; les
+// réponses le citent dans In-Reply-To.
+func (s SMTPConfig) newMessageID(ticketID uint) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("<ticket-%d.%s@%s>", ticketID, hex.EncodeToString(b), s.domain())
+}
+
+// replyTo renvoie l'adresse de réponse d'un ticket : celle de l'expéditeur,
+// sous-adressée avec le numéro et le jeton de réponse du ticket
+// (tickets+12-<jeton>@exemple.fr). Vide si l'expéditeur n'est pas valide.
+func (s SMTPConfig) replyTo(ticketID uint, token string) string {
+	addr, err := mail.ParseAddress(s.From)
+	if err != nil || token == "" {
+		return ""
+	}
+	local, domain, ok := strings.Cut(addr.Address, "@")
+	if !ok {
+		return ""
+	}
+	if base, _, found := strings.Cut(local, "+"); found {
+		local = base
+	}
+	addr.Address = fmt.Sprintf("%s+%d-%s@%s", local, ticketID, token, domain)
+	return addr.String()
+}
+
+func (s SMTPConfig) message(to, replyTo, subject, body, messageID string) []byte {
+	var buf bytes.Buffer
+	header := func(k, v string) { fmt.Fprintf(&buf, "%s: %s\r\n", k, v) }
+	header("From", s.From)
+	header("To", to)
+	if replyTo != "" {
+		header("Reply-To", replyTo)
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", messageID)
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	header("Auto-Submitted", "auto-generated")
+	buf.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	qp.Close()
+	return buf.Bytes()
+}
+
+// Send remet un message au relais.
+func (s SMTPConfig) Send(to, replyTo, subject, body, messageID string) error {
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return fmt.Errorf("expéditeur %q : %w", s.From, err)
+	}
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", s.Addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(s.message(to, replyTo, subject, body, messageID)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,199 @@
+// Package scheduler exécute en tâche de fond l'escalade des tickets dont les
+// échéances de SLA approchent ou sont dépassées.
+//
+// À chaque passage, les règles sont évaluées pour les tickets ouverts dont
+// une échéance approche ou est dépassée ; une règle déclenchée est
+// enregistrée (db.Escalation) dans la même transaction que ses effets, ce qui
+// évite les doubles déclenchements après un redémarrage.
+package scheduler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"sae/config"
+	"sae/db"
+
+	"gorm.io/gorm"
+)
+
+// Actor est le nom sous lequel le scheduler apparaît dans l'historique.
+const Actor = "scheduler"
+
+// Règles d'escalade.
+const (
+	RuleResponseWarning   = "response_warning"   // première réponse bientôt due
+	RuleResponseBreach    = "response_breach"    // première réponse en retard : priorité +1
+	RuleResolutionWarning = "resolution_warning" // résolution bientôt due
+	RuleResolutionBreach  = "resolution_breach"  // résolution en retard : priorité +1 et réassignation
+)
+
+type Scheduler struct {
+	DB       *gorm.DB
+	Interval time.Duration
+	// WarnBefore est l'avance des alertes "bientôt dû" ; 0 les désactive.
+	WarnBefore time.Duration
+	// Assignee reçoit les tickets dont la résolution est en retard ; vide,
+	// l'assignation ne change pas.
+	Assignee string
+}
+
+func New(database *gorm.DB, cfg config.Config) *Scheduler {
+	interval := cfg.EscalationInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return &Scheduler{
+		DB:         database,
+		Interval:   interval,
+		WarnBefore: cfg.EscalationWarning,
+		Assignee:   cfg.EscalationAssignee,
+	}
+}
+
+// Start lance les passages périodiques jusqu'à l'annulation de ctx.
+func (s *Scheduler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		for {
+			if n, err := s.RunOnce(time.Now()); err != nil {
+				log.Println("Escalade :", err)
+			} else if n > 0 {
+				log.Printf("Escalade : %d règle(s) déclenchée(s)", n)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// due renvoie, pour un ticket, les règles applicables à l'instant now et
+// l'échéance à laquelle chacune se rapporte.
+func (s *Scheduler) due(t db.Ticket, now time.Time) map[string]time.Time {
+	out := map[string]time.Time{}
+	if t.FirstResponseAt == nil && t.ResponseDueAt != nil {
+		if !now.Before(*t.ResponseDueAt) {
+			out[RuleResponseBreach] = *t.ResponseDueAt
+		} else if s.WarnBefore > 0 && !now.Before(t.ResponseDueAt.Add(-s.WarnBefore)) {
+			out[RuleResponseWarning] = *t.ResponseDueAt
+		}
+	}
+	if t.ResolutionDueAt != nil {
+		if !now.Before(*t.ResolutionDueAt) {
+			out[RuleResolutionBreach] = *t.ResolutionDueAt
+		} else if s.WarnBefore > 0 && !now.Before(t.ResolutionDueAt.Add(-s.WarnBefore)) {
+			out[RuleResolutionWarning] = *t.ResolutionDueAt
+		}
+	}
+	return out
+}
+
+// notFired exige qu'une règle n'ait pas déjà été déclenchée pour l'échéance
+// actuelle du ticket (colonne col).
+func notFired(rule, col string) string {
+	return "NOT EXISTS (SELECT 1 FROM escalations e WHERE e.ticket_id = tickets.id AND e.deleted_at IS NULL" +
+		" AND e.rule = '" + rule + "' AND e.due_at = tickets." + col + ")"
+}
+
+// candidates charge les tickets ouverts dont au moins une règle est due à now
+// et pas encore déclenchée ; due fait ensuite le détail ticket par ticket.
+func (s *Scheduler) candidates(now time.Time) ([]db.Ticket, error) {
+	soon := now.Add(s.WarnBefore)
+	rules := s.DB.
+		Where("first_response_at IS NULL AND response_due_at <= ? AND "+notFired(RuleResponseBreach, "response_due_at"), now).
+		Or("resolution_due_at <= ? AND "+notFired(RuleResolutionBreach, "resolution_due_at"), now)
+	if s.WarnBefore > 0 {
+		rules = rules.
+			Or("first_response_at IS NULL AND response_due_at > ? AND response_due_at <= ? AND "+notFired(RuleResponseWarning, "response_due_at"), now, soon).
+			Or("resolution_due_at > ? AND resolution_due_at <= ? AND "+notFired(RuleResolutionWarning, "resolution_due_at"), now, soon)
+	}
+
+	// Un ticket jamais fermé a une date de fermeture zéro.
+	var tickets []db.Ticket
+	err := s.DB.Where("closed_at <= ? OR closed_at IS NULL", time.Time{}).Where(rules).Order("id").Find(&tickets).Error
+	return tickets, err
+}
+
+// RunOnce fait un passage et renvoie le nombre de règles déclenchées.
+func (s *Scheduler) RunOnce(now time.Time) (int, error) {
+	tickets, err := s.candidates(now)
+	if err != nil {
+		return 0, err
+	}
+
+	fired := 0
+	for _, t := range tickets {
+		// Ordre fixe : la réponse avant la résolution.
+		rules := s.due(t, now)
+		for _, rule := range []string{RuleResponseWarning, RuleResponseBreach, RuleResolutionWarning, RuleResolutionBreach} {
+			dueAt, ok := rules[rule]
+			if !ok {
+				continue
+			}
+			done, err := s.fire(&t, rule, dueAt)
+			if err != nil {
+				return fired, err
+			}
+			if done {
+				fired++
+			}
+		}
+	}
+	return fired, nil
+}
+
+// fire applique une règle si elle n'a pas déjà été déclenchée pour cette
+// échéance, enregistre le ticket et publie l'événement ticket.escalated dans
+// la même transaction.
+func (s *Scheduler) fire(t *db.Ticket, rule string, dueAt time.Time) (bool, error) {
+	data := map[string]string{"rule": rule, "due_at": dueAt.Format(time.RFC3339)}
+	claimed := false
+
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		ok, err := db.ClaimEscalation(tx, t.ID, rule, dueAt)
+		if err != nil || !ok {
+			return err
+		}
+		claimed = true
+		return db.SaveTicket(tx, t, func(tx *gorm.DB) error {
+			db.LogTicketChange(tx, *t, Actor, "Escalation", "", rule)
+
+			if rule == RuleResponseBreach || rule == RuleResolutionBreach {
+				old := t.Priority
+				raised, err := db.RaisePriority(tx, t, Actor)
+				if err != nil {
+					return err
+				}
+				if raised {
+					data["old_priority"], data["priority"] = old, t.Priority
+				}
+			}
+			if rule == RuleResolutionBreach && s.Assignee != "" && s.reassign(tx, t) {
+				data["assignee"] = s.Assignee
+			}
+			db.Publish(tx, db.Event{Type: db.EventTicketEscalated, Ticket: *t, Actor: Actor, Data: data})
+			return nil
+		})
+	})
+	return claimed && err == nil, err
+}
+
+// reassign confie le ticket à s.Assignee ; un échec est journalisé sans
+// annuler l'escalade.
+func (s *Scheduler) reassign(tx *gorm.DB, t *db.Ticket) bool {
+	var agent db.User
+	if err := tx.Where("username = ?", s.Assignee).First(&agent).Error; err != nil {
+		log.Printf("Escalade : utilisateur %q introuvable pour la réassignation", s.Assignee)
+		return false
+	}
+	if err := db.AssignTicket(tx, t, agent.ID, Actor); err != nil {
+		log.Printf("Escalade : réassignation du ticket %d à %q impossible : %v", t.ID, s.Assignee, err)
+		return false
+	}
+	return true
+}
@@ -1,102 +1,317 @@
 package main
 
 import (
-	"time"
+	"context"
+	"errors"
 	"net/http"
 	"sae/db"
+	"sae/calendar"
+	"sae/config"
+	"sae/inbound"
+	"sae/notify"
+	"sae/scheduler"
+	"sae/storage"
+	"sae/webhook"
+	"sae/workflow"
 	"strconv"
+	"strings"
+	"time"
 	"sae/handle"
-	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 func main() {
+	cfg := config.Load()
+	// Un binaire compilé sans FTS5 (go build sans -tags sqlite_fts5) ne
+	// démarre pas sans le demander : voir le Makefile.
+	if db.SearchEngine != cfg.SearchEngine {
+		panic("Recherche : moteur " + db.SearchEngine + " compilé, " + cfg.SearchEngine + " attendu (compiler avec make build, ou GTM_SEARCH=like)")
+	}
+
 	database, err := db.InitDB()
 	if err != nil {
-		panic("Impossible de se connecter à la DB")
+		panic("Impossible de se connecter à la DB : " + err.Error())
 	}
 	database.AutoMigrate(&db.User{}, &db.Ticket{})
 
+	wf, err := workflow.Load(cfg.WorkflowFile)
+	if err != nil {
+		panic("Workflow des tickets : " + err.Error())
+	}
+	cals, err := calendar.Load(cfg.CalendarFile)
+	if err != nil {
+		panic("Calendriers d'heures ouvrées : " + err.Error())
+	}
+	blobs, err := storage.New(cfg)
+	if err != nil {
+		panic("Stockage des pièces jointes : " + err.Error())
+	}
+	passkeys, err := handle.NewWebAuthn(cfg)
+	if err != nil {
+		panic("Passkeys : " + err.Error())
+	}
+
+	if cfg.SMTPAddr != "" {
+		notifier, err := notify.New(database, cfg)
+		if err != nil {
+			panic("Notifications : " + err.Error())
+		}
+		notifier.Subscribe()
+		notifier.Start(context.Background())
+	}
+	hooks := webhook.New(database, cfg)
+	hooks.Subscribe()
+	hooks.Start(context.Background())
+
+	if cfg.Maildir != "" {
+		poller := &inbound.Poller{
+			DB:        database,
+			Store:     blobs,
+			Config:    cfg,
+			Workflow:  wf,
+			Calendars: cals,
+			Dir:       cfg.Maildir,
+			Interval:  cfg.MaildirInterval,
+		}
+		if poller.Interval <= 0 {
+			poller.Interval = 30 * time.Second
+		}
+		poller.Start(context.Background())
+	}
+	if cfg.Scheduler {
+		scheduler.New(database, cfg).Start(context.Background())
+	}
+
 	router := gin.Default()
 
-	store := cookie.NewStore([]byte("dihosvsdvibvioboaifbvoidsbvb123123DSFQSCQ45"))
-	router.Use(sessions.Sessions("session", store))
 	router.SetTrustedProxies(nil)
 	router.LoadHTMLGlob("templates/*")
 	router.Static("/static", "./static")
 
 	router.Use(func(c *gin.Context) {
 		c.Set("db", database) 
+		c.Set("config", cfg)
+		c.Set("storage", blobs)
+		c.Set("workflow", wf)
+		c.Set("calendars", cals)
+		c.Set("webauthn", passkeys)
 		c.Next()
 	})
 
-	authRequired := func(c *gin.Context) {
-		session := sessions.Default(c)
-		user := session.Get("user")
-		if user == nil {
-			c.Redirect(http.StatusFound, "/")
-			c.Abort()
-			return
+	// identify renseigne l'utilisateur courant dans le contexte, à partir d'un
+	// jeton "Authorization: Bearer" ou, à défaut, du cookie de session. La
+	// session, l'utilisateur, son rôle et ses permissions sont relus à chaque
+	// requête : une session révoquée, un utilisateur supprimé ou une
+	// modification faite dans /admin s'appliquent sans attendre l'expiration
+	// du cookie.
+	identify := func(c *gin.Context) bool {
+		var user db.User
+		if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			token, u, err := db.LookupAPIToken(database, strings.TrimPrefix(header, "Bearer "))
+			if err != nil {
+				return false
+			}
+			user = u
+			c.Set("token", token)
+		} else {
+			// Une session en attente de seconde étape n'ouvre que /login/2fa,
+			// et le rôle peut imposer la double authentification après coup.
+			session, u, ok := handle.LookupSession(c, database)
+			if !ok || session.Stage != "" {
+				return false
+			}
+			if !u.TOTPEnabled && db.TOTPRequired(database, u) && !db.HasSecondFactor(database, u) {
+				return false
+			}
+			user = u
+			c.Set("session", session)
 		}
-		c.Next()
+
+		perms, err := db.RolePermissions(database, user.Role)
+		if err != nil {
+			return false
+		}
+		c.Set("user", user.Username)
+		c.Set("role", user.Role)
+		c.Set("permissions", perms)
+		return true
+	}
+
+	// tokenAllows est toujours vrai pour une session navigateur : les portées
+	// ne restreignent que les jetons d'API.
+	tokenAllows := func(c *gin.Context, scope string) bool {
+		v, ok := c.Get("token")
+		if !ok {
+			return true
+		}
+		return v.(db.APIToken).HasScope(scope)
+	}
+
+	ticketScope := func(c *gin.Context) string {
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			return db.ScopeTicketsRead
+		}
+		return db.ScopeTicketsWrite
 	}
 
-	adminRequired := func(c *gin.Context) {
-		session := sessions.Default(c)
-		user := session.Get("user")
-		if user == nil {
+	authRequired := func(c *gin.Context) {
+		if !identify(c) {
 			c.Redirect(http.StatusFound, "/")
 			c.Abort()
 			return
 		}
-
-		roleInterface := session.Get("role")
-		role, ok := roleInterface.(string)
-		if !ok || role != "Admin" {
-			c.String(http.StatusForbidden, "User is not an admin")
+		if !tokenAllows(c, ticketScope(c)) {
+			c.String(http.StatusForbidden, "Missing scope "+ticketScope(c))
 			c.Abort()
 			return
 		}
 		c.Next()
 	}
 
-	supervisororadminRequired := func(c *gin.Context) {
-		session := sessions.Default(c)
-		user := session.Get("user")
-		if user == nil {
-			c.Redirect(http.StatusFound, "/")
-			c.Abort()
+	// Variante JSON d'authRequired pour /api : pas de redirection vers le formulaire.
+	apiAuthRequired := func(c *gin.Context) {
+		if !identify(c) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
 			return
 		}
+		c.Next()
+	}
+
+	scopeRequired := func(scope string) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			if !tokenAllows(c, scope) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "missing scope " + scope})
+				return
+			}
+			c.Next()
+		}
+	}
 
-		roleInterface := session.Get("role")
-		role, ok := roleInterface.(string)
-		if !ok || (role != "Supervisor" && role != "Admin") {
-			c.String(http.StatusForbidden, "User is not a supervisor or an admin")
+	// Les pages de gestion des jetons ne sont pas accessibles avec un jeton.
+	sessionOnly := func(c *gin.Context) {
+		if _, ok := c.Get("token"); ok {
+			c.String(http.StatusForbidden, "Session required")
 			c.Abort()
 			return
-		} 
+		}
 		c.Next()
 	}
 
-	router.GET("/admin", authRequired, adminRequired, func(c *gin.Context) {
-		var users []db.User
-		var tickets []db.Ticket
+	// permissionRequired est le contrôle d'accès des routes : le rôle de
+	// l'utilisateur doit accorder perm et, pour un jeton d'API, le jeton
+	// porter la portée associée (voir db.Permissions). Sous /api, les refus
+	// sont en JSON.
+	permissionRequired := func(perm string) gin.HandlerFunc {
+		p, ok := db.LookupPermission(perm)
+		if !ok {
+			panic("Permission inconnue : " + perm)
+		}
+		return func(c *gin.Context) {
+			api := strings.HasPrefix(c.Request.URL.Path, "/api/")
+			if c.GetString("user") == "" && !identify(c) {
+				if api {
+					c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+				} else {
+					c.Redirect(http.StatusFound, "/")
+					c.Abort()
+				}
+				return
+			}
+
+			if !handle.Can(c, perm) {
+				if api {
+					c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden", "details": "missing permission " + perm})
+				} else {
+					c.String(http.StatusForbidden, "Permission manquante : "+perm)
+					c.Abort()
+				}
+				return
+			}
+			if p.Scope != "" && !tokenAllows(c, p.Scope) {
+				if api {
+					c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "missing scope " + p.Scope})
+				} else {
+					c.String(http.StatusForbidden, "Missing scope "+p.Scope)
+					c.Abort()
+				}
+				return
+			}
+			c.Next()
+		}
+	}
 
+	router.GET("/admin", authRequired, permissionRequired(db.PermAdminAccess), func(c *gin.Context) {
+		var users []db.User
 		database.Find(&users)
-		database.Find(&tickets)
 
-		c.HTML(http.StatusOK, "admin.html", gin.H{
-			"users":   users,
-			"tickets": tickets,
-		})
+		data, ok := handle.TicketListing(c, nil)
+		if !ok {
+			return
+		}
+		tickets := data["tickets"].([]db.Ticket)
+		agents, _ := db.Agents(database)
+		policies, _ := db.SLAPolicies(database)
+
+		var webhooks []db.Webhook
+		var deliveries []db.WebhookDelivery
+		database.Order("id").Find(&webhooks)
+		database.Preload("Webhook", func(q *gorm.DB) *gorm.DB { return q.Unscoped() }).
+			Order("id desc").Limit(50).Find(&deliveries)
+
+		data["users"] = users
+		data["sessionCounts"], _ = db.SessionCounts(database)
+		data["passkeyCounts"], _ = db.PasskeyCounts(database)
+		data["agents"] = agents
+		data["states"] = handle.StateChoices(wf, c.GetString("role"), tickets)
+		data["slaPolicies"] = policies
+		data["calendars"] = cals.Names()
+		data["webhooks"] = webhooks
+		data["deliveries"] = deliveries
+		data["hookEvents"] = db.WebhookEvents
+		data["fieldTypes"] = db.FieldTypes
+		roles, _ := db.Roles(database)
+		manageable := map[string]bool{}
+		for _, r := range roles {
+			manageable[r.Name] = db.CanAssignRole(database, c.GetString("role"), r.Name)
+		}
+		data["roles"] = roles
+		data["manageable"] = manageable
+		data["permissions"] = db.Permissions
+		data["perms"], _ = c.Get("permissions")
+		c.HTML(http.StatusOK, "admin.html", data)
 	})
 
-	router.POST("/admin/user/add", authRequired, adminRequired, func(c *gin.Context) {
+	router.POST("/admin/sla", authRequired, permissionRequired(db.PermSLAManage), handle.AdminUpdateSLA)
+	router.POST("/admin/webhooks", authRequired, permissionRequired(db.PermWebhookManage), handle.AdminCreateWebhook)
+	router.POST("/admin/webhooks/:id/toggle", authRequired, permissionRequired(db.PermWebhookManage), handle.AdminToggleWebhook)
+	router.POST("/admin/webhooks/:id/delete", authRequired, permissionRequired(db.PermWebhookManage), handle.AdminDeleteWebhook)
+	router.POST("/admin/webhooks/deliveries/:id/retry", authRequired, permissionRequired(db.PermWebhookManage), handle.AdminRetryDelivery)
+	router.POST("/admin/labels", authRequired, permissionRequired(db.PermLabelManage), handle.AdminCreateLabel)
+	router.POST("/admin/labels/:id/edit", authRequired, permissionRequired(db.PermLabelManage), handle.AdminUpdateLabel)
+	router.POST("/admin/labels/:id/delete", authRequired, permissionRequired(db.PermLabelManage), handle.AdminDeleteLabel)
+	router.POST("/admin/queues", authRequired, permissionRequired(db.PermQueueManage), handle.AdminCreateQueue)
+	router.POST("/admin/queues/:id/edit", authRequired, permissionRequired(db.PermQueueManage), handle.AdminUpdateQueue)
+	router.POST("/admin/queues/:id/delete", authRequired, permissionRequired(db.PermQueueManage), handle.AdminDeleteQueue)
+	router.POST("/admin/fields", authRequired, permissionRequired(db.PermFieldManage), handle.AdminCreateField)
+	router.POST("/admin/fields/:id/edit", authRequired, permissionRequired(db.PermFieldManage), handle.AdminUpdateField)
+	router.POST("/admin/fields/:id/delete", authRequired, permissionRequired(db.PermFieldManage), handle.AdminDeleteField)
+	router.POST("/admin/roles", authRequired, permissionRequired(db.PermRoleManage), handle.AdminCreateRole)
+	router.POST("/admin/roles/:id/edit", authRequired, permissionRequired(db.PermRoleManage), handle.AdminUpdateRole)
+	router.POST("/admin/roles/:id/delete", authRequired, permissionRequired(db.PermRoleManage), handle.AdminDeleteRole)
+
+	router.POST("/admin/user/add", authRequired, permissionRequired(db.PermUserManage), func(c *gin.Context) {
 		username := c.PostForm("username")
 		password := c.PostForm("password")
 		role := c.PostForm("role")
+		if !db.IsRole(database, role) {
+			c.String(http.StatusBadRequest, "Rôle inconnu")
+			return
+		}
+		if !db.CanAssignRole(database, c.GetString("role"), role) {
+			c.String(http.StatusForbidden, "Ce rôle a des permissions que vous n'avez pas")
+			return
+		}
 
 		user := db.User{
 			Username: username,
@@ -107,7 +322,7 @@ func main() {
 		c.Redirect(http.StatusFound, "/admin")
 	})
 
-	router.POST("/admin/user/edit/:id", authRequired, adminRequired, func(c *gin.Context) {
+	router.POST("/admin/user/edit/:id", authRequired, permissionRequired(db.PermUserManage), func(c *gin.Context) {
 		id, _ := strconv.Atoi(c.Param("id"))
 		username := c.PostForm("username")
 		password := c.PostForm("password")
@@ -118,41 +333,108 @@ func main() {
 			c.String(http.StatusNotFound, "Utilisateur introuvable")
 			return
 		}
+		if !db.IsRole(database, role) {
+			c.String(http.StatusBadRequest, "Rôle inconnu")
+			return
+		}
+		// Ni promotion au-delà de ses propres permissions, ni modification
+		// (mot de passe compris) d'un compte plus privilégié.
+		if !db.CanAssignRole(database, c.GetString("role"), user.Role) || !db.CanAssignRole(database, c.GetString("role"), role) {
+			c.String(http.StatusForbidden, "Ce rôle a des permissions que vous n'avez pas")
+			return
+		}
+		if user.Role == db.RoleAdmin && role != db.RoleAdmin && db.LastAdmin(database, user) {
+			c.String(http.StatusBadRequest, "Impossible de retirer le rôle du dernier Admin")
+			return
+		}
 
 		user.Username = username
 		user.Role = role
 		if password != "" {
+			// Un nouveau mot de passe lève aussi le verrouillage de /login.
 			user.Password = db.HashPassword(password)
+			user.FailedLogins, user.LockedUntil = 0, time.Time{}
 		}
 
 		database.Save(&user)
+		if password != "" {
+			db.RevokeUserSessions(database, user.ID, 0)
+		}
 		c.Redirect(http.StatusFound, "/admin")
 	})
 
-	router.POST("/admin/user/delete/:id", authRequired, adminRequired, func(c *gin.Context) {
+	router.POST("/admin/user/delete/:id", authRequired, permissionRequired(db.PermUserManage), func(c *gin.Context) {
 		id, _ := strconv.Atoi(c.Param("id"))
-		database.Delete(&db.User{}, id)
+		var user db.User
+		if err := database.First(&user, id).Error; err == nil && user.Role == db.RoleAdmin && db.LastAdmin(database, user) {
+			c.String(http.StatusBadRequest, "Impossible de supprimer le dernier Admin")
+			return
+		}
+		if user.ID != 0 && !db.CanAssignRole(database, c.GetString("role"), user.Role) {
+			c.String(http.StatusForbidden, "Ce rôle a des permissions que vous n'avez pas")
+			return
+		}
+		if err := db.DeleteUser(database, uint(id)); err != nil {
+			c.String(http.StatusInternalServerError, "Échec suppression")
+			return
+		}
 		c.Redirect(http.StatusFound, "/admin")
 	})
 
-	router.POST("/admin/ticket/add", authRequired, adminRequired, func(c *gin.Context) {
+	router.POST("/admin/user/logout/:id", authRequired, permissionRequired(db.PermUserManage), handle.AdminRevokeUserSessions)
+	router.POST("/admin/user/reset-2fa/:id", authRequired, permissionRequired(db.PermUserManage), handle.AdminResetSecondFactor)
+
+	router.POST("/admin/ticket/add", authRequired, permissionRequired(db.PermTicketEdit), func(c *gin.Context) {
 		title := c.PostForm("title")
 		description := c.PostForm("description")
 		user := c.PostForm("user")
 		priority := c.PostForm("priority")
 
+		labels, err := handle.FormLabels(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Étiquette inconnue")
+			return
+		}
+		queue, err := handle.FormQueue(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, "File inconnue")
+			return
+		}
+
 		ticket := db.Ticket{
 			Title:       title,
 			Description: description,
 			User:        user,
-			State:       "open",
+			State:       wf.Initial,
 			Priority:    priority,
+			Labels:      labels,
+		}
+		if queue != nil {
+			ticket.QueueID = &queue.ID
+		}
+		values, err := handle.FormFieldValues(c, ticket.QueueID)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Ticket invalide : "+err.Error())
+			return
+		}
+		err = database.Transaction(func(tx *gorm.DB) error {
+			if err := db.CreateTicket(tx, cals, &ticket); err != nil {
+				return err
+			}
+			return db.InitTicketFields(tx, ticket.ID, values)
+		})
+		if errors.Is(err, db.ErrInvalidPriority) {
+			c.String(http.StatusBadRequest, "Ticket invalide : "+err.Error())
+			return
+		}
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Échec enregistrement du ticket")
+			return
 		}
-		database.Create(&ticket)
 		c.Redirect(http.StatusFound, "/admin")
 	})
 
-	router.POST("/admin/ticket/edit/:id", authRequired, adminRequired, func(c *gin.Context) {
+	router.POST("/admin/ticket/edit/:id", authRequired, permissionRequired(db.PermTicketEdit), func(c *gin.Context) {
 		id, _ := strconv.Atoi(c.Param("id"))
 		title := c.PostForm("title")
 		description := c.PostForm("description")
@@ -160,52 +442,65 @@ func main() {
 		state := c.PostForm("state")
 
 		var ticket db.Ticket
-		if err := database.First(&ticket, id).Error; err != nil {
+		if err := database.First(&ticket, id).Error; err != nil || !handle.CanSeeTicket(c, ticket) {
 			c.String(http.StatusNotFound, "Ticket introuvable")
 			return
 		}
 
-		session := sessions.Default(c)
-		currentUser := session.Get("user").(string)
+		currentUser := c.GetString("user")
 
-		if ticket.Title != title {
-			db.LogTicketChange(database, ticket, currentUser, "Title", ticket.Title, title)
-		}
-		if ticket.Description != description {
-			db.LogTicketChange(database, ticket, currentUser, "Description", ticket.Description, description)
-		}
-		if ticket.Priority != priority {
-			db.LogTicketChange(database, ticket, currentUser, "Priority", ticket.Priority, priority)
-		}
-		if ticket.State != state {
-			db.LogTicketChange(database, ticket, currentUser, "State", ticket.State, state)
+		// Priorité vide : inchangée (les anciens tickets n'en ont pas).
+		if priority == "" {
+			priority = ticket.Priority
+		} else if !db.IsPriority(priority) {
+			c.String(http.StatusBadRequest, "Priorité invalide")
+			return
 		}
 
-		ticket.Title = title
-		ticket.Description = description
-		ticket.Priority = priority
-		ticket.State = state
-
-		if state == "closed" {
-			ticket.ClosedAt = time.Now()
-		} else {
-			ticket.ClosedAt = time.Time{}
+		labels, err := handle.FormLabels(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Étiquette inconnue")
+			return
 		}
 
-		database.Save(&ticket)
+		err = db.SaveTicket(database, &ticket, func(tx *gorm.DB) error {
+			fields := map[string]string{"resolution": c.PostForm("resolution")}
+			if err := db.ChangeTicketState(tx, wf, &ticket, state, c.GetString("role"), currentUser, fields); err != nil {
+				return err
+			}
+			if ticket.Title != title {
+				db.LogTicketChange(tx, ticket, currentUser, "Title", ticket.Title, title)
+				ticket.Title = title
+			}
+			if ticket.Description != description {
+				db.LogTicketChange(tx, ticket, currentUser, "Description", ticket.Description, description)
+				ticket.Description = description
+			}
+			if err := db.SetTicketPriority(tx, cals, &ticket, priority, currentUser); err != nil {
+				return err
+			}
+			return db.SetTicketLabels(tx, &ticket, labels, currentUser)
+		})
+		if !handle.TicketSaved(c, err) {
+			return
+		}
 		c.Redirect(http.StatusFound, "/admin")
 	})
 
-	router.POST("/admin/ticket/delete/:id", authRequired, adminRequired, func(c *gin.Context) {
+	router.POST("/admin/ticket/assign/:id", authRequired, permissionRequired(db.PermTicketAssign), handle.AssignTicket("/admin"))
+	router.POST("/admin/ticket/queue/:id", authRequired, permissionRequired(db.PermTicketEdit), handle.AdminMoveTicket)
+
+	router.POST("/admin/ticket/delete/:id", authRequired, permissionRequired(db.PermTicketDeleteAny), func(c *gin.Context) {
 		id, _ := strconv.Atoi(c.Param("id"))
-		database.Delete(&db.Ticket{}, id)
+		var ticket db.Ticket
+		if err := database.First(&ticket, id).Error; err == nil && handle.CanSeeTicket(c, ticket) {
+			db.DeleteTicket(database, ticket, c.GetString("user"))
+		}
 		c.Redirect(http.StatusFound, "/admin")
 	})
 
 	router.GET("/ticket/history/:id", authRequired, func(c *gin.Context) {
 		ticketID, _ := strconv.Atoi(c.Param("id"))
-		session := sessions.Default(c)
-		currentUser := session.Get("user").(string)
 
 		var ticket db.Ticket
 		if err := database.First(&ticket, ticketID).Error; err != nil {
@@ -213,25 +508,31 @@ func main() {
 			return
 		}
 
-		var user db.User
-		if err := database.Where("username = ?", currentUser).First(&user).Error; err != nil {
-			c.String(http.StatusInternalServerError, "Utilisateur introuvable")
-			return
-		}
-
-		if user.Role != "admin" && ticket.User != currentUser {
+		if !handle.CanSeeTicket(c, ticket) {
 			c.String(http.StatusForbidden, "Vous n'avez pas le droit de voir cet historique")
 			return
 		}
 
 		var history []db.TicketHistory
-		database.Where("ticket_id = ?", ticketID).Order("changed_at desc").Find(&history)
+		q := database.Where("ticket_id = ?", ticketID)
+		if !handle.Can(c, db.PermTicketInternal) {
+			q = q.Where("changed_field <> ?", db.HistoryInternalNote)
+		}
+		q.Order("changed_at desc").Find(&history)
 
 		c.HTML(http.StatusOK, "ticket_history.html", gin.H{
 			"history": history,
 		})
 	})
 
+	router.GET("/ticket/:id", authRequired, handle.TicketPage)
+	router.GET("/search", authRequired, handle.SearchPage)
+	router.POST("/ticket/:id/comments", authRequired, handle.LimitUploads, handle.TicketPostComment)
+	router.POST("/ticket/:id/fields", authRequired, permissionRequired(db.PermTicketUpdateFields), handle.TicketUpdateFields)
+	router.POST("/ticket/:id/attachments", authRequired, handle.LimitUploads, handle.TicketUploadAttachments)
+	router.GET("/attachments/:id", authRequired, handle.DownloadAttachment)
+	router.POST("/attachments/:id/delete", authRequired, handle.DeleteAttachment)
+
 	router.GET("/", func(c *gin.Context) {
 		success := c.Query("success")
 		c.HTML(http.StatusOK, "login.html", gin.H{
@@ -254,10 +555,25 @@ func main() {
 			return
 		}
 
+		email, err := db.NormalizeEmail(c.PostForm("email"))
+		if err != nil {
+			c.HTML(http.StatusBadRequest, "register.html", gin.H{
+				"error": "Adresse e-mail invalide",
+			})
+			return
+		}
+		if db.EmailTaken(database, email, 0) {
+			c.HTML(http.StatusBadRequest, "register.html", gin.H{
+				"error": "Adresse e-mail déjà utilisée",
+			})
+			return
+		}
+
 		user := db.User{
 			Username: username,
 			Password: db.HashPassword(password),
-			Role:     "Client",
+			Role:     db.RoleClient,
+			Email:    email,
 		}
 
 		if err := database.Create(&user).Error; err != nil {
@@ -282,43 +598,57 @@ func main() {
 			return
 		}
 
+		// Compte verrouillé : le mot de passe n'est même pas vérifié.
+		if db.LoginLocked(user, time.Now()) {
+			c.HTML(http.StatusTooManyRequests, "auth.html", gin.H{
+				"error": "Trop d'échecs de connexion : compte verrouillé temporairement, réessayez plus tard",
+			})
+			return
+		}
+
 		if !db.CheckPassword(user.Password, password) {
+			db.FailLogin(database, &user, time.Now())
 			c.HTML(http.StatusUnauthorized, "auth.html", gin.H{
 				"error": "Nom d'utilisateur ou mot de passe incorrect",
 			})
 			return
 		}
 
-		session := sessions.Default(c)
-		session.Set("user", user.Username)
-		session.Set("role", user.Role)
-		session.Set("token", db.HashPassword(user.Password))
-		session.Save()
+		// Avec la double authentification, le mot de passe n'ouvre qu'une
+		// session en attente du code (voir handle.LoginTOTP) ; le compteur
+		// d'échecs n'est remis à zéro qu'une fois le second facteur vérifié.
+		stage := ""
+		if db.HasSecondFactor(database, user) {
+			stage = db.SessionSecondFactor
+		} else if db.TOTPRequired(database, user) {
+			stage = db.SessionEnroll
+		} else {
+			db.ResetLoginFailures(database, &user)
+		}
+		if err := handle.StartSession(c, database, user, stage); err != nil {
+			c.HTML(http.StatusInternalServerError, "auth.html", gin.H{
+				"error": "Impossible d'ouvrir la session",
+			})
+			return
+		}
+		if stage != "" {
+			c.Redirect(http.StatusFound, "/login/2fa")
+			return
+		}
 
 		c.Redirect(http.StatusFound, "/home")
 	})
 
-	router.GET("/form", authRequired, func(c *gin.Context) {
-		c.HTML(http.StatusOK, "form.html", nil)
-	})
-
-	router.POST("/form", authRequired, func(c *gin.Context) {
-		session := sessions.Default(c)
-		username := session.Get("user").(string)
-
-		title := c.PostForm("title")
-		description := c.PostForm("description")
+	router.GET("/login/2fa", handle.LoginTOTPPage)
+	router.POST("/login/2fa", handle.LoginTOTP)
+	router.POST("/login/2fa/passkey/begin", handle.PasskeySecondFactorBegin)
+	router.POST("/login/2fa/passkey/finish", handle.PasskeySecondFactorFinish)
+	router.POST("/login/passkey/begin", handle.PasskeyLoginBegin)
+	router.POST("/login/passkey/finish", handle.PasskeyLoginFinish)
 
-		ticket := db.Ticket{
-			Title:       title,
-			Description: description,
-			User:        username,
-			State:       "open",
-		}
+	router.GET("/form", authRequired, permissionRequired(db.PermTicketCreate), handle.TicketForm)
 
-		database.Create(&ticket)
-		c.Redirect(http.StatusFound, "/tickets")
-	})
+	router.POST("/form", authRequired, permissionRequired(db.PermTicketCreate), handle.LimitUploads, handle.TicketCreate)
 
 	router.GET("/home", func(c *gin.Context) {
 		c.HTML(http.StatusOK, "home.html", nil)
@@ -328,149 +658,178 @@ func main() {
 		c.HTML(http.StatusOK, "login.html", nil)
 	})
 
+	// Filtres, tri et pagination : voir db.TicketFilter.
 	router.GET("/tickets", authRequired, func(c *gin.Context) {
-		var tickets []db.Ticket
-		session := sessions.Default(c)
-		username := session.Get("user").(string)
-
-		if err := database.Where("user = ?", username).Find(&tickets).Error; err != nil {
-			c.HTML(http.StatusInternalServerError, "tickets.html", gin.H{
-				"error": "Impossible de récupérer les tickets",
-			})
+		username := c.GetString("user")
+		data, ok := handle.TicketListing(c, func(f *db.TicketFilter) { f.User = username })
+		if !ok {
 			return
 		}
-
-		c.HTML(http.StatusOK, "tickets.html", gin.H{
-			"tickets": tickets,
-		})
+		c.HTML(http.StatusOK, "tickets.html", data)
 	})
 
+	// Sans la permission ticket.delete.any, on ne supprime que ses propres tickets.
 	router.POST("/tickets/delete/:id", authRequired, func(c *gin.Context) {
 		id, _ := strconv.Atoi(c.Param("id"))
-		database.Delete(&db.Ticket{}, id)
+		var ticket db.Ticket
+		if err := database.First(&ticket, id).Error; err != nil {
+			c.String(http.StatusNotFound, "Ticket introuvable")
+			return
+		}
+		if ticket.User != c.GetString("user") && !(handle.Can(c, db.PermTicketDeleteAny) && handle.CanSeeTicket(c, ticket)) {
+			c.String(http.StatusForbidden, "Vous ne pouvez supprimer que vos propres tickets")
+			return
+		}
+		db.DeleteTicket(database, ticket, c.GetString("user"))
 		c.Redirect(http.StatusFound, "/tickets")
 	})
 
-grp := router.Group("/supervisor", authRequired, supervisororadminRequired)
+grp := router.Group("/supervisor", authRequired, permissionRequired(db.PermTicketReadAny))
 {
     grp.GET("", func(c *gin.Context) {
-        var tickets []db.Ticket
-        if err := database.Find(&tickets).Error; err != nil {
-            c.String(http.StatusInternalServerError, "Erreur chargement tickets")
+        data, ok := handle.TicketListing(c, nil)
+        if !ok {
             return
         }
-        c.HTML(http.StatusOK, "tickets.html", gin.H{
-            "tickets":      tickets,
-            "isSupervisor": true,
-        })
+        tickets := data["tickets"].([]db.Ticket)
+        data["agents"], _ = db.Agents(database)
+        data["states"] = handle.StateChoices(wf, c.GetString("role"), tickets)
+        data["isSupervisor"] = true
+        data["pinnedViews"] = handle.PinnedViewCounts(c)
+        data["activeView"] = c.Query("view")
+        c.HTML(http.StatusOK, "tickets.html", data)
     })
 
+    grp.GET("/assigned", handle.AssignedTickets)
+    grp.GET("/views", handle.ViewsPage)
+    grp.POST("/views", handle.CreateView)
+    grp.GET("/views/counts", handle.ViewCounts)
+    grp.GET("/views/:id", handle.OpenView)
+    grp.POST("/views/:id/pin", handle.ToggleViewPin)
+    grp.POST("/views/:id/delete", handle.DeleteView)
+    grp.POST("/ticket/:id/assign", permissionRequired(db.PermTicketAssign), handle.AssignTicket("/supervisor"))
+    grp.POST("/ticket/:id/labels", permissionRequired(db.PermTicketUpdateLabels), handle.TicketLabels("/supervisor"))
+
     grp.POST("/ticket/update", func(c *gin.Context) {
         id, err := strconv.Atoi(c.PostForm("id"))
         if err != nil { c.String(http.StatusBadRequest, "ID invalide"); return }
 
         var ticket db.Ticket
-        if err := database.First(&ticket, id).Error; err != nil {
+        if err := database.First(&ticket, id).Error; err != nil || !handle.CanSeeTicket(c, ticket) {
             c.String(http.StatusNotFound, "Ticket introuvable"); return
         }
 
-        if v := c.PostForm("state"); v != "" {
-            allowed := map[string]bool{"open": true, "in_progress": true, "closed": true}
-            if !allowed[v] { c.String(http.StatusBadRequest, "État invalide"); return }
-            if ticket.State != v {
-                session := sessions.Default(c)
-                currentUser, _ := session.Get("user").(string)
-                db.LogTicketChange(database, ticket, currentUser, "State", ticket.State, v)
-            }
-            ticket.State = v
+        state, priority := c.PostForm("state"), c.PostForm("priority")
+        if state != "" && !handle.Can(c, db.PermTicketUpdateState) {
+            c.String(http.StatusForbidden, "Permission manquante : "+db.PermTicketUpdateState); return
         }
-
-        if v := c.PostForm("priority"); v != "" {
-            allowed := map[string]bool{"low": true, "medium": true, "high": true, "urgent": true}
-            if !allowed[v] { c.String(http.StatusBadRequest, "Priorité invalide"); return }
-            if ticket.Priority != v {
-                session := sessions.Default(c)
-                currentUser, _ := session.Get("user").(string)
-                db.LogTicketChange(database, ticket, currentUser, "Priority", ticket.Priority, v)
-            }
-            ticket.Priority = v
+        if priority != "" && !handle.Can(c, db.PermTicketUpdatePriority) {
+            c.String(http.StatusForbidden, "Permission manquante : "+db.PermTicketUpdatePriority); return
         }
-
-        if err := database.Save(&ticket).Error; err != nil {
-            c.String(http.StatusInternalServerError, "Échec mise à jour"); return
+        if priority != "" && !db.IsPriority(priority) {
+            c.String(http.StatusBadRequest, "Priorité invalide"); return
         }
+
+        // Tout ou rien : une priorité refusée n'enregistre pas le changement d'état.
+        err = db.SaveTicket(database, &ticket, func(tx *gorm.DB) error {
+            if state != "" {
+                fields := map[string]string{"resolution": c.PostForm("resolution")}
+                if err := db.ChangeTicketState(tx, wf, &ticket, state, c.GetString("role"), c.GetString("user"), fields); err != nil {
+                    return err
+                }
+            }
+            if priority != "" {
+                return db.SetTicketPriority(tx, cals, &ticket, priority, c.GetString("user"))
+            }
+            return nil
+        })
+        if !handle.TicketSaved(c, err) { return }
         c.Redirect(http.StatusSeeOther, "/supervisor")
     })
 
-    grp.POST("/ticket/:id/state", func(c *gin.Context) {
+    grp.POST("/ticket/:id/state", permissionRequired(db.PermTicketUpdateState), func(c *gin.Context) {
         id, err := strconv.Atoi(c.Param("id"))
         if err != nil { c.String(http.StatusBadRequest, "ID invalide"); return }
 
         var ticket db.Ticket
-        if err := database.First(&ticket, id).Error; err != nil {
+        if err := database.First(&ticket, id).Error; err != nil || !handle.CanSeeTicket(c, ticket) {
             c.String(http.StatusNotFound, "Ticket introuvable"); return
         }
 
-        v := c.PostForm("state")
-        allowed := map[string]bool{"open": true, "in_progress": true, "closed": true}
-        if !allowed[v] { c.String(http.StatusBadRequest, "État invalide"); return }
-
-        if ticket.State != v {
-            session := sessions.Default(c)
-            currentUser, _ := session.Get("user").(string)
-            db.LogTicketChange(database, ticket, currentUser, "State", ticket.State, v)
-        }
-        ticket.State = v
-
-        if err := database.Save(&ticket).Error; err != nil {
-            c.String(http.StatusInternalServerError, "Échec mise à jour"); return
-        }
+        err = db.SaveTicket(database, &ticket, func(tx *gorm.DB) error {
+            fields := map[string]string{"resolution": c.PostForm("resolution")}
+            return db.ChangeTicketState(tx, wf, &ticket, c.PostForm("state"), c.GetString("role"), c.GetString("user"), fields)
+        })
+        if !handle.TicketSaved(c, err) { return }
         c.Redirect(http.StatusSeeOther, "/supervisor")
     })
 
-    grp.POST("/ticket/:id/priority", func(c *gin.Context) {
+    grp.POST("/ticket/:id/priority", permissionRequired(db.PermTicketUpdatePriority), func(c *gin.Context) {
         id, err := strconv.Atoi(c.Param("id"))
         if err != nil { c.String(http.StatusBadRequest, "ID invalide"); return }
 
         var ticket db.Ticket
-        if err := database.First(&ticket, id).Error; err != nil {
+        if err := database.First(&ticket, id).Error; err != nil || !handle.CanSeeTicket(c, ticket) {
             c.String(http.StatusNotFound, "Ticket introuvable"); return
         }
 
-        v := c.PostForm("priority")
-        allowed := map[string]bool{"low": true, "medium": true, "high": true, "urgent": true}
-        if !allowed[v] { c.String(http.StatusBadRequest, "Priorité invalide"); return }
-
-        if ticket.Priority != v {
-            session := sessions.Default(c)
-            currentUser, _ := session.Get("user").(string)
-            db.LogTicketChange(database, ticket, currentUser, "Priority", ticket.Priority, v)
-        }
-        ticket.Priority = v
-
-        if err := database.Save(&ticket).Error; err != nil {
-            c.String(http.StatusInternalServerError, "Échec mise à jour"); return
-        }
+        err = db.SaveTicket(database, &ticket, func(tx *gorm.DB) error {
+            return db.SetTicketPriority(tx, cals, &ticket, c.PostForm("priority"), c.GetString("user"))
+        })
+        if !handle.TicketSaved(c, err) { return }
         c.Redirect(http.StatusSeeOther, "/supervisor")
     })
 }
 
 router.GET("/logout", func(c *gin.Context) {
-	session := sessions.Default(c)
-	session.Clear()
-	session.Save()
+	handle.EndSession(c, database)
 	c.Redirect(http.StatusFound, "/")
 })
 
-router.GET("/stats", authRequired, adminRequired, handle.StatsPage)
+router.GET("/stats", authRequired, permissionRequired(db.PermStatsView), handle.StatsPage)
 
-api := router.Group("/api/stats")
+api := router.Group("/api/stats", apiAuthRequired, permissionRequired(db.PermStatsView))
 {
     api.GET("/summary", handle.StatsSummary)
     api.GET("/time", handle.StatsTimeSeries)
     api.GET("/by-user", handle.StatsByUser)
+    api.GET("/sla", handle.StatsSLA)
 }
 
+v1 := router.Group("/api/v1", apiAuthRequired)
+{
+    read := scopeRequired(db.ScopeTicketsRead)
+    write := scopeRequired(db.ScopeTicketsWrite)
+
+    v1.GET("/tickets", read, handle.APIListTickets)
+    v1.POST("/tickets", write, permissionRequired(db.PermTicketCreate), handle.APICreateTicket)
+    v1.GET("/tickets/:id", read, handle.APIGetTicket)
+    v1.PATCH("/tickets/:id", write, handle.APIUpdateTicket)
+    v1.DELETE("/tickets/:id", write, handle.APIDeleteTicket)
+    v1.GET("/tickets/:id/comments", read, handle.APIListComments)
+    v1.POST("/tickets/:id/comments", write, handle.APICreateComment)
+    v1.GET("/tickets/:id/attachments", read, handle.APIListAttachments)
+    v1.POST("/tickets/:id/attachments", write, handle.LimitUploads, handle.APIUploadAttachments)
+    v1.GET("/attachments/:id", read, handle.APIDownloadAttachment)
+    v1.DELETE("/attachments/:id", write, handle.APIDeleteAttachment)
+    v1.POST("/alerts", permissionRequired(db.PermAlertCreate), handle.APIReceiveAlerts)
+    v1.GET("/search", read, handle.APISearch)
+}
+
+router.GET("/profile", authRequired, sessionOnly, handle.ProfilePage)
+router.POST("/profile/email", authRequired, sessionOnly, handle.ProfileUpdateEmail)
+router.POST("/profile/tokens", authRequired, sessionOnly, handle.ProfileCreateToken)
+router.POST("/profile/tokens/:id/revoke", authRequired, sessionOnly, handle.ProfileRevokeToken)
+router.POST("/profile/sessions/revoke", authRequired, sessionOnly, handle.ProfileRevokeOtherSessions)
+router.POST("/profile/sessions/:id/revoke", authRequired, sessionOnly, handle.ProfileRevokeSession)
+router.POST("/profile/2fa/setup", authRequired, sessionOnly, handle.ProfileStartTOTP)
+router.POST("/profile/2fa/enable", authRequired, sessionOnly, handle.ProfileEnableTOTP)
+router.POST("/profile/2fa/disable", authRequired, sessionOnly, handle.ProfileDisableTOTP)
+router.POST("/profile/2fa/recovery", authRequired, sessionOnly, handle.ProfileRecoveryCodes)
+router.POST("/profile/passkeys/begin", authRequired, sessionOnly, handle.PasskeyRegisterBegin)
+router.POST("/profile/passkeys/finish", authRequired, sessionOnly, handle.PasskeyRegisterFinish)
+router.POST("/profile/passkeys/:id/delete", authRequired, sessionOnly, handle.ProfileDeletePasskey)
+
 
 	router.RunTLS(":443", "cert.pem", "key.pem")
 }
@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// DetectType détermine le type d'un contenu d'après ses premiers octets, sans
+// se fier au nom ni au type déclaré. Le type renvoyé est le plus précis
+// qu'allowed accepte : le type détecté ou, à défaut, l'un de ses parents
+// (text/plain pour un CSV, par exemple).
+func DetectType(r io.Reader, allowed func(string) bool) (string, error) {
+	detected, err := mimetype.DetectReader(r)
+	if err != nil {
+		return "", err
+	}
+	for m := detected; m != nil; m = m.Parent() {
+		base := strings.SplitN(m.String(), ";", 2)[0]
+		if allowed(base) {
+			return base, nil
+		}
+	}
+	return "", fmt.Errorf("type %s non autorisé", detected.String())
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// Blob décrit un blob à migrer, tel qu'enregistré par sa pièce jointe.
+type Blob struct {
+	Key         string
+	Size        int64
+	ContentType string
+	Checksum    string // SHA-256 en hexadécimal, vide si inconnu
+}
+
+type MigrateOptions struct {
+	DeleteSource bool // supprimer le blob source après une copie vérifiée
+	DryRun       bool // ne rien écrire, signaler seulement les blobs à copier
+	// Report reçoit chaque blob en erreur, et en DryRun chaque blob qui
+	// serait copié (err nil).
+	Report func(b Blob, err error)
+}
+
+type MigrateResult struct {
+	Copied, Skipped, Failed int
+}
+
+// Migrate copie les blobs de src vers dst. La copie est idempotente : un blob
+// déjà présent à destination est ignoré.
+func Migrate(ctx context.Context, src, dst Store, blobs []Blob, opts MigrateOptions) MigrateResult {
+	report := opts.Report
+	if report == nil {
+		report = func(Blob, error) {}
+	}
+
+	var res MigrateResult
+	for _, b := range blobs {
+		exists, err := dst.Exists(ctx, b.Key)
+		if err != nil {
+			report(b, err)
+			res.Failed++
+			continue
+		}
+		if exists {
+			res.Skipped++
+			continue
+		}
+		if opts.DryRun {
+			report(b, nil)
+			continue
+		}
+
+		if err := Copy(ctx, src, dst, b); err != nil {
+			report(b, err)
+			res.Failed++
+			continue
+		}
+		res.Copied++
+
+		if opts.DeleteSource {
+			if err := src.Delete(ctx, b.Key); err != nil {
+				report(b, fmt.Errorf("copie faite mais suppression source impossible : %w", err))
+			}
+		}
+	}
+	return res
+}
+
+// Copy copie un blob et vérifie son empreinte ; en cas d'écart la copie est
+// retirée de la destination.
+func Copy(ctx context.Context, src, dst Store, b Blob) error {
+	r, err := src.Get(ctx, b.Key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	hash := sha256.New()
+	if err := dst.Put(ctx, b.Key, io.TeeReader(r, hash), b.Size, b.ContentType); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); b.Checksum != "" && sum != b.Checksum {
+		dst.Delete(ctx, b.Key)
+		return fmt.Errorf("empreinte différente (%s au lieu de %s)", sum, b.Checksum)
+	}
+	return nil
+}
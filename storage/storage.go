@@ -0,0 +1,61 @@
+// Package storage conserve le contenu des pièces jointes hors de tickets.db,
+// derrière une interface commune à plusieurs pilotes.
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"sae/config"
+)
+
+var ErrNotFound = errors.New("blob introuvable")
+
+// Store est un stockage de blobs adressés par clé ("2025/10/3fa1...").
+type Store interface {
+	// Put écrit le contenu de r sous key ; size vaut -1 si inconnue.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get ouvre le blob ; l'appelant doit fermer le lecteur.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	Exists(ctx context.Context, key string) (bool, error)
+}
+
+// NewKey renvoie une clé aléatoire, préfixée par l'année et le mois.
+func NewKey() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return time.Now().Format("2006/01/") + hex.EncodeToString(buf), nil
+}
+
+// New construit le pilote choisi par cfg.StorageDriver.
+func New(cfg config.Config) (Store, error) {
+	return Open(cfg.StorageDriver, cfg)
+}
+
+// Open construit un pilote nommé ("local" ou "s3") ; utilisé par la
+// commande de migration pour ouvrir deux stockages à la fois.
+func Open(driver string, cfg config.Config) (Store, error) {
+	switch driver {
+	case "", "local":
+		return NewLocal(cfg.UploadDir), nil
+	case "s3":
+		return NewS3(S3Options{
+			Endpoint:  cfg.S3Endpoint,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			Region:    cfg.S3Region,
+			UseSSL:    cfg.S3UseSSL,
+		})
+	default:
+		return nil, fmt.Errorf("pilote de stockage inconnu : %q", driver)
+	}
+}
@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 est un stand-in S3 minimal, en mémoire, pour le pilote S3 : objets
+// adressés en path-style (/bucket/clé), PUT, GET, HEAD et DELETE. Les
+// signatures ne sont pas vérifiées.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string]fakeObject
+}
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *S3) {
+	t.Helper()
+	fake := &fakeS3{bucket: bucket, objects: map[string]fakeObject{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	s3, err := NewS3(S3Options{
+		Endpoint:  strings.TrimPrefix(srv.URL, "http://"),
+		Bucket:    bucket,
+		AccessKey: "test",
+		SecretKey: "testtesttest",
+		Region:    "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, s3
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		s3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		data, err := readS3Body(r)
+		if err != nil {
+			s3Error(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[key] = fakeObject{data: data, contentType: r.Header.Get("Content-Type")}
+		w.Header().Set("ETag", etag(data))
+	case http.MethodGet, http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			s3Error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag(obj.data))
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) object(key string) (fakeObject, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[key]
+	return obj, ok
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func s3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+	}
+}
+
+// readS3Body lit le corps d'un PUT, y compris en encodage aws-chunked
+// (signature en flux, utilisée par minio-go sans TLS).
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var out bytes.Buffer
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return out.Bytes(), nil
+		}
+		if _, err := io.CopyN(&out, br, size); err != nil {
+			return nil, err
+		}
+		if _, err := br.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func put(t *testing.T, s Store, key, content string) Blob {
+	t.Helper()
+	if err := s.Put(context.Background(), key, strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatalf("Put %s : %v", key, err)
+	}
+	sum := sha256.Sum256([]byte(content))
+	return Blob{Key: key, Size: int64(len(content)), ContentType: "text/plain", Checksum: hex.EncodeToString(sum[:])}
+}
+
+func get(t *testing.T, s Store, key string) string {
+	t.Helper()
+	r, err := s.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get %s : %v", key, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Get %s : %v", key, err)
+	}
+	return string(data)
+}
+
+func TestS3PutGetDelete(t *testing.T) {
+	ctx := context.Background()
+	fake, s3 := newFakeS3(t, "attachments")
+
+	put(t, s3, "2025/10/abc", "capture d'écran")
+	if obj, ok := fake.object("2025/10/abc"); !ok || obj.contentType != "text/plain" {
+		t.Fatalf("objet stocké : %+v, %v", obj, ok)
+	}
+	if got := get(t, s3, "2025/10/abc"); got != "capture d'écran" {
+		t.Fatalf("Get = %q", got)
+	}
+	if ok, err := s3.Exists(ctx, "2025/10/abc"); err != nil || !ok {
+		t.Fatalf("Exists = %v, %v", ok, err)
+	}
+
+	if err := s3.Delete(ctx, "2025/10/abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3.Get(ctx, "2025/10/abc"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get après Delete : %v, attendu ErrNotFound", err)
+	}
+	if ok, err := s3.Exists(ctx, "2025/10/abc"); err != nil || ok {
+		t.Fatalf("Exists après Delete = %v, %v", ok, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	local := NewLocal(t.TempDir())
+	_, s3 := newFakeS3(t, "attachments")
+
+	blobs := []Blob{
+		put(t, local, "2025/10/a", "premier"),
+		put(t, local, "2025/10/b", "second"),
+	}
+	// Déjà présent à destination : ignoré.
+	put(t, s3, "2025/10/b", "second")
+
+	res := Migrate(ctx, local, s3, blobs, MigrateOptions{DeleteSource: true})
+	if res != (MigrateResult{Copied: 1, Skipped: 1}) {
+		t.Fatalf("Migrate = %+v", res)
+	}
+	if got := get(t, s3, "2025/10/a"); got != "premier" {
+		t.Fatalf("blob migré = %q", got)
+	}
+	if ok, _ := local.Exists(ctx, "2025/10/a"); ok {
+		t.Fatal("le blob source copié aurait dû être supprimé")
+	}
+	if ok, _ := local.Exists(ctx, "2025/10/b"); !ok {
+		t.Fatal("un blob ignoré ne doit pas être supprimé de la source")
+	}
+
+	// Relancer la migration ne recopie rien.
+	if res := Migrate(ctx, local, s3, blobs, MigrateOptions{}); res != (MigrateResult{Skipped: 2}) {
+		t.Fatalf("seconde migration = %+v", res)
+	}
+
+	// Et dans l'autre sens, vers le disque.
+	back := NewLocal(t.TempDir())
+	if res := Migrate(ctx, s3, back, blobs, MigrateOptions{}); res != (MigrateResult{Copied: 2}) {
+		t.Fatalf("migration retour = %+v", res)
+	}
+	if got := get(t, back, "2025/10/b"); got != "second" {
+		t.Fatalf("blob rapatrié = %q", got)
+	}
+}
+
+func TestMigrateChecksumMismatch(t *testing.T) {
+	ctx := context.Background()
+	local := NewLocal(t.TempDir())
+	_, s3 := newFakeS3(t, "attachments")
+
+	b := put(t, local, "2025/10/c", "contenu")
+	b.Checksum = strings.Repeat("0", 64)
+
+	var reported []error
+	res := Migrate(ctx, local, s3, []Blob{b}, MigrateOptions{
+		DeleteSource: true,
+		Report:       func(_ Blob, err error) { reported = append(reported, err) },
+	})
+	if res != (MigrateResult{Failed: 1}) || len(reported) != 1 {
+		t.Fatalf("Migrate = %+v, erreurs %v", res, reported)
+	}
+	if ok, _ := s3.Exists(ctx, b.Key); ok {
+		t.Fatal("une copie à l'empreinte fausse doit être retirée de la destination")
+	}
+	if ok, _ := local.Exists(ctx, b.Key); !ok {
+		t.Fatal("la source ne doit pas être supprimée après un échec")
+	}
+}
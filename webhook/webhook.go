@@ -0,0 +1,217 @@
+// Package webhook envoie les événements des tickets aux abonnements gérés
+// dans /admin (db.Webhook).
+//
+// Chaque événement retenu est enregistré dans la file db.WebhookDelivery,
+// dans la transaction du changement, puis envoyé en POST JSON par un worker
+// qui réessaie avec un délai exponentiel. Chaque requête est signée :
+//
+//	X-GTM-Timestamp: <secondes Unix>
+//	X-GTM-Signature: sha256=<hex(HMAC-SHA256(secret, timestamp + "." + corps))>
+//
+// Le destinataire recalcule la signature et refuse un horodatage trop ancien.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sae/config"
+	"sae/db"
+
+	"gorm.io/gorm"
+)
+
+// Payload est le corps JSON envoyé.
+type Payload struct {
+	Event      string            `json:"event"`
+	OccurredAt time.Time         `json:"occurred_at"`
+	Actor      string            `json:"actor"`
+	Ticket     Ticket            `json:"ticket"`
+	Data       map[string]string `json:"data,omitempty"`
+}
+
+type Ticket struct {
+	ID         uint   `json:"id"`
+	Title      string `json:"title"`
+	User       string `json:"user"`
+	State      string `json:"state"`
+	Priority   string `json:"priority"`
+	AssigneeID *uint  `json:"assignee_id"`
+	URL        string `json:"url"`
+}
+
+type Dispatcher struct {
+	DB          *gorm.DB
+	Client      *http.Client
+	BaseURL     string
+	MaxAttempts int
+}
+
+func New(database *gorm.DB, cfg config.Config) *Dispatcher {
+	return &Dispatcher{
+		DB:          database,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		BaseURL:     cfg.BaseURL,
+		MaxAttempts: int(cfg.WebhookMaxAttempts),
+	}
+}
+
+// Subscribe branche le dispatcher sur les événements des tickets.
+func (d *Dispatcher) Subscribe() {
+	db.Subscribe(d.enqueue)
+}
+
+// Les événements propres aux notifications (changement d'état, assignation...)
+// sont déjà couverts par ticket.updated.
+func (d *Dispatcher) enqueue(tx *gorm.DB, e db.Event) {
+	switch e.Type {
+	case db.EventTicketCreated, db.EventTicketCommented, db.EventTicketDeleted:
+	case db.EventTicketUpdated:
+		// Les messages ont leur propre événement, ticket.commented.
+		if f := e.Data["field"]; f == db.HistoryComment || f == db.HistoryInternalNote {
+			return
+		}
+	default:
+		return
+	}
+
+	var hooks []db.Webhook
+	if err := tx.Where("active = ?", true).Find(&hooks).Error; err != nil || len(hooks) == 0 {
+		return
+	}
+
+	// Les changements sont publiés avec le ticket enregistré (db.SaveTicket).
+	ticket := Ticket{
+		ID:         e.Ticket.ID,
+		Title:      e.Ticket.Title,
+		User:       e.Ticket.User,
+		State:      e.Ticket.State,
+		Priority:   e.Ticket.Priority,
+		AssigneeID: e.Ticket.AssigneeID,
+		URL:        fmt.Sprintf("%s/ticket/%d", d.BaseURL, e.Ticket.ID),
+	}
+
+	body, err := json.Marshal(Payload{
+		Event:      e.Type,
+		OccurredAt: e.At,
+		Actor:      e.Actor,
+		Data:       e.Data,
+		Ticket:     ticket,
+	})
+	if err != nil {
+		log.Println("Webhook :", err)
+		return
+	}
+
+	for _, h := range hooks {
+		if !h.Wants(e.Type) {
+			continue
+		}
+		delivery := db.WebhookDelivery{
+			WebhookID: h.ID,
+			Event:     e.Type,
+			TicketID:  e.Ticket.ID,
+			Payload:   string(body),
+		}
+		if err := db.EnqueueDelivery(tx, &delivery); err != nil {
+			log.Printf("Webhook %d : %v", h.ID, err)
+		}
+	}
+}
+
+// Start lance l'envoi de la file jusqu'à l'annulation de ctx.
+func (d *Dispatcher) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(2 * time.Second)
+		defer ticker.Stop()
+		for {
+			d.SendDue(ctx, time.Now())
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// SendDue fait les envois dus. Un abonnement désactivé entre-temps n'est
+// plus servi : ses envois sont abandonnés.
+func (d *Dispatcher) SendDue(ctx context.Context, now time.Time) {
+	deliveries, err := db.DueDeliveries(d.DB, now, 20)
+	if err != nil {
+		log.Println("File des webhooks :", err)
+		return
+	}
+	for i := range deliveries {
+		dl := &deliveries[i]
+		if ok, err := db.ClaimDelivery(d.DB, dl, time.Minute); err != nil || !ok {
+			continue
+		}
+		if !dl.Webhook.Active {
+			db.RecordDeliveryAttempt(d.DB, dl, 0, fmt.Errorf("abonnement désactivé"), 0)
+			continue
+		}
+
+		code, err := d.post(ctx, dl)
+		retry := backoff(dl.Attempts + 1)
+		if dl.Attempts+1 >= d.MaxAttempts {
+			retry = 0
+		}
+		db.RecordDeliveryAttempt(d.DB, dl, code, err, retry)
+	}
+}
+
+// Sign calcule la signature d'un corps pour un horodatage donné.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *Dispatcher) post(ctx context.Context, dl *db.WebhookDelivery) (int, error) {
+	body := []byte(dl.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dl.Webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-ticket-manager-webhook")
+	req.Header.Set("X-GTM-Event", dl.Event)
+	req.Header.Set("X-GTM-Delivery", strconv.FormatUint(uint64(dl.ID), 10))
+	req.Header.Set("X-GTM-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("X-GTM-Signature", Sign(dl.Webhook.Secret, ts, body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("réponse HTTP %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff renvoie le délai avant la tentative suivante : 10 s, 20 s, 40 s…
+// plafonné à une heure.
+func backoff(attempts int) time.Duration {
+	d := 10 * time.Second
+	for i := 1; i < attempts && d < time.Hour; i++ {
+		d *= 2
+	}
+	return min(d, time.Hour)
+}
@@ -0,0 +1,193 @@
+// Package workflow décrit le cycle de vie des tickets : les états, les
+// transitions permises, les rôles autorisés à les franchir et les champs
+// exigés (par exemple une note de résolution à la fermeture).
+//
+// La définition par défaut reprend les états historiques open, in_progress et
+// closed ; une autre définition peut être chargée depuis un fichier JSON
+// (GTM_WORKFLOW_FILE, voir workflow.example.json).
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+type State struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	// Closed marque les états terminaux : le ticket reçoit une date de fermeture.
+	Closed bool `json:"closed"`
+}
+
+type Transition struct {
+	From  string   `json:"from"`
+	To    string   `json:"to"`
+	Roles []string `json:"roles"`
+	// Requires liste les champs qui doivent être non vides, parmi Fields.
+	Requires []string `json:"requires"`
+}
+
+type Definition struct {
+	Initial     string       `json:"initial"`
+	States      []State      `json:"states"`
+	Transitions []Transition `json:"transitions"`
+}
+
+var (
+	ErrUnknownState  = errors.New("état inconnu")
+	ErrNotAllowed    = errors.New("transition non permise")
+	ErrRoleForbidden = errors.New("rôle non autorisé pour cette transition")
+)
+
+// MissingFieldError signale un champ exigé par la transition mais absent.
+type MissingFieldError struct {
+	Field string
+}
+
+func (e *MissingFieldError) Error() string {
+	return fmt.Sprintf("le champ %q est obligatoire pour cette transition", e.Field)
+}
+
+var staff = []string{"Supervisor", "Admin"}
+
+// Fields liste les champs qu'une transition peut exiger : ceux que les
+// formulaires et l'API transmettent avec un changement d'état. Un autre nom
+// rendrait la transition impossible, Validate le refuse.
+var Fields = []string{"resolution"}
+
+// Default est le workflow utilisé quand aucun fichier n'est configuré.
+func Default() *Definition {
+	return &Definition{
+		Initial: "open",
+		States: []State{
+			{Name: "open", Label: "Ouvert"},
+			{Name: "in_progress", Label: "En cours"},
+			{Name: "closed", Label: "Fermé", Closed: true},
+		},
+		Transitions: []Transition{
+			{From: "open", To: "in_progress", Roles: staff},
+			{From: "in_progress", To: "open", Roles: staff},
+			{From: "open", To: "closed", Roles: staff, Requires: []string{"resolution"}},
+			{From: "in_progress", To: "closed", Roles: staff, Requires: []string{"resolution"}},
+			{From: "closed", To: "open", Roles: staff},
+		},
+	}
+}
+
+// Load lit une définition JSON ; un chemin vide renvoie Default().
+func Load(path string) (*Definition, error) {
+	if path == "" {
+		return Default(), nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var d Definition
+	if err := json.Unmarshal(raw, &d); err != nil {
+		return nil, fmt.Errorf("%s : %w", path, err)
+	}
+	if err := d.Validate(); err != nil {
+		return nil, fmt.Errorf("%s : %w", path, err)
+	}
+	return &d, nil
+}
+
+// Validate vérifie que l'état initial et les transitions citent des états
+// déclarés, et que les champs exigés font partie de Fields.
+func (d *Definition) Validate() error {
+	if len(d.States) == 0 {
+		return errors.New("aucun état déclaré")
+	}
+	if !d.IsState(d.Initial) {
+		return fmt.Errorf("état initial %q : %w", d.Initial, ErrUnknownState)
+	}
+	for _, t := range d.Transitions {
+		if !d.IsState(t.From) || !d.IsState(t.To) {
+			return fmt.Errorf("transition %s → %s : %w", t.From, t.To, ErrUnknownState)
+		}
+		if len(t.Roles) == 0 {
+			return fmt.Errorf("transition %s → %s : aucun rôle autorisé", t.From, t.To)
+		}
+		for _, f := range t.Requires {
+			if !slices.Contains(Fields, f) {
+				return fmt.Errorf("transition %s → %s : champ exigé %q inconnu (possibles : %s)", t.From, t.To, f, strings.Join(Fields, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Definition) state(name string) (State, bool) {
+	for _, s := range d.States {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return State{}, false
+}
+
+func (d *Definition) IsState(name string) bool {
+	_, ok := d.state(name)
+	return ok
+}
+
+// IsClosed indique si l'état est terminal.
+func (d *Definition) IsClosed(name string) bool {
+	s, ok := d.state(name)
+	return ok && s.Closed
+}
+
+func (d *Definition) transition(from, to string) (Transition, bool) {
+	for _, t := range d.Transitions {
+		if t.From == from && t.To == to {
+			return t, true
+		}
+	}
+	return Transition{}, false
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Check valide le passage de from à to pour role ; fields contient les
+// valeurs fournies avec la demande (ex : fields["resolution"]).
+func (d *Definition) Check(from, to, role string, fields map[string]string) error {
+	if !d.IsState(to) {
+		return fmt.Errorf("%q : %w", to, ErrUnknownState)
+	}
+	t, ok := d.transition(from, to)
+	if !ok {
+		return fmt.Errorf("%s → %s : %w", from, to, ErrNotAllowed)
+	}
+	if !hasRole(t.Roles, role) {
+		return fmt.Errorf("%s → %s : %w", from, to, ErrRoleForbidden)
+	}
+	for _, f := range t.Requires {
+		if fields[f] == "" {
+			return &MissingFieldError{Field: f}
+		}
+	}
+	return nil
+}
+
+// Next renvoie les états atteignables depuis from pour role.
+func (d *Definition) Next(from, role string) []string {
+	var out []string
+	for _, t := range d.Transitions {
+		if t.From == from && hasRole(t.Roles, role) {
+			out = append(out, t.To)
+		}
+	}
+	return out
+}